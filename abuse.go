@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// abuseHalfLife is how quickly a connection's anomaly score fades
+const abuseHalfLife = time.Minute
+
+// defaultAbuseWeights score the anomalies a connection can trigger; -abuse-weights overrides them
+var defaultAbuseWeights = map[string]float64{
+	// signaling or room commands sent before joining
+	"prejoin-signal": 3,
+	// targeted messages for clients that aren't in the room
+	"missing-target": 1,
+	"invalid-json":   2,
+	"unknown-type":   1,
+	// hopping between rooms over one connection
+	"room-switch": 2,
+	// join or resume messages rejected as replays
+	"replay": 5,
+}
+
+// abuseScore accumulates a connection's weighted anomalies with exponential decay
+type abuseScore struct {
+	mutex   sync.Mutex
+	score   float64
+	updated time.Time
+	// flagged is set while the score is above the threshold, so each
+	// crossing is reported once
+	flagged bool
+}
+
+// suspect records an anomalous event for the connection. Crossing
+// -abuse-threshold logs an 'abuse-suspected' event and, with
+// -abuse-action=disconnect, closes the connection.
+func (c *Client) suspect(event string) {
+	if config.AbuseThreshold <= 0 {
+		return
+	}
+	weight := config.AbuseWeights[event]
+	if weight <= 0 {
+		return
+	}
+	a := &c.abuse
+	a.mutex.Lock()
+	now := time.Now()
+	if !a.updated.IsZero() {
+		a.score *= math.Exp2(-float64(now.Sub(a.updated)) / float64(abuseHalfLife))
+	}
+	a.score += weight
+	a.updated = now
+	score := a.score
+	crossed := !a.flagged && score >= config.AbuseThreshold
+	if crossed {
+		a.flagged = true
+	} else if score < config.AbuseThreshold/2 {
+		a.flagged = false
+	}
+	a.mutex.Unlock()
+	if !crossed {
+		return
+	}
+
+	roomName := ""
+	if c.room() != nil {
+		roomName = c.room().Name
+	}
+	log.Printf("abuse-suspected remoteIp=%q client=%q room=%q userAgent=%q event=%q score=%.1f action=%q",
+		c.RemoteIP, c.name(), roomName, c.UserAgent, event, score, config.AbuseAction)
+	if config.AbuseAction == "disconnect" {
+		c.disconnect(websocket.ClosePolicyViolation, "abuse-suspected")
+	}
+}
+
+// parseAbuseWeights applies comma-separated event=weight overrides to the default weights
+func parseAbuseWeights(overrides string) (map[string]float64, error) {
+	weights := make(map[string]float64, len(defaultAbuseWeights))
+	for event, weight := range defaultAbuseWeights {
+		weights[event] = weight
+	}
+	for _, entry := range splitList(overrides) {
+		event, value, _ := strings.Cut(entry, "=")
+		event = strings.TrimSpace(event)
+		if _, known := defaultAbuseWeights[event]; !known {
+			return nil, fmt.Errorf("unknown abuse event '%s'", event)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight for abuse event '%s'", event)
+		}
+		weights[event] = weight
+	}
+	return weights, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// roomInfo is the admin view of a single room
+type roomInfo struct {
+	Name    string       `json:"name"`
+	Clients []clientInfo `json:"clients"`
+	Usage   usage        `json:"usage"`
+}
+
+// clientInfo is the admin view of a single client connection
+type clientInfo struct {
+	Name        string    `json:"name"`
+	RemoteIP    string    `json:"remoteIp"`
+	UserAgent   string    `json:"userAgent"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Usage       usage     `json:"usage"`
+	Hidden      bool      `json:"hidden,omitempty"`
+}
+
+// clientInfos snapshots the admin view of every client in the room, sorted by name
+func (r *Room) clientInfos() []clientInfo {
+	r.Mutex.Lock()
+	infos := make([]clientInfo, 0, len(r.Clients))
+	for name, client := range r.Clients {
+		infos = append(infos, clientInfo{
+			Name:        name,
+			RemoteIP:    client.RemoteIP,
+			UserAgent:   client.UserAgent,
+			ConnectedAt: client.ConnectedAt,
+			Usage:       client.usage(),
+			Hidden:      client.Hidden,
+		})
+	}
+	r.Mutex.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// writeJSON encodes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Admin response encode error:", err)
+	}
+}
+
+// handleRooms lists every room with its connected clients
+func handleRooms(w http.ResponseWriter, r *http.Request) {
+	rooms := server.Rooms.List()
+	infos := make([]roomInfo, 0, len(rooms))
+	total := 0
+	for _, room := range rooms {
+		clients := room.clientInfos()
+		total += len(clients)
+		infos = append(infos, roomInfo{Name: room.Name, Clients: clients, Usage: room.usage()})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"draining":     server.Draining.Load(),
+		"totalClients": total,
+		"rooms":        infos,
+		"resumeSessions": map[string]interface{}{
+			"size": server.Sessions.Size(),
+			"max":  config.MaxResumeSessions,
+		},
+	})
+}
+
+// handleDrain reports the draining flag (GET), enables it (POST) or disables it (DELETE)
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		server.Draining.Store(true)
+		log.Println("Draining enabled. New connections will be rejected.")
+	case http.MethodDelete:
+		server.Draining.Store(false)
+		log.Println("Draining disabled. Accepting new connections.")
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"draining": server.Draining.Load(),
+	})
+}
+
+// mergeRequest is the body of POST /admin/merge
+type mergeRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// OnConflict is "reject" (default) to refuse the merge when names clash,
+	// or "rename" to give clashing clients a free name in the destination
+	OnConflict string `json:"onConflict"`
+}
+
+// handleMerge moves every client of one room into another and deletes the
+// source room once it is empty
+func handleMerge(w http.ResponseWriter, r *http.Request) {
+	var req mergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.OnConflict == "" {
+		req.OnConflict = "reject"
+	}
+	if req.From == "" || req.To == "" || req.From == req.To {
+		http.Error(w, "'from' and 'to' must be two different rooms", http.StatusBadRequest)
+		return
+	}
+	if req.OnConflict != "reject" && req.OnConflict != "rename" {
+		http.Error(w, "'onConflict' must be 'reject' or 'rename'", http.StatusBadRequest)
+		return
+	}
+	source, exists := server.Rooms.Get(req.From)
+	if !exists {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+	destination, err := server.openRoom(req.To, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	source.Mutex.Lock()
+	clients := make([]*Client, 0, len(source.Clients))
+	arriving := 0
+	for _, client := range source.Clients {
+		clients = append(clients, client)
+		if !client.Hidden {
+			arriving++
+		}
+	}
+	source.Mutex.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ConnectedAt.Before(clients[j].ConnectedAt) })
+
+	destination.Mutex.Lock()
+	conflicts := make([]string, 0)
+	for _, client := range clients {
+		if _, taken := destination.Clients[client.name()]; taken {
+			conflicts = append(conflicts, client.name())
+		}
+	}
+	occupancy := destination.visibleCount()
+	destination.Mutex.Unlock()
+	if req.OnConflict == "reject" && len(conflicts) > 0 {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"error": "name-conflict", "conflicts": conflicts})
+		return
+	}
+	if capacity := destination.capacity(); capacity > 0 && occupancy+arriving > capacity {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"error": "room-full", "capacity": capacity})
+		return
+	}
+
+	log.Printf("Merging room '%s' (%d clients) into room '%s'", source.Name, len(clients), destination.Name)
+	moved := make(map[string]string)
+	failed := make(map[string]string)
+	for _, client := range clients {
+		// Both names are taken on the client's goroutine, around the move,
+		// since the client may rename itself until then
+		var oldName, newName string
+		err := client.do(func() error {
+			oldName = client.name()
+			name := oldName
+			if req.OnConflict == "rename" {
+				name = destination.freeName(name)
+			}
+			if err := client.moveTo(destination, name); err != nil {
+				return err
+			}
+			newName = client.name()
+			return nil
+		})
+		if err != nil {
+			// The client kept its name, and may have left without running the move
+			name := client.name()
+			log.Printf("Could not move client '%s' to room '%s': %v", name, destination.Name, err)
+			failed[name] = err.Error()
+			continue
+		}
+		moved[oldName] = newName
+	}
+
+	deleted := false
+	source.Mutex.Lock()
+	if len(source.Clients) == 0 {
+		source.deleted = true
+		server.Rooms.Delete(source.Name)
+		deleted = true
+	}
+	source.Mutex.Unlock()
+	if deleted {
+		log.Printf("Room '%s' deleted after merge", source.Name)
+		server.Webhooks.emit("room-destroyed", map[string]interface{}{"room": source.Name})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"moved":         moved,
+		"failed":        failed,
+		"sourceDeleted": deleted,
+	})
+}
+
+// clientMatch is one connection found by handleClient
+type clientMatch struct {
+	Room string `json:"room"`
+	clientInfo
+	// SendBacklog is the number of messages queued for the client
+	SendBacklog int `json:"sendBacklog"`
+}
+
+// handleClient looks a client name up in every room; names are only unique
+// per room, so it can match several connections
+func handleClient(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	matches := make([]clientMatch, 0)
+	for _, room := range server.Rooms.List() {
+		room.Mutex.Lock()
+		client, exists := room.Clients[name]
+		room.Mutex.Unlock()
+		if !exists {
+			continue
+		}
+		matches = append(matches, clientMatch{
+			Room: room.Name,
+			clientInfo: clientInfo{
+				Name:        name,
+				RemoteIP:    client.RemoteIP,
+				UserAgent:   client.UserAgent,
+				ConnectedAt: client.ConnectedAt,
+				Usage:       client.usage(),
+				Hidden:      client.Hidden,
+			},
+			SendBacklog: len(client.Send),
+		})
+	}
+	if len(matches) == 0 {
+		http.Error(w, "client not found", http.StatusNotFound)
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Room < matches[j].Room })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"clients": matches})
+}
+
+// handleRevokeSession invalidates a resume token so it can't be used again
+func handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID == "" {
+		http.Error(w, "body must be JSON with a 'sessionId'", http.StatusBadRequest)
+		return
+	}
+	if !server.Sessions.revoke(req.SessionID) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"revoked": true})
+}
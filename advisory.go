@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+)
+
+// A full mesh costs every client an upstream per peer, so beyond a few
+// participants it stops working. When a mesh room grows past
+// -mesh-advisory-size clients, the server broadcasts a 'topology-advisory'
+// suggesting a star arrangement, in which peers connect only to a relay
+// peer (or an SFU of their own) instead of to each other:
+//
+//	{"type": "topology-advisory", "topology": "star", "clients": 9, "threshold": 8, "relay": "alice"}
+//
+// The relay is the longest-connected visible client, so every client agrees
+// on it; -advisory-relay=false leaves the choice to the clients. Once the
+// room shrinks back, a "mesh" advisory follows. The server keeps relaying
+// signaling as before: clients decide whether to follow the advice.
+
+// updateAdvisory re-evaluates the room's topology advisory after its
+// membership changed, or a client's name or connection did, and broadcasts
+// it when it changed. A client that just joined a room that is already past
+// the threshold gets the current one. Updates run one at a time, from the
+// evaluation to the broadcast, so concurrent changes can't deliver their
+// advisories out of order and leave clients with a stale one.
+func (r *Room) updateAdvisory(joined *Client) {
+	if config.MeshAdvisorySize <= 0 {
+		return
+	}
+	r.advisoryMutex.Lock()
+	defer r.advisoryMutex.Unlock()
+	r.Mutex.Lock()
+	clients := r.visibleCount()
+	large := r.mode() == roomModeMesh && clients > config.MeshAdvisorySize
+	relay := ""
+	if large && config.AdvisoryRelay {
+		relay = r.relayPeer()
+	}
+	changed := large != r.advised || relay != r.advisedRelay
+	r.advised, r.advisedRelay = large, relay
+	r.Mutex.Unlock()
+	if !changed && (!large || joined == nil) {
+		return
+	}
+
+	advisory := map[string]interface{}{
+		"type":      "topology-advisory",
+		"topology":  "mesh",
+		"clients":   clients,
+		"threshold": config.MeshAdvisorySize,
+	}
+	if large {
+		advisory["topology"] = "star"
+	}
+	if relay != "" {
+		advisory["relay"] = relay
+	}
+	advisoryJSON, _ := json.Marshal(advisory)
+	if !changed {
+		joined.trySend(advisoryJSON)
+		return
+	}
+	log.Printf("Room '%s' has %d clients; advising topology '%s' (relay '%s')", r.Name, clients, advisory["topology"], relay)
+	r.Broadcast(advisoryJSON, "", false)
+}
+
+// relayPeer picks the visible client connected the longest, ties broken by
+// name. The caller must hold r.Mutex.
+func (r *Room) relayPeer() string {
+	candidates := make([]*Client, 0, len(r.Clients))
+	for _, client := range r.Clients {
+		if !client.Hidden {
+			candidates = append(candidates, client)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if !candidates[i].ConnectedAt.Equal(candidates[j].ConnectedAt) {
+			return candidates[i].ConnectedAt.Before(candidates[j].ConnectedAt)
+		}
+		return candidates[i].name() < candidates[j].name()
+	})
+	return candidates[0].name()
+}
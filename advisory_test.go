@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// adviseMeshesOver sets -mesh-advisory-size for the rest of the test. Every
+// client reads it on joins and leaves, so it only changes while none are
+// connected.
+func adviseMeshesOver(t *testing.T, size int) {
+	t.Helper()
+	waitFor(t, 5*time.Second, "earlier tests' clients to be cleaned up", func() bool { return server.connected.Load() == 0 })
+	previous := config.MeshAdvisorySize
+	config.MeshAdvisorySize = size
+	t.Cleanup(func() {
+		waitFor(t, 5*time.Second, "the test's clients to be cleaned up", func() bool { return server.connected.Load() == 0 })
+		config.MeshAdvisorySize = previous
+	})
+}
+
+// closeAll closes the sockets when the test ends, ahead of the cleanups
+// registered before it
+func closeAll(t *testing.T, sockets ...*fakeSocket) {
+	t.Cleanup(func() {
+		for _, socket := range sockets {
+			socket.Close()
+		}
+	})
+}
+
+func TestAdvisoryFollowsRenamedRelay(t *testing.T) {
+	adviseMeshesOver(t, 2)
+	room := t.Name()
+	alice := joinFake(t, room, "alice")
+	bob := joinFake(t, room, "bob")
+	carol := joinFake(t, room, "carol")
+	closeAll(t, alice, bob, carol)
+	if advisory := bob.expect("topology-advisory"); advisory["topology"] != "star" || advisory["relay"] != "alice" {
+		t.Fatalf("bob got advisory %v, want star with relay alice", advisory)
+	}
+
+	alice.feed(map[string]interface{}{"type": "rename", "name": "anna"})
+	bob.expect("renamed")
+	if advisory := bob.expect("topology-advisory"); advisory["relay"] != "anna" {
+		t.Fatalf("bob got advisory %v after the relay's rename, want relay anna", advisory)
+	}
+}
+
+func TestAdvisoryAfterRelayResumes(t *testing.T) {
+	adviseMeshesOver(t, 2)
+	room := t.Name()
+	alice := joinFake(t, room, "alice")
+	r, _ := server.Rooms.Get(room)
+	r.Mutex.Lock()
+	r.ResumeGrace = time.Minute
+	r.Mutex.Unlock()
+	// alice joined before resume was on; rejoin for a token
+	alice.feed(map[string]interface{}{"type": "leave"})
+	waitFor(t, 5*time.Second, "alice to leave", alice.isClosed)
+	alice = serveFake(t, "/ws")
+	alice.feed(map[string]interface{}{"type": "join", "room": room, "name": "alice"})
+	token, _ := alice.expect("joined")["resumeToken"].(string)
+	if token == "" {
+		t.Fatal("alice got no resume token")
+	}
+	bob := joinFake(t, room, "bob")
+	carol := joinFake(t, room, "carol")
+	if advisory := bob.expect("topology-advisory"); advisory["relay"] != "alice" {
+		t.Fatalf("bob got advisory %v, want relay alice", advisory)
+	}
+
+	// The resumed connection is the newest, so bob becomes the relay
+	alice.feed(map[string]interface{}{"type": "leave", "temporary": true})
+	waitFor(t, 5*time.Second, "alice to leave", alice.isClosed)
+	resumed := serveFake(t, "/ws")
+	closeAll(t, bob, carol, resumed)
+	resumed.feed(map[string]interface{}{"type": "resume", "token": token})
+	resumed.expect("joined")
+	if advisory := bob.expect("topology-advisory"); advisory["relay"] != "bob" {
+		t.Fatalf("bob got advisory %v after alice resumed, want relay bob", advisory)
+	}
+	if advisory := resumed.expect("topology-advisory"); advisory["relay"] != "bob" {
+		t.Fatalf("alice got advisory %v after resuming, want relay bob", advisory)
+	}
+}
+
+// lastAdvisory returns the last 'topology-advisory' f got before its reply
+// to a 'whereami' sent now, or nil if there was none
+func (f *fakeSocket) lastAdvisory() map[string]interface{} {
+	f.t.Helper()
+	f.feed(map[string]interface{}{"type": "whereami"})
+	var last map[string]interface{}
+	for {
+		data, ok := f.next(time.Now().Add(5 * time.Second))
+		if !ok {
+			f.t.Fatal("timed out waiting for 'whereami'")
+		}
+		var message map[string]interface{}
+		json.Unmarshal(data, &message)
+		switch message["type"] {
+		case "topology-advisory":
+			last = message
+		case "whereami":
+			return last
+		}
+	}
+}
+
+// TestAdvisoryOrderUnderChurn joins and drops clients concurrently around
+// the threshold and checks that the last advisory an observer gets matches
+// the room once it settles
+func TestAdvisoryOrderUnderChurn(t *testing.T) {
+	adviseMeshesOver(t, 4)
+	room := t.Name()
+	observer := joinFake(t, room, "observer")
+	closeAll(t, observer)
+	for round := 0; round < 20; round++ {
+		sockets := make([]*fakeSocket, 8)
+		for i := range sockets {
+			sockets[i] = serveFake(t, "/ws")
+		}
+		var wg sync.WaitGroup
+		for i, socket := range sockets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				socket.feed(map[string]interface{}{"type": "join", "room": room, "name": fmt.Sprintf("peer-%d", i)})
+				if _, ok := socket.await("joined", 5*time.Second); !ok {
+					t.Errorf("peer %d was not joined", i)
+					return
+				}
+				// Half leave again right away; the others wait until their
+				// join, advisory included, is handled
+				if i%2 == 1 {
+					socket.hangUp(websocket.CloseNormalClosure)
+					return
+				}
+				socket.feed(map[string]interface{}{"type": "whereami"})
+				if _, ok := socket.await("whereami", 5*time.Second); !ok {
+					t.Errorf("peer %d got no 'whereami' reply", i)
+				}
+			}()
+		}
+		wg.Wait()
+		if t.Failed() {
+			t.FailNow()
+		}
+		waitFor(t, 5*time.Second, "the leaving peers' cleanup", func() bool { return server.connected.Load() == 5 })
+		if advisory := observer.lastAdvisory(); advisory == nil || advisory["topology"] != "star" || advisory["relay"] != "observer" {
+			t.Fatalf("round %d: with 5 clients the observer was last advised %v, want star with relay observer", round, advisory)
+		}
+
+		for _, socket := range sockets {
+			socket.Close()
+		}
+		waitFor(t, 5*time.Second, "the peers' cleanup", func() bool { return server.connected.Load() == 1 })
+		if advisory := observer.lastAdvisory(); advisory == nil || advisory["topology"] != "mesh" {
+			t.Fatalf("round %d: alone, the observer was last advised %v, want mesh", round, advisory)
+		}
+	}
+}
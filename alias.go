@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// roomAliases redirects old room names to their canonical rooms, so invite
+// links keep working after rooms are renamed or consolidated
+type roomAliases struct {
+	mutex   sync.Mutex
+	targets map[string]string
+}
+
+func newRoomAliases() *roomAliases {
+	return &roomAliases{targets: make(map[string]string)}
+}
+
+// resolve returns the canonical name for a room name
+func (a *roomAliases) resolve(name string) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if target, ok := a.targets[name]; ok {
+		return target
+	}
+	return name
+}
+
+// set points alias at room. Aliases don't chain: the target must be a
+// canonical name and an alias can't also be a target.
+func (a *roomAliases) set(alias, room string) error {
+	alias, room = strings.TrimSpace(alias), strings.TrimSpace(room)
+	if alias == "" || room == "" || alias == room {
+		return fmt.Errorf("alias and room must be two different, non-empty names")
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, isAlias := a.targets[room]; isAlias {
+		return fmt.Errorf("'%s' is itself an alias", room)
+	}
+	for existing, target := range a.targets {
+		if target == alias {
+			return fmt.Errorf("'%s' is the target of alias '%s'", alias, existing)
+		}
+	}
+	a.targets[alias] = room
+	log.Printf("Room alias '%s' now redirects to room '%s'", alias, room)
+	return nil
+}
+
+// remove deletes an alias and reports whether it existed
+func (a *roomAliases) remove(alias string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	_, exists := a.targets[alias]
+	delete(a.targets, alias)
+	return exists
+}
+
+// parse loads comma-separated alias=room pairs from -room-aliases
+func (a *roomAliases) parse(pairs string) error {
+	for _, entry := range splitList(pairs) {
+		alias, room, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid room alias %q, want alias=room", entry)
+		}
+		if err := a.set(alias, room); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleRoomAlias creates or replaces (PUT) or deletes (DELETE) the alias in the path
+func handleRoomAlias(w http.ResponseWriter, r *http.Request) {
+	alias := r.PathValue("alias")
+	if r.Method == http.MethodDelete {
+		if !server.Aliases.remove(alias) {
+			http.Error(w, "alias not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"alias": alias, "deleted": true})
+		return
+	}
+	var req struct {
+		Room string `json:"room"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := server.Aliases.set(alias, req.Room); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"alias": alias, "room": strings.TrimSpace(req.Room)})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// defaultPalette is used for peer colors unless -color-palette overrides it
+var defaultPalette = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4", "#42d4f4",
+	"#f032e6", "#469990", "#9a6324", "#800000", "#808000", "#000075",
+}
+
+// appearance is the cosmetic identity derived from a client's name, so every
+// peer renders the same color and avatar without coordinating
+type appearance struct {
+	Color      string `json:"color"`
+	AvatarSeed string `json:"avatarSeed"`
+}
+
+// appearanceOf maps name to a stable palette color and avatar seed
+func appearanceOf(name string) appearance {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	sum := hash.Sum64()
+	return appearance{
+		Color:      config.ColorPalette[sum%uint64(len(config.ColorPalette))],
+		AvatarSeed: strconv.FormatUint(sum, 16),
+	}
+}
+
+// appearancesOf returns the appearance of each name, keyed by name
+func appearancesOf(names []string) map[string]appearance {
+	appearances := make(map[string]appearance, len(names))
+	for _, name := range names {
+		appearances[name] = appearanceOf(name)
+	}
+	return appearances
+}
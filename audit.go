@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The audit log is a connection-level trail for compliance, kept apart from
+// the operational log: one record when a client connects, joins a room,
+// leaves it and disconnects. -audit-log picks the sink.
+
+// auditQueueSize bounds the records waiting for the file sink
+const auditQueueSize = 4096
+
+// auditRecord is one audit log entry
+type auditRecord struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	RemoteIP  string    `json:"remoteIp"`
+	UserAgent string    `json:"userAgent"`
+	Room      string    `json:"room,omitempty"`
+	// ConnectedAt is when the connection was established
+	ConnectedAt time.Time `json:"connectedAt"`
+	// Reason says why a client joined or disconnected, e.g. "resume" or "left"
+	Reason string `json:"reason,omitempty"`
+}
+
+// auditSink stores audit records. record must not block signaling; run
+// does the writing until ctx is cancelled.
+type auditSink interface {
+	record(entry auditRecord)
+	run(ctx context.Context)
+}
+
+// auditLog writes audit records to its sink; a nil auditLog records nothing
+type auditLog struct {
+	sink auditSink
+}
+
+// newAuditLog builds the audit log described by -audit-log: empty disables
+// it, file:PATH appends JSON lines to PATH and an http(s) URL POSTs each
+// record as an 'audit' webhook event.
+func newAuditLog(target string) (*auditLog, error) {
+	switch {
+	case target == "":
+		return nil, nil
+	case strings.HasPrefix(target, "file:"):
+		path := strings.TrimPrefix(target, "file:")
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		return &auditLog{sink: &fileAuditSink{file: file, queue: make(chan auditRecord, auditQueueSize)}}, nil
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		return &auditLog{sink: webhookAuditSink{newWebhookPoster(target, []string{"audit"})}}, nil
+	}
+	return nil, fmt.Errorf("unknown audit log %q, want file:PATH or an http(s) URL", target)
+}
+
+// record writes one audit record about client
+func (a *auditLog) record(event string, client *Client, room, reason string) {
+	if a == nil {
+		return
+	}
+	a.sink.record(auditRecord{
+		Event:       event,
+		Time:        time.Now().UTC(),
+		Client:      client.name(),
+		Subject:     client.Subject,
+		RemoteIP:    client.RemoteIP,
+		UserAgent:   client.UserAgent,
+		Room:        room,
+		ConnectedAt: client.ConnectedAt,
+		Reason:      reason,
+	})
+}
+
+// fileAuditSink appends records to a file as JSON lines
+type fileAuditSink struct {
+	file  *os.File
+	queue chan auditRecord
+}
+
+func (s *fileAuditSink) record(entry auditRecord) {
+	select {
+	case s.queue <- entry:
+	default:
+		log.Printf("Audit queue full. '%s' record for '%s' dropped.", entry.Event, entry.Client)
+	}
+}
+
+// run writes queued records in order. At shutdown it writes what is still
+// queued and closes the file.
+func (s *fileAuditSink) run(ctx context.Context) {
+	defer s.file.Close()
+	for {
+		select {
+		case entry := <-s.queue:
+			s.write(entry)
+		case <-ctx.Done():
+			for len(s.queue) > 0 {
+				s.write(<-s.queue)
+			}
+			return
+		}
+	}
+}
+
+// write appends one record as a JSON line
+func (s *fileAuditSink) write(entry auditRecord) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("Audit encode error:", err)
+		return
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		log.Println("Audit write error:", err)
+	}
+}
+
+// webhookAuditSink POSTs records through a webhook poster
+type webhookAuditSink struct {
+	poster *webhookPoster
+}
+
+func (s webhookAuditSink) record(entry auditRecord) {
+	s.poster.emit("audit", entry)
+}
+
+func (s webhookAuditSink) run(ctx context.Context) {
+	s.poster.run(ctx)
+}
+
+// disconnectReason describes the read error that ended a connection
+func disconnectReason(err error) string {
+	var closeErr *websocket.CloseError
+	switch {
+	case err == nil:
+		return "connection-lost"
+	case errors.As(err, &closeErr):
+		return fmt.Sprintf("closed (%d)", closeErr.Code)
+	}
+	return err.Error()
+}
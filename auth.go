@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jwtClaims are the registered claims checked on connection tokens
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+}
+
+// authenticate verifies the HS256 JWT presented at upgrade, either in the
+// 'token' query parameter (browsers can't set headers on WebSockets) or as a
+// bearer token, and returns its subject. Without a configured secret,
+// authentication is off and the subject is empty.
+func authenticate(r *http.Request) (string, error) {
+	if config.JWTSecret == "" {
+		return "", nil
+	}
+	token := r.URL.Query().Get("token")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token == "" {
+		token = bearer
+	}
+	if token == "" {
+		return "", errors.New("missing token")
+	}
+	claims, err := verifyJWT(token, []byte(config.JWTSecret), time.Now())
+	if err != nil {
+		return "", err
+	}
+	if claims.Subject == "" {
+		return "", errors.New("token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+// verifyJWT checks the signature and time claims of an HS256 token
+func verifyJWT(token string, secret []byte, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, errors.New("malformed token")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return jwtClaims{}, errors.New("malformed token header")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Algorithm != "HS256" {
+		return jwtClaims{}, errors.New("token must be signed with HS256")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, errors.New("malformed token signature")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return jwtClaims{}, errors.New("invalid token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return jwtClaims{}, errors.New("malformed token payload")
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return jwtClaims{}, errors.New("malformed token claims")
+	}
+	unix := float64(now.Unix())
+	if claims.ExpiresAt != nil && unix >= *claims.ExpiresAt {
+		return jwtClaims{}, errors.New("token has expired")
+	}
+	if claims.NotBefore != nil && unix < *claims.NotBefore {
+		return jwtClaims{}, errors.New("token is not valid yet")
+	}
+	return claims, nil
+}
+
+// acquireUserConnection counts a new connection for an authenticated subject,
+// refusing it once the per-user limit is reached
+func (s *Server) acquireUserConnection(subject string) error {
+	if subject == "" {
+		return nil
+	}
+	s.userMutex.Lock()
+	defer s.userMutex.Unlock()
+	if limit := config.MaxConnectionsPerUser; limit > 0 && s.userConnections[subject] >= limit {
+		log.Printf("User '%s' reached the limit of %d concurrent connections", subject, limit)
+		return fmt.Errorf("user already has %d open connections", limit)
+	}
+	s.userConnections[subject]++
+	return nil
+}
+
+// releaseUserConnection undoes acquireUserConnection when a connection ends
+func (s *Server) releaseUserConnection(subject string) {
+	if subject == "" {
+		return
+	}
+	s.userMutex.Lock()
+	defer s.userMutex.Unlock()
+	if s.userConnections[subject]--; s.userConnections[subject] <= 0 {
+		delete(s.userConnections, subject)
+	}
+}
+
+// requireAdmin guards an admin handler with the -admin-token bearer token.
+// Without a configured token the admin endpoints stay open.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken != "" && !hasAdminToken(r) {
+			log.Printf("Rejected admin request %s %s from %s", r.Method, r.URL.Path, clientIP(r))
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// hasAdminToken reports whether r carries the configured -admin-token
+func hasAdminToken(r *http.Request) bool {
+	if config.AdminToken == "" {
+		return false
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
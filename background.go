@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// backgroundTasks tracks the server's long-running goroutines, such as
+// sweepers and delivery queues, so shutdown can stop them and wait for them
+type backgroundTasks struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newBackgroundTasks() *backgroundTasks {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backgroundTasks{ctx: ctx, cancel: cancel}
+}
+
+// goBackground runs task on its own goroutine until the server shuts down.
+// task must return soon after its context is cancelled.
+func (s *Server) goBackground(name string, task func(ctx context.Context)) {
+	s.background.wg.Add(1)
+	go func() {
+		defer s.background.wg.Done()
+		task(s.background.ctx)
+		log.Printf("Background task '%s' stopped", name)
+	}()
+}
+
+// Shutdown cancels every background task and waits for them to return, or
+// for ctx to end
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.background.cancel()
+	stopped := make(chan struct{})
+	go func() {
+		s.background.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// everyTick calls fn on every tick of interval until ctx is cancelled
+func everyTick(ctx context.Context, interval time.Duration, fn func(now time.Time)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			fn(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backgroundFrames are the functions the server's background tasks run in
+var backgroundFrames = []string{".everyTick(", ".(*resumeStore).sweep(", ".(*fileAuditSink).run("}
+
+// backgroundGoroutines counts the goroutines running any of backgroundFrames
+func backgroundGoroutines() int {
+	buffer := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buffer, true)
+		if n < len(buffer) {
+			buffer = buffer[:n]
+			break
+		}
+		buffer = make([]byte, 2*len(buffer))
+	}
+	count := 0
+	for _, stack := range strings.Split(string(buffer), "\n\n") {
+		for _, frame := range backgroundFrames {
+			if strings.Contains(stack, frame) {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+// TestShutdownStopsBackgroundTasks starts the background tasks of a fresh
+// server, including the sweepers and a file audit log, and checks that
+// Shutdown stops every one of their goroutines
+func TestShutdownStopsBackgroundTasks(t *testing.T) {
+	// The test server's own ban and resume sweepers keep running
+	waitFor(t, time.Second, "the test server's sweepers to start", func() bool { return backgroundGoroutines() >= 2 })
+	before := backgroundGoroutines()
+
+	audit, err := newAuditLog("file:" + filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Sessions: newResumeStore(), Audit: audit, background: newBackgroundTasks()}
+	s.startServices()
+	// The ban and resume sweepers and the audit log
+	waitFor(t, time.Second, "the background tasks to start", func() bool { return backgroundGoroutines() == before+3 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	waitFor(t, time.Second, "the background goroutines to exit", func() bool { return backgroundGoroutines() == before })
+}
+
+// TestShutdownGivesUpOnStuckTask checks that Shutdown returns when its
+// context ends, even if a task ignores cancellation
+func TestShutdownGivesUpOnStuckTask(t *testing.T) {
+	s := &Server{background: newBackgroundTasks()}
+	release := make(chan struct{})
+	defer func() {
+		close(release)
+		s.background.wg.Wait()
+	}()
+	s.goBackground("stuck", func(ctx context.Context) { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// checkBacklog tracks how long the client's send queue has stayed at or above
+// the high-water mark and disconnects the client once that lasts longer than
+// the configured grace period
+func (c *Client) checkBacklog() {
+	if config.SendHighWater <= 0 {
+		return
+	}
+	if len(c.Send) < config.SendHighWater {
+		c.backlogSince.Store(0)
+		return
+	}
+	now := time.Now().UnixNano()
+	since := c.backlogSince.Load()
+	if since == 0 {
+		c.backlogSince.CompareAndSwap(0, now)
+		return
+	}
+	if time.Duration(now-since) >= config.SlowClientGrace {
+		c.slowOnce.Do(c.disconnectSlow)
+	}
+}
+
+// disconnectSlow closes the connection of a client that can't keep up. The
+// queue is full, so the reason travels in the close frame instead of a message.
+func (c *Client) disconnectSlow() {
+	log.Printf("Client '%s' kept %d+ queued messages for over %s. Disconnecting as too slow.", c.name(), config.SendHighWater, config.SlowClientGrace)
+	c.disconnect(websocket.ClosePolicyViolation, "too-slow")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxBanDuration bounds the ban duration a host may ask for
+const maxBanDuration = 24 * time.Hour
+
+// banIdentity is what a client joining as name is banned by: its
+// authenticated user when it has one, otherwise the name
+func (c *Client) banIdentity(name string) string {
+	if c.Subject != "" {
+		return "user " + c.Subject
+	}
+	return "name " + name
+}
+
+// banRemaining returns how much longer the client joining as name is banned
+// from the room, or 0 when it isn't. The caller must hold r.Mutex.
+func (r *Room) banRemaining(c *Client, name string, now time.Time) time.Duration {
+	remaining := time.Duration(0)
+	for _, identity := range []string{c.banIdentity(name), "IP " + c.RemoteIP} {
+		if left := r.bans[identity].Sub(now); left > remaining {
+			remaining = left
+		}
+	}
+	return remaining
+}
+
+// bannedError is the join rejection for a banned client
+func bannedError(room string, remaining time.Duration) error {
+	remaining = remaining.Round(time.Second)
+	if remaining < time.Second {
+		remaining = time.Second
+	}
+	return &joinError{Code: "banned", Message: fmt.Sprintf("banned from room '%s' for another %s", room, remaining), RetryAfter: remaining}
+}
+
+// banDuration is the ban length a host asked for in seconds, or -ban-duration
+func banDuration(seconds float64) time.Duration {
+	if seconds <= 0 {
+		return config.BanDuration
+	}
+	return min(time.Duration(seconds*float64(time.Second)), maxBanDuration)
+}
+
+// removePeer disconnects another client of the host's room for reason
+// ("kicked" or "banned"). With a positive ban duration the client's identity,
+// and with byIP its address, can't rejoin the room until the ban expires.
+// A client that isn't connected can still be banned by name.
+func (c *Client) removePeer(target, reason string, ban time.Duration, byIP bool) error {
+	room := c.room()
+	room.Mutex.Lock()
+	if room.Host != c.name() {
+		room.Mutex.Unlock()
+		return fmt.Errorf("only the host can remove clients from room '%s'", room.Name)
+	}
+	targetClient, exists := room.Clients[target]
+	if target == "" || target == c.name() || !exists && (ban <= 0 || byIP) {
+		room.Mutex.Unlock()
+		return fmt.Errorf("no other client '%s' in room '%s'", target, room.Name)
+	}
+	if ban > 0 {
+		if room.bans == nil {
+			room.bans = make(map[string]time.Time)
+		}
+		expires := time.Now().Add(ban)
+		identity := "name " + target
+		if exists {
+			identity = targetClient.banIdentity(target)
+		}
+		room.bans[identity] = expires
+		if byIP {
+			room.bans["IP "+targetClient.RemoteIP] = expires
+		}
+		log.Printf("Host '%s' banned '%s' (%s, by IP: %t) from room '%s' for %s", c.name(), target, identity, byIP, room.Name, ban)
+	}
+	room.Mutex.Unlock()
+	detail := "by " + c.name()
+	if ban > 0 {
+		detail += " for " + ban.String()
+	}
+	server.Events.record(room.Name, reason, target, detail)
+	if exists {
+		log.Printf("Host '%s' removed client '%s' from room '%s' (%s)", c.name(), target, room.Name, reason)
+		targetClient.disconnect(websocket.ClosePolicyViolation, reason)
+	}
+	return nil
+}
+
+// sweepBans drops expired bans from every room
+func sweepBans(now time.Time) {
+	for _, room := range server.Rooms.List() {
+		room.Mutex.Lock()
+		for identity, expires := range room.bans {
+			if !now.Before(expires) {
+				delete(room.bans, identity)
+			}
+		}
+		room.Mutex.Unlock()
+	}
+}
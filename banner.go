@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// loadBanner builds the 'banner' message from the -banner flag: literal
+// text, or "@path" to read it from a file. Content that parses as JSON is
+// sent as structured 'content', anything else as 'text'. An empty value
+// means no banner.
+func loadBanner(value string) ([]byte, error) {
+	if path, ok := strings.CutPrefix(value, "@"); ok {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		value = string(contents)
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	banner := map[string]interface{}{"type": "banner"}
+	if json.Valid([]byte(value)) {
+		banner["content"] = json.RawMessage(value)
+	} else {
+		banner["text"] = value
+	}
+	return json.Marshal(banner)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Breakout rooms are child rooms of a main room, named "<parent>/<breakout>".
+// The host of the parent moves clients into them with 'move-to-breakout' and
+// pulls them back with 'return-from-breakout'. Clients are moved with the
+// same primitive as room switches, so both rooms see the usual membership
+// events.
+
+// breakoutRoom returns the child room of r called breakout, creating it if
+// needed unless rooms must be provisioned
+func (r *Room) breakoutRoom(breakout, creator string) (*Room, error) {
+	breakout = strings.TrimSpace(breakout)
+	if breakout == "" || strings.Contains(breakout, "/") {
+		return nil, errors.New("'breakout' must be a non-empty name without '/'")
+	}
+	child, err := server.openRoom(r.Name+"/"+breakout, creator)
+	if err != nil {
+		return nil, err
+	}
+	child.Mutex.Lock()
+	defer child.Mutex.Unlock()
+	if child.Parent == nil {
+		child.Parent = r
+	}
+	if child.Parent != r {
+		return nil, fmt.Errorf("room '%s' belongs to another room", child.Name)
+	}
+	return child, nil
+}
+
+// breakouts lists the child rooms of r
+func (r *Room) breakouts() []*Room {
+	children := make([]*Room, 0)
+	for _, room := range server.Rooms.List() {
+		room.Mutex.Lock()
+		parent := room.Parent
+		room.Mutex.Unlock()
+		if parent == r {
+			children = append(children, room)
+		}
+	}
+	return children
+}
+
+// requireHost checks that c hosts its room and that the room is a main room
+func (c *Client) requireHost() error {
+	room := c.room()
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+	if room.Host != c.name() {
+		return fmt.Errorf("only the host of room '%s' can manage breakout rooms", room.Name)
+	}
+	if room.Parent != nil {
+		return fmt.Errorf("room '%s' is itself a breakout room", room.Name)
+	}
+	return nil
+}
+
+// moveToBreakout moves the named clients of the host's room into a breakout
+// room. The moves run on the moved clients' goroutines, so this runs on its
+// own goroutine; the host gets a 'breakout-moved' report when it is done.
+func (c *Client) moveToBreakout(breakout string, names []string) {
+	parent := c.room()
+	child, err := parent.breakoutRoom(breakout, c.creatorID())
+	if err != nil {
+		c.trySend(errorMessage("invalid-breakout", err.Error()))
+		return
+	}
+	parent.Mutex.Lock()
+	clients := make([]*Client, 0, len(names))
+	failed := make(map[string]string)
+	for _, name := range names {
+		if client, exists := parent.Clients[name]; exists {
+			clients = append(clients, client)
+		} else {
+			failed[name] = fmt.Sprintf("not in room '%s'", parent.Name)
+		}
+	}
+	parent.Mutex.Unlock()
+
+	log.Printf("Host '%s' moving %d clients from room '%s' to breakout '%s'", c.name(), len(clients), parent.Name, child.Name)
+	moved := relocate(clients, child, failed)
+	c.reportBreakout("breakout-moved", child.Name, moved, failed)
+}
+
+// returnFromBreakout pulls clients back from the breakout rooms into the
+// host's room: the named ones, or everyone when names is empty
+func (c *Client) returnFromBreakout(names []string) {
+	parent := c.room()
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	clients := make([]*Client, 0)
+	for _, child := range parent.breakouts() {
+		child.Mutex.Lock()
+		for name, client := range child.Clients {
+			if len(names) == 0 || wanted[name] {
+				clients = append(clients, client)
+				delete(wanted, name)
+			}
+		}
+		child.Mutex.Unlock()
+	}
+	failed := make(map[string]string)
+	for name := range wanted {
+		failed[name] = "not in a breakout room"
+	}
+
+	log.Printf("Host '%s' returning %d clients to room '%s'", c.name(), len(clients), parent.Name)
+	moved := relocate(clients, parent, failed)
+	c.reportBreakout("breakout-returned", parent.Name, moved, failed)
+}
+
+// relocate moves each client into room under its current name, recording
+// failures by name, and returns the names that were moved
+func relocate(clients []*Client, room *Room, failed map[string]string) []string {
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ConnectedAt.Before(clients[j].ConnectedAt) })
+	moved := make([]string, 0, len(clients))
+	for _, client := range clients {
+		name := client.name()
+		if err := client.do(func() error { return client.moveTo(room, client.name()) }); err != nil {
+			log.Printf("Could not move client '%s' to room '%s': %v", name, room.Name, err)
+			failed[name] = err.Error()
+			continue
+		}
+		moved = append(moved, name)
+	}
+	return moved
+}
+
+// reportBreakout tells the host which clients were moved to room
+func (c *Client) reportBreakout(messageType, room string, moved []string, failed map[string]string) {
+	reportJSON, _ := json.Marshal(map[string]interface{}{
+		"type":   messageType,
+		"room":   room,
+		"moved":  moved,
+		"failed": failed,
+	})
+	c.trySend(reportJSON)
+}
+
+// stringList extracts the strings of a decoded JSON array field
+func stringList(value interface{}) []string {
+	items, _ := value.([]interface{})
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		if name, ok := item.(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
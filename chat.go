@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// maxTrackedChats bounds how many recent chat messages per room accept read receipts
+const maxTrackedChats = 500
+
+// chatRecord remembers who sent a chat message and who has seen it
+type chatRecord struct {
+	From   string
+	SeenBy map[string]bool
+}
+
+// relayChat assigns the chat message an id and broadcasts it to the whole
+// room, sender included, so everyone can acknowledge it by id
+func (c *Client) relayChat(data map[string]interface{}) {
+	text, _ := data["text"].(string)
+	if text == "" {
+		c.trySend(errorMessage("invalid-chat", "'text' must be a non-empty string"))
+		return
+	}
+	if !c.allowBroadcast("chat") {
+		return
+	}
+	room := c.room()
+
+	room.Mutex.Lock()
+	room.chatSequence++
+	id := strconv.FormatInt(room.chatSequence, 10)
+	if room.chats == nil {
+		room.chats = make(map[string]*chatRecord)
+	}
+	room.chats[id] = &chatRecord{From: c.name(), SeenBy: make(map[string]bool)}
+	room.chatOrder = append(room.chatOrder, id)
+	if len(room.chatOrder) > maxTrackedChats {
+		delete(room.chats, room.chatOrder[0])
+		room.chatOrder = room.chatOrder[1:]
+	}
+	room.Mutex.Unlock()
+
+	chatJSON, _ := json.Marshal(map[string]interface{}{
+		"type":   "chat",
+		"id":     id,
+		"from":   c.name(),
+		"text":   text,
+		"sentAt": time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	room.RelayFrom(c, chatJSON, "", false, time.Time{})
+	server.Webhooks.emit("chat", map[string]interface{}{"room": room.Name, "id": id, "from": c.name(), "text": text})
+	log.Printf("Chat message '%s' from '%s' relayed in room '%s'", id, c.name(), room.Name)
+}
+
+// renameInChats moves a renamed client's sent messages and read receipts to
+// its new name. The caller must hold r.Mutex.
+func (r *Room) renameInChats(oldName, newName string) {
+	for _, record := range r.chats {
+		if record.From == oldName {
+			record.From = newName
+		}
+		if record.SeenBy[oldName] {
+			delete(record.SeenBy, oldName)
+			record.SeenBy[newName] = true
+		}
+	}
+}
+
+// relayReadReceipt forwards a client's acknowledgement of a chat message to
+// its sender and, when enabled, broadcasts the updated seen count
+func (c *Client) relayReadReceipt(data map[string]interface{}) error {
+	id, _ := data["id"].(string)
+	room := c.room()
+
+	room.Mutex.Lock()
+	record, exists := room.chats[id]
+	if !exists {
+		room.Mutex.Unlock()
+		return fmt.Errorf("unknown chat message '%s'", id)
+	}
+	if record.From == c.name() || record.SeenBy[c.name()] {
+		room.Mutex.Unlock()
+		return nil
+	}
+	record.SeenBy[c.name()] = true
+	seenCount := len(record.SeenBy)
+	sender := room.Clients[record.From]
+	room.Mutex.Unlock()
+
+	if sender != nil {
+		receiptJSON, _ := json.Marshal(map[string]interface{}{
+			"type": "read-receipt",
+			"id":   id,
+			"by":   c.name(),
+		})
+		sender.trySend(receiptJSON)
+	}
+	if config.ChatSeenCounts {
+		seenJSON, _ := json.Marshal(map[string]interface{}{
+			"type":  "chat-seen",
+			"id":    id,
+			"count": seenCount,
+		})
+		room.Broadcast(seenJSON, "", false)
+	}
+	return nil
+}
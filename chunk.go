@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// A signaling message too large for the read limit can be sent as ordered
+// 'chunk' messages:
+//
+//	{"type": "chunk", "transfer": "<id>", "index": 0, "total": 3, "data": "<part>"}
+//
+// The data of all chunks, concatenated, is the original message. Once the
+// last chunk arrives the server handles it as if the client had sent it in
+// one frame, so it is checked and routed like any other targeted or
+// broadcast message and reaches its recipients whole. A transfer is aborted
+// when it grows past -max-chunked-size, and expires when its next chunk
+// doesn't arrive within -chunk-timeout.
+
+// maxChunkTransfers bounds the transfers a client may have in progress at once
+const maxChunkTransfers = 4
+
+// chunkTransfer is a chunked message being reassembled
+type chunkTransfer struct {
+	data     strings.Builder
+	next     int
+	total    int
+	deadline time.Time
+}
+
+// receiveChunk adds a chunk to its transfer and handles the reassembled
+// message once the transfer is complete. It runs on the client's read
+// goroutine, which owns c.chunks.
+func (c *Client) receiveChunk(data map[string]interface{}) departure {
+	now := time.Now()
+	for id, transfer := range c.chunks {
+		if now.After(transfer.deadline) {
+			log.Printf("Chunked transfer '%s' from '%s' expired after %d of %d chunks", id, c.name(), transfer.next, transfer.total)
+			metrics.IncCounter("signaling_chunked_transfers_total", "outcome", "expired")
+			delete(c.chunks, id)
+		}
+	}
+
+	id, _ := data["transfer"].(string)
+	index, _ := data["index"].(float64)
+	total, _ := data["total"].(float64)
+	part, _ := data["data"].(string)
+	if id == "" || total < 1 || index < 0 || index >= total {
+		c.trySend(errorMessage("bad-chunk", "a chunk needs a 'transfer' id, an 'index' below 'total', and 'data'"))
+		return staying
+	}
+	transfer, exists := c.chunks[id]
+	if !exists {
+		if index != 0 {
+			c.trySend(errorMessage("bad-chunk", fmt.Sprintf("transfer '%s' is unknown or expired", id)))
+			return staying
+		}
+		if len(c.chunks) >= maxChunkTransfers {
+			c.trySend(errorMessage("bad-chunk", fmt.Sprintf("at most %d chunked transfers may be in progress", maxChunkTransfers)))
+			return staying
+		}
+		if c.chunks == nil {
+			c.chunks = make(map[string]*chunkTransfer)
+		}
+		transfer = &chunkTransfer{total: int(total)}
+		c.chunks[id] = transfer
+	}
+	if int(index) != transfer.next || int(total) != transfer.total {
+		c.abortChunks(id, "bad-chunk", fmt.Sprintf("transfer '%s' expected chunk %d of %d", id, transfer.next, transfer.total))
+		return staying
+	}
+	if int64(transfer.data.Len()+len(part)) > config.MaxChunkedSize {
+		c.abortChunks(id, "chunk-too-large", fmt.Sprintf("transfer '%s' is larger than %d bytes", id, config.MaxChunkedSize))
+		return staying
+	}
+	transfer.data.WriteString(part)
+	transfer.next++
+	transfer.deadline = now.Add(config.ChunkTimeout)
+	if transfer.next < transfer.total {
+		return staying
+	}
+
+	delete(c.chunks, id)
+	message := []byte(transfer.data.String())
+	assembled, err := decodeFrame(message)
+	if err != nil {
+		c.trySend(errorMessage("bad-chunk", fmt.Sprintf("transfer '%s' is not a valid message: %v", id, err)))
+		return staying
+	}
+	messageType, _ := assembled["type"].(string)
+	if route := config.Routes[messageType]; route != routeTargeted && route != routeBroadcast {
+		c.trySend(errorMessage("bad-chunk", fmt.Sprintf("'%s' messages can't be sent in chunks", messageType)))
+		return staying
+	}
+	metrics.IncCounter("signaling_chunked_transfers_total", "outcome", "complete")
+	debugf("Chunked transfer '%s' from '%s' complete: %d chunks, %d bytes", id, c.name(), transfer.total, len(message))
+	return c.handleMessage(message)
+}
+
+// abortChunks drops a transfer in progress and tells the client why
+func (c *Client) abortChunks(id, code, message string) {
+	delete(c.chunks, id)
+	log.Printf("Chunked transfer '%s' from '%s' aborted: %s", id, c.name(), message)
+	metrics.IncCounter("signaling_chunked_transfers_total", "outcome", "aborted")
+	c.trySend(errorMessage(code, message))
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultReconnectable says, per server-initiated disconnect reason, whether
+// the client should reconnect; -reconnectable overrides entries. Reasons not
+// listed are treated as reconnectable, like a dropped network.
+var defaultReconnectable = map[string]bool{
+	"kicked":                false,
+	"banned":                false,
+	"replaced":              false,
+	"resumed":               false,
+	"abuse-suspected":       false,
+	"too-many-targets":      false,
+	"unauthorized":          false,
+	"upgrade-required":      false,
+	"invalid-join":          false,
+	"user-connection-limit": false,
+	"shutdown":              true,
+	"draining":              true,
+	"too-slow":              true,
+}
+
+// parseReconnectable applies comma-separated reason=true|false overrides to
+// the default reconnect table
+func parseReconnectable(overrides string) (map[string]bool, error) {
+	reconnectable := make(map[string]bool, len(defaultReconnectable))
+	for reason, allowed := range defaultReconnectable {
+		reconnectable[reason] = allowed
+	}
+	for _, entry := range splitList(overrides) {
+		reason, value, ok := strings.Cut(entry, "=")
+		reason = strings.TrimSpace(reason)
+		allowed, err := strconv.ParseBool(strings.TrimSpace(value))
+		if !ok || reason == "" || err != nil {
+			return nil, fmt.Errorf("invalid reconnect setting %q, want reason=true|false", entry)
+		}
+		reconnectable[reason] = allowed
+	}
+	return reconnectable, nil
+}
+
+// isReconnectable reports whether a client disconnected for reason may reconnect
+func isReconnectable(reason string) bool {
+	if allowed, listed := config.Reconnectable[reason]; listed {
+		return allowed
+	}
+	return true
+}
+
+// defaultCloseCodes is the WebSocket close code sent for each reason the
+// server closes a connection, from the application range 4000-4999, so
+// clients can branch on the close event alone; the close frame's reason
+// string is the reason itself. -close-codes overrides entries. Other reasons
+// keep the standard code each call site picks, such as 1001 (going away) or
+// 1008 (policy violation).
+//
+//	4000 kicked                 4009 too-slow
+//	4001 banned                 4010 too-many-targets
+//	4002 replaced               4011 too-many-messages
+//	4003 resumed                4012 room-full
+//	4004 unauthorized           4013 room-locked
+//	4005 upgrade-required       4014 room-not-found
+//	4006 invalid-join           4015 (retired, not reused)
+//	4007 user-connection-limit  4016 draining
+//	4008 abuse-suspected        4017 shutdown
+//
+// 4015 was idle-timeout, which nothing closes with any more; it stays
+// unassigned so clients that still branch on it never misread a new reason.
+var defaultCloseCodes = map[string]int{
+	"kicked":                4000,
+	"banned":                4001,
+	"replaced":              4002,
+	"resumed":               4003,
+	"unauthorized":          4004,
+	"upgrade-required":      4005,
+	"invalid-join":          4006,
+	"user-connection-limit": 4007,
+	"abuse-suspected":       4008,
+	"too-slow":              4009,
+	"too-many-targets":      4010,
+	"too-many-messages":     4011,
+	"room-full":             4012,
+	"room-locked":           4013,
+	"room-not-found":        4014,
+	"draining":              4016,
+	"shutdown":              4017,
+}
+
+// parseCloseCodes applies comma-separated reason=code overrides to the
+// default close codes; reasons must be ones the server closes with and codes
+// must be in the application range
+func parseCloseCodes(overrides string) (map[string]int, error) {
+	codes := make(map[string]int, len(defaultCloseCodes))
+	for reason, code := range defaultCloseCodes {
+		codes[reason] = code
+	}
+	for _, entry := range splitList(overrides) {
+		reason, value, ok := strings.Cut(entry, "=")
+		reason = strings.TrimSpace(reason)
+		if _, known := defaultCloseCodes[reason]; ok && !known {
+			return nil, fmt.Errorf("unknown close reason '%s'", reason)
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || reason == "" || err != nil || code < 4000 || code > 4999 {
+			return nil, fmt.Errorf("invalid close code setting %q, want reason=4000-4999", entry)
+		}
+		codes[reason] = code
+	}
+	return codes, nil
+}
+
+// closeCodeFor returns the close code for reason, or fallback when the
+// reason has none of its own
+func closeCodeFor(reason string, fallback int) int {
+	if code, listed := config.CloseCodes[reason]; listed {
+		return code
+	}
+	return fallback
+}
+
+// disconnect closes the connection from the server side after queueing a
+// 'disconnect' message with the reason and whether the client should
+// reconnect. The message is lost when the send buffer is full, so the reason
+// is repeated in the close frame.
+func (c *Client) disconnect(closeCode int, reason string) {
+	if c.closing.Load() {
+		return
+	}
+	if c.room() != nil {
+		server.Events.record(c.room().Name, "disconnect", c.name(), reason)
+	}
+	notice, _ := json.Marshal(map[string]interface{}{
+		"type":          "disconnect",
+		"reason":        reason,
+		"reconnectable": isReconnectable(reason),
+	})
+	select {
+	case c.Send <- outbound{data: signMessage(notice)}:
+	default:
+	}
+	c.close(closeCode, reason)
+}
+
+// close closes the connection with the close code for reason, falling back
+// to closeCode. Within -close-grace, writeMessages first
+// writes what is already queued, so a final message such as an error reaches
+// the client, and then sends the close frame; the client accepts no new
+// messages meanwhile. The socket is closed once the grace period is over
+// either way.
+func (c *Client) close(closeCode int, reason string) {
+	if !c.closing.CompareAndSwap(false, true) {
+		return
+	}
+	closeMessage := websocket.FormatCloseMessage(closeCodeFor(reason, closeCode), reason)
+	if config.CloseGrace > 0 && c.writing.Load() {
+		select {
+		case c.closeFrame <- closeMessage:
+			time.AfterFunc(config.CloseGrace, func() { c.Socket.Close() })
+			return
+		default:
+		}
+	}
+	c.Socket.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+	c.Socket.Close()
+}
+
+// disconnectAll disconnects every client in every room and waits, until ctx
+// ends, for their final messages and close frames to be written
+func disconnectAll(ctx context.Context, closeCode int, reason string) {
+	var wg sync.WaitGroup
+	for _, room := range server.Rooms.List() {
+		room.Mutex.Lock()
+		clients := make([]*Client, 0, len(room.Clients))
+		for _, client := range room.Clients {
+			clients = append(clients, client)
+		}
+		room.Mutex.Unlock()
+		for _, client := range clients {
+			client.disconnect(closeCode, reason)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				select {
+				case <-client.writerDone:
+				case <-ctx.Done():
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// flushAndClose writes the messages still queued for the client, within the
+// close grace period, and then the close frame. It runs on the writer goroutine.
+func (c *Client) flushAndClose(closeMessage []byte) {
+	deadline := time.Now().Add(config.CloseGrace)
+	flushed := 0
+	queued := make([]outbound, 0, maxBatchSize)
+	batch := make([][]byte, 0, maxBatchSize)
+	for time.Now().Before(deadline) {
+		queued = queued[:0]
+	drain:
+		for len(queued) < maxBatchSize {
+			select {
+			case message := <-c.Send:
+				queued = append(queued, message)
+			default:
+				break drain
+			}
+		}
+		if len(queued) == 0 {
+			break
+		}
+		batch = c.liveBatch(batch[:0], queued, time.Now())
+		if len(batch) == 0 {
+			continue
+		}
+		if err := c.writeBatch(batch); err != nil {
+			log.Printf("Could not flush messages to client '%s' before closing: %v", c.name(), err)
+			return
+		}
+		flushed += len(batch)
+	}
+	if left := len(c.Send); left > 0 {
+		log.Printf("Close grace period for client '%s' ran out with %d messages unsent", c.name(), left)
+	}
+	// The flush may have used up the grace period, so the close frame gets its own deadline
+	c.Socket.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+	log.Printf("Flushed %d messages to client '%s' before closing", flushed, c.name())
+}
+
+// disconnecting reports whether the client's connection is closing or already gone
+func (c *Client) disconnecting() bool {
+	if c.closing.Load() {
+		return true
+	}
+	select {
+	case <-c.Done:
+		return true
+	default:
+		return false
+	}
+}
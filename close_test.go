@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseCloseCodes(t *testing.T) {
+	codes, err := parseCloseCodes("kicked=4100, shutdown = 4999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codes["kicked"] != 4100 || codes["shutdown"] != 4999 || codes["banned"] != defaultCloseCodes["banned"] {
+		t.Fatalf("overrides gave %v, want kicked=4100, shutdown=4999 and the other defaults", codes)
+	}
+
+	for overrides, want := range map[string]string{
+		"kiked=4100":   "unknown close reason 'kiked'",
+		"kicked=1000":  "invalid close code setting",
+		"kicked=5000":  "invalid close code setting",
+		"kicked":       "invalid close code setting",
+		"=4100":        "unknown close reason ''",
+		"kicked=later": "invalid close code setting",
+		// Nothing disconnects idle clients
+		"idle-timeout=4015": "unknown close reason 'idle-timeout'",
+	} {
+		if _, err := parseCloseCodes(overrides); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseCloseCodes(%q) returned %v, want an error containing %q", overrides, err, want)
+		}
+	}
+	if defaultCloseCodes["kicked"] != 4000 {
+		t.Fatal("parsing overrides changed the defaults")
+	}
+}
+
+// TestFlushAndCloseOutlastingGrace flushes a write that only completes
+// after the close grace period and checks that the close frame is still
+// written
+func TestFlushAndCloseOutlastingGrace(t *testing.T) {
+	waitFor(t, 5*time.Second, "earlier tests' clients to be cleaned up", func() bool { return server.connected.Load() == 0 })
+	grace := config.CloseGrace
+	config.CloseGrace = 50 * time.Millisecond
+	t.Cleanup(func() { config.CloseGrace = grace })
+
+	socket := newFakeSocket(t, 1)
+	socket.stall()
+	client := &Client{Socket: socket, Send: make(chan outbound, 1), Done: make(chan struct{})}
+	client.setName("alice")
+	client.Send <- outbound{data: []byte(`{"type":"notice","text":"hello"}`)}
+	go func() {
+		for socket.blockedWrites() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(2 * config.CloseGrace)
+		socket.unstall()
+	}()
+
+	client.flushAndClose(websocket.FormatCloseMessage(4000, "kicked"))
+	if frames := socket.control(websocket.CloseMessage); len(frames) != 1 {
+		t.Fatalf("%d close frames written after the grace period ran out, want 1", len(frames))
+	}
+}
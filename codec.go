@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket subprotocols selecting the wire format of server messages. A
+// client that offers neither gets JSON.
+const (
+	subprotocolJSON    = "signaling.json"
+	subprotocolMsgpack = "signaling.msgpack"
+)
+
+// messageEncoder turns a server message, built as JSON internally, into the
+// wire format negotiated for a connection
+type messageEncoder interface {
+	// FrameType is the WebSocket message type frames are sent as
+	FrameType() int
+	// Encode converts a JSON message to the wire format
+	Encode(message []byte) ([]byte, error)
+}
+
+// encoderFor returns the encoder for a negotiated subprotocol
+func encoderFor(subprotocol string) messageEncoder {
+	if subprotocol == subprotocolMsgpack {
+		return msgpackEncoder{}
+	}
+	return jsonEncoder{}
+}
+
+// writeFrame encodes message for the socket's subprotocol and writes it,
+// returning the number of bytes put on the wire. Each write must finish
+// within config.WriteTimeout: a peer that stops reading fills the OS buffers
+// and would otherwise block the writer forever. A timed-out write leaves the
+// connection unusable, so callers tear it down.
+func writeFrame(socket socketConn, message []byte) (int, error) {
+	encoder := encoderFor(socket.Subprotocol())
+	frame, err := encoder.Encode(message)
+	if err != nil {
+		return 0, err
+	}
+	if config.WriteTimeout > 0 {
+		socket.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+	}
+	return len(frame), socket.WriteMessage(encoder.FrameType(), frame)
+}
+
+// jsonEncoder sends messages unchanged as text frames
+type jsonEncoder struct{}
+
+func (jsonEncoder) FrameType() int { return websocket.TextMessage }
+
+func (jsonEncoder) Encode(message []byte) ([]byte, error) { return message, nil }
+
+// msgpackEncoder re-encodes messages as MessagePack binary frames
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) FrameType() int { return websocket.BinaryMessage }
+
+func (msgpackEncoder) Encode(message []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := packValue(&out, value); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// packValue appends the MessagePack encoding of a decoded JSON value;
+// map keys are sorted so the output is deterministic
+func packValue(out *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		out.WriteByte(0xc0)
+	case bool:
+		if v {
+			out.WriteByte(0xc3)
+		} else {
+			out.WriteByte(0xc2)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			packInt(out, n)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		out.WriteByte(0xcb)
+		binary.Write(out, binary.BigEndian, math.Float64bits(f))
+	case string:
+		packHeader(out, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		out.WriteString(v)
+	case []interface{}:
+		packHeader(out, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := packValue(out, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		packHeader(out, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			packValue(out, key)
+			if err := packValue(out, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot encode %T as msgpack", value)
+	}
+	return nil
+}
+
+// packInt writes n in the smallest MessagePack integer format that holds it
+func packInt(out *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n < 128:
+		out.WriteByte(byte(n))
+	case n < 0 && n >= -32:
+		out.WriteByte(byte(int8(n)))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		out.WriteByte(0xd0)
+		out.WriteByte(byte(int8(n)))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		out.WriteByte(0xd1)
+		binary.Write(out, binary.BigEndian, int16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		out.WriteByte(0xd2)
+		binary.Write(out, binary.BigEndian, int32(n))
+	default:
+		out.WriteByte(0xd3)
+		binary.Write(out, binary.BigEndian, n)
+	}
+}
+
+// packHeader writes a string, array or map header for length n, using the
+// fix format below fixLimit and the 8-, 16- or 32-bit length formats above
+// it; arrays and maps have no 8-bit format (marker 0)
+func packHeader(out *bytes.Buffer, n int, fixMarker byte, fixLimit int, marker8, marker16, marker32 byte) {
+	switch {
+	case n < fixLimit:
+		out.WriteByte(fixMarker | byte(n))
+	case marker8 != 0 && n <= math.MaxUint8:
+		out.WriteByte(marker8)
+		out.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		out.WriteByte(marker16)
+		binary.Write(out, binary.BigEndian, uint16(n))
+	default:
+		out.WriteByte(marker32)
+		binary.Write(out, binary.BigEndian, uint32(n))
+	}
+}
+
+// withFields returns message, a JSON object, with fields added or replaced.
+// The new values are spliced into the message as the client sent it, so
+// every other byte, including the whitespace, key order and escaping of
+// members the server doesn't model, passes through unchanged. Added fields
+// go at the end in name order.
+func withFields(message []byte, fields map[string]interface{}) ([]byte, error) {
+	encoded := make(map[string][]byte, len(fields))
+	for name, value := range fields {
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(value); err != nil {
+			return nil, err
+		}
+		encoded[name] = bytes.TrimSuffix(buffer.Bytes(), []byte("\n"))
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, errors.New("message must be a JSON object")
+	}
+	out := make([]byte, 0, len(message)+32*len(fields))
+	copied, members := 0, 0
+	replaced := make(map[string]bool, len(fields))
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		members++
+		name, _ := token.(string)
+		if replacement, ok := encoded[name]; ok {
+			end := int(decoder.InputOffset())
+			out = append(out, message[copied:end-len(value)]...)
+			out = append(out, replacement...)
+			copied = end
+			replaced[name] = true
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	closing := int(decoder.InputOffset()) - 1
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errMalformedFrame
+	}
+	out = append(out, message[copied:closing]...)
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		if !replaced[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if members > 0 {
+			out = append(out, ',')
+		}
+		members++
+		key, _ := json.Marshal(name)
+		out = append(out, key...)
+		out = append(out, ':')
+		out = append(out, encoded[name]...)
+	}
+	return append(out, message[closing:]...), nil
+}
+
+// errMalformedFrame rejects a frame holding more than one JSON document
+var errMalformedFrame = errors.New("frame must hold exactly one JSON document")
+
+// decodeFrame parses a client frame. Each WebSocket message must carry
+// exactly one JSON object; trailing data after it, such as a second
+// newline-delimited document, is rejected with errMalformedFrame rather than
+// silently ignored or treated as a generic parse error.
+func decodeFrame(message []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	var data map[string]interface{}
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errMalformedFrame
+	}
+	return data, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// FuzzParseMessage feeds arbitrary frames through the parsing and routing
+// decisions a client message goes through before it reaches a peer, none of
+// which may panic or hang. Run it with go test -fuzz=FuzzParseMessage.
+func FuzzParseMessage(f *testing.F) {
+	for _, seed := range []string{
+		`{"type":"join","room":"lobby","name":"alice","protocol":3,"role":"publisher","appVersion":"1.2.0","attributes":{"tenant":"acme"}}`,
+		`{"type":"join","room":"lobby","name":"bob","hidden":true,"correlationId":"c-1"}`,
+		`{"type":"resume","token":"0123456789abcdef"}`,
+		`{"type":"offer","target":"bob","sdp":"v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\n"}`,
+		`{"type":"answer","target":"alice","answer":{"type":"answer","sdp":"v=0\r\no=- 2 2 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"}}`,
+		`{"type":"candidate","target-slot":1,"candidate":{"candidate":"candidate:1 1 udp 2122260223 192.0.2.1 54321 typ host","sdpMid":"0"}}`,
+		`{"type":"offer","target":"bob","room":"lobby","sealed":"c2VhbGVk","correlationId":"c-2"}`,
+		`{"type":"chat","text":"hello"}`,
+		`{"type":"qos-report","rtt":0.25,"jitter":12,"packetLoss":0.01}`,
+		`{"type":"move-to-breakout","breakout":"a","clients":["alice"]}`,
+		`{"type":"return-from-breakout","clients":["alice","bob"]}`,
+		`{"type":"dtmf","target":"bob","tones":"123#","price":2.50,"count":12345678901234567890}`,
+		`{"type":"chat","text":"one"}{"type":"chat","text":"two"}`,
+		`[[[[[[[[[[[[[[[[[[[[{}]]]]]]]]]]]]]]]]]]]]`,
+	} {
+		f.Add([]byte(seed))
+	}
+	room := &Room{Name: "lobby"}
+	f.Fuzz(func(t *testing.T, message []byte) {
+		data, err := decodeFrame(message)
+		if err != nil {
+			return
+		}
+		messageType, _ := data["type"].(string)
+		if req, err := parseJoinMessage(data); err == nil && req.Name == "" {
+			t.Fatalf("join %s accepted without a name", message)
+		}
+		if isSignal(messageType) {
+			validateSignal(messageType, data)
+		}
+		if isSealed(data) {
+			validateEnvelope(data, room.Name)
+		}
+		for _, topology := range []string{topologyAny, topologyTargetedOnly, topologyBroadcastOnly} {
+			room.Topology = topology
+			room.checkTopology(messageType, data)
+		}
+		correlationTag(data)
+		stringList(data["clients"])
+		msgpackEncoder{}.Encode(message)
+
+		// Annotating a frame keeps it a single valid document
+		annotated, err := withFields(message, map[string]interface{}{"polite": true})
+		if err != nil {
+			return
+		}
+		if reparsed, err := decodeFrame(annotated); err != nil || reparsed["polite"] != true {
+			t.Fatalf("annotating %s gave %s: %v", message, annotated, err)
+		}
+	})
+}
+
+// customFields are members the server doesn't model: numbers a float64
+// would round or reformat, characters json.Marshal escapes for HTML, escaped
+// control characters and a nested value spaced out by hand
+const customFields = `"price":2.50,"count":12345678901234567890,"note":"a<b & c>d","sdp":"v=0\r\na=x",` +
+	`"meta": { "tags" : [ "a", "b" ],"ratio":1e-7 }`
+
+func TestWithFieldsKeepsUnmodeledFields(t *testing.T) {
+	tests := []struct {
+		message string
+		fields  map[string]interface{}
+		want    string
+	}{
+		{
+			`{"type":"offer","target":"bob",` + customFields + `}`,
+			map[string]interface{}{"polite": true, "target": "carol"},
+			`{"type":"offer","target":"carol",` + customFields + `,"polite":true}`,
+		},
+		{`{}`, map[string]interface{}{"from": "a&b", "polite": false}, `{"from":"a&b","polite":false}`},
+		{` { "a" : 1 } `, map[string]interface{}{"a": 2}, ` { "a" : 2 } `},
+		{`{"from":"x","from":"y"}`, map[string]interface{}{"from": "alice"}, `{"from":"alice","from":"alice"}`},
+	}
+	for _, test := range tests {
+		annotated, err := withFields([]byte(test.message), test.fields)
+		if err != nil {
+			t.Fatalf("annotating %s: %v", test.message, err)
+		}
+		if string(annotated) != test.want {
+			t.Errorf("annotating %s gave\n%s\nwant\n%s", test.message, annotated, test.want)
+		}
+	}
+
+	for _, message := range []string{`["not","an","object"]`, `{"a":1}{"b":2}`, `{"a":`} {
+		if _, err := withFields([]byte(message), map[string]interface{}{"polite": true}); err == nil {
+			t.Errorf("annotating %s succeeded, want an error", message)
+		}
+	}
+}
+
+// TestRelayKeepsCustomFields sends messages with fields the server doesn't
+// model and checks they reach the peer exactly as sent, both when the frame
+// is forwarded as it is and when the server stamps it with the sender
+func TestRelayKeepsCustomFields(t *testing.T) {
+	room := t.Name()
+	alice := joinFake(t, room, "alice")
+	bob := joinFake(t, room, "bob")
+	alice.expect("new-user")
+
+	for _, test := range []struct{ sent, want string }{
+		{
+			`{"type":"dtmf","target":"bob","tones":"1#",` + customFields + `}`,
+			`{"type":"dtmf","target":"bob","tones":"1#",` + customFields + `}`,
+		},
+		{
+			`{"type":"qos-report","target":"bob",` + customFields + `}`,
+			`{"type":"qos-report","target":"bob",` + customFields + `,"from":"alice"}`,
+		},
+		{
+			`{"type":"qos-report",` + customFields + `}`,
+			`{"type":"qos-report",` + customFields + `,"from":"alice"}`,
+		},
+	} {
+		alice.feedRaw([]byte(test.sent))
+		var sent map[string]interface{}
+		json.Unmarshal([]byte(test.sent), &sent)
+		if got := bob.expectRaw(sent["type"].(string)); string(got) != test.want {
+			t.Fatalf("bob got\n%s\nwant\n%s", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"time"
+)
+
+// Config holds the runtime settings of the server
+type Config struct {
+	// Addr is the TCP address or Unix socket ("unix:/path") to listen on
+	Addr string
+	// TURNSecret is the coturn static-auth-secret; empty disables credential issuing
+	TURNSecret string
+	// TURNTTL is how long issued TURN credentials stay valid
+	TURNTTL time.Duration
+	// TURNURIs are the TURN server URIs handed out with credentials
+	TURNURIs []string
+	// STUNURIs are the STUN server URIs in the server-wide ICE server list
+	STUNURIs []string
+	// ValidateSDP checks offer/answer SDP and candidates before relaying them
+	ValidateSDP bool
+	// AllowedOrigins are the browser origins allowed to open WebSockets
+	AllowedOrigins []string
+	// StrictOrigin rejects every origin that isn't in AllowedOrigins, even when the list is empty
+	StrictOrigin bool
+	// TrustProxy takes the client IP from X-Forwarded-For/X-Real-IP
+	TrustProxy bool
+	// SendHighWater is the send queue depth considered a backlog (0 disables the check)
+	SendHighWater int
+	// MinProtocol and MinAppVersion reject joins from older clients (zero values disable the checks)
+	MinProtocol   int
+	MinAppVersion string
+	// BanDuration is how long a host's ban lasts unless the 'ban' message gives a duration
+	BanDuration time.Duration
+	// CloseGrace is how long a server-initiated disconnect may spend flushing queued messages
+	CloseGrace time.Duration
+	// SlowClientGrace is how long a backlog may last before the client is disconnected
+	SlowClientGrace time.Duration
+	// ResumeGrace is how long the slot and resume token of a temporarily-left client stay valid (0 disables resume)
+	ResumeGrace time.Duration
+	// MaxResumeSessions caps the resume store (0 means unlimited)
+	MaxResumeSessions int
+	// ResumeStoreFull is "evict" (the oldest session) or "refuse" (the new one) when the store is full
+	ResumeStoreFull string
+	// MaxClients caps the number of clients per room (0 means unlimited)
+	MaxClients int
+	// MeshAdvisorySize is the mesh room size beyond which clients are advised to use a star topology (0 disables it)
+	MeshAdvisorySize int
+	// AdvisoryRelay nominates the relay peer in topology advisories
+	AdvisoryRelay bool
+	// MaxJoinAttempts is how many invalid messages a client may send before joining (0 means unlimited)
+	MaxJoinAttempts int
+	// MaxPreJoinMessages is how many messages of any kind a client may send before joining (0 means unlimited)
+	MaxPreJoinMessages int
+	// PreJoinPolicy is "reject" or "buffer": what happens to routed messages sent before joining
+	PreJoinPolicy string
+	// PreJoinBuffer is how many messages "buffer" keeps for after the join
+	PreJoinBuffer int
+	// NameCollision is "replace" or "replace-dead": which client already holding a joining client's name is replaced
+	NameCollision string
+	// ChatSeenCounts broadcasts aggregated 'chat-seen' counts on read receipts
+	ChatSeenCounts bool
+	// CountHidden includes hidden clients in the occupancy shown to participants
+	CountHidden bool
+	// MaxPendingSetups bounds connections between upgrade and join; beyond it upgrades get 503 (0 means unbounded)
+	MaxPendingSetups int
+	// QoSLogInterval is how often per-room 'qos-report' averages are logged (0 disables)
+	QoSLogInterval time.Duration
+	// RoomCreationLimit caps the rooms one user or IP may create per RoomCreationWindow (0 means unlimited)
+	RoomCreationLimit  int
+	RoomCreationWindow time.Duration
+	// FairBroadcast serves large broadcasts round-robin across rooms
+	FairBroadcast bool
+	// RoomStatsInterval is how often rooms get a 'room-stats' message (0 disables)
+	RoomStatsInterval time.Duration
+	// MaxMessageSize is the largest message a client may send, in bytes (0 means unlimited)
+	MaxMessageSize int64
+	// MaxChunkedSize is the largest message a client may send in 'chunk' messages, in bytes
+	MaxChunkedSize int64
+	// ChunkTimeout expires a chunked transfer whose next chunk doesn't arrive in time
+	ChunkTimeout time.Duration
+	// WriteTimeout bounds each socket write so clients that stop reading are disconnected (0 disables)
+	WriteTimeout time.Duration
+	// KeepaliveInterval is how long a connection may stay quiet before a 'keepalive' is sent (0 disables)
+	KeepaliveInterval time.Duration
+	// MaxDistinctTargets is how many different targets a client may address per DistinctTargetWindow (0 means unlimited)
+	MaxDistinctTargets   int
+	DistinctTargetWindow time.Duration
+	// AbuseThreshold is the anomaly score that flags a connection (0 disables scoring)
+	AbuseThreshold float64
+	// AbuseAction is "log" or "disconnect", applied when a connection is flagged
+	AbuseAction string
+	// AbuseWeights scores each kind of anomaly
+	AbuseWeights map[string]float64
+	// CloseCodes maps server-initiated disconnect reasons to application close codes
+	CloseCodes map[string]int
+	// Priorities orders relayed messages queued for a slow recipient by sender class
+	Priorities map[string]int
+	// NoImplicitRooms rejects joins to rooms that weren't provisioned through the admin API
+	NoImplicitRooms bool
+	// RateLimit is the sustained messages per second allowed per client (0 disables limiting)
+	RateLimit float64
+	// RateBurst is how many messages a client may send at once above the rate
+	RateBurst int
+	// RateLimitExempt lists message types that are never rate limited
+	RateLimitExempt map[string]bool
+	// RoomBroadcastRate is the broadcasts per second allowed per room (0 disables limiting)
+	RoomBroadcastRate float64
+	// WebhookURL receives POSTed copies of selected events when set
+	WebhookURL string
+	// WebhookEvents are the event types mirrored to the webhook
+	WebhookEvents []string
+	// RoomStateURL is the GET URL, with a {room} placeholder, that joining clients' room snapshots come from
+	RoomStateURL string
+	// GeoDB is the MaxMind DB (.mmdb) that -geo-allow and -geo-deny look countries up in
+	GeoDB string
+	// SigningKey is the Ed25519 key file server messages are signed with, or "generate"
+	SigningKey string
+	// AuditLog is where audit records go: empty, file:PATH or an http(s) URL
+	AuditLog string
+	// Metrics names the metrics implementation: none or prometheus
+	Metrics string
+	// Tracing names the span exporter: none, log or otlp
+	Tracing string
+	// OTLPEndpoint is the OTLP/HTTP traces URL spans are sent to with -tracing otlp
+	OTLPEndpoint string
+	// RoomMappings are templates like "ticket-{ticketId}" deriving the room from client attributes
+	RoomMappings []string
+	// Routes maps client message types to how they are routed
+	Routes map[string]route
+	// Reconnectable says per disconnect reason whether clients should reconnect
+	Reconnectable map[string]bool
+	// EchoUnknownTypes answers unknown message types with an 'unknown-type' error, for client development
+	EchoUnknownTypes bool
+	// PeerColors attaches a stable color and avatar seed to membership events
+	PeerColors bool
+	// ColorPalette is the set of colors peers are assigned from
+	ColorPalette []string
+	// ReplayWindow enables nonce checks on join/resume messages and is the allowed clock skew (0 disables)
+	ReplayWindow time.Duration
+	// Banner is the encoded 'banner' message sent right after upgrade, nil for none
+	Banner []byte
+	// AdminToken is the bearer token required by the admin endpoints when set
+	AdminToken string
+	// JWTSecret enables HS256 token authentication at upgrade when set
+	JWTSecret string
+	// MaxConnectionsPerUser caps concurrent connections per token subject (0 means unlimited)
+	MaxConnectionsPerUser int
+}
+
+// Global configuration, filled in by parseFlags
+var config = Config{
+	Addr:               ":3000",
+	TURNTTL:            24 * time.Hour,
+	SendHighWater:      192,
+	SlowClientGrace:    10 * time.Second,
+	CloseGrace:         time.Second,
+	BanDuration:        10 * time.Minute,
+	MaxResumeSessions:  100000,
+	ResumeStoreFull:    "evict",
+	MaxJoinAttempts:    5,
+	MaxPreJoinMessages: 20,
+	KeepaliveInterval:  25 * time.Second,
+	WriteTimeout:       10 * time.Second,
+	MaxPendingSetups:   256,
+	AbuseThreshold:     20,
+	AbuseAction:        "log",
+	RateBurst:          50,
+	RoomCreationWindow: time.Minute,
+}
+
+// parseFlags populates config from the command line
+func parseFlags() {
+	var geoAllow, geoDeny string
+	var logLevelName, turnURIs, stunURIs, palette, banner, routes, reconnectable, closeCodes, abuseWeights, priorities, origins, roomMappings, aliases string
+	rateLimitExempt := "leave,ack,pong,keepalive"
+	webhookEvents := "join,leave,room-created,room-destroyed,chat"
+	flag.StringVar(&config.Addr, "addr", config.Addr, "listen address: host:port, or unix:/path/to.sock for a Unix domain socket")
+	flag.StringVar(&config.TURNSecret, "turn-secret", config.TURNSecret, "shared secret for coturn REST credentials (empty disables /turn-credentials, which also needs -jwt-secret or -admin-token)")
+	flag.DurationVar(&config.TURNTTL, "turn-ttl", config.TURNTTL, "lifetime of issued TURN credentials")
+	flag.StringVar(&turnURIs, "turn-uris", "", "comma-separated TURN URIs returned with credentials")
+	flag.StringVar(&stunURIs, "stun-uris", "", "comma-separated STUN URIs included in the ICE servers sent on join")
+	flag.BoolVar(&config.ValidateSDP, "validate-sdp", config.ValidateSDP, "reject malformed SDP and ICE candidates instead of relaying them")
+	flag.StringVar(&origins, "allowed-origins", "", "comma-separated origins allowed to connect (empty allows any, unless -strict-origin)")
+	flag.BoolVar(&config.StrictOrigin, "strict-origin", config.StrictOrigin, "reject every origin not in -allowed-origins, including requests without an Origin header")
+	flag.BoolVar(&config.TrustProxy, "trust-proxy", config.TrustProxy, "resolve client IPs from X-Forwarded-For/X-Real-IP headers")
+	flag.IntVar(&config.SendHighWater, "send-high-water", config.SendHighWater, "send queue depth that counts as a backlog (0 disables slow-client disconnects)")
+	flag.IntVar(&config.MinProtocol, "min-protocol", 0, "reject joins reporting an older protocol version with 'upgrade-required' (0 disables)")
+	flag.StringVar(&config.MinAppVersion, "min-app-version", "", "reject joins reporting an older dotted app version, or none, with 'upgrade-required' (empty disables)")
+	flag.DurationVar(&config.BanDuration, "ban-duration", config.BanDuration, "how long a host's 'ban' keeps a client out of the room when the message gives no duration")
+	flag.DurationVar(&config.CloseGrace, "close-grace", config.CloseGrace, "how long a server-initiated disconnect may spend delivering already queued messages before closing (0 closes at once)")
+	flag.DurationVar(&config.SlowClientGrace, "slow-client-grace", config.SlowClientGrace, "how long a backlog may last before the client is disconnected as too slow")
+	flag.DurationVar(&config.ResumeGrace, "resume-grace", config.ResumeGrace, "how long the slot of a client that left temporarily is held for resume (0 disables resumable sessions)")
+	flag.IntVar(&config.MaxResumeSessions, "max-resume-sessions", config.MaxResumeSessions, "most resume sessions kept at once (0 means unlimited)")
+	flag.StringVar(&config.ResumeStoreFull, "resume-store-full", config.ResumeStoreFull, "what a full resume store does with a new session: evict the oldest session, or refuse to issue a token")
+	flag.IntVar(&config.MaxClients, "max-clients", config.MaxClients, "maximum clients per room (0 means unlimited)")
+	flag.IntVar(&config.MeshAdvisorySize, "mesh-advisory-size", 0, "clients in a mesh room beyond which a 'topology-advisory' suggests a star topology (0 disables advisories)")
+	flag.BoolVar(&config.AdvisoryRelay, "advisory-relay", true, "nominate the longest-connected client as relay peer in topology advisories")
+	flag.IntVar(&config.MaxJoinAttempts, "max-join-attempts", config.MaxJoinAttempts, "invalid messages allowed before a successful join (0 means unlimited)")
+	flag.StringVar(&config.PreJoinPolicy, "prejoin-policy", "reject", "what to do with signaling sent before joining: reject it with 'join-required', or buffer it and handle it after the join")
+	flag.IntVar(&config.PreJoinBuffer, "prejoin-buffer", 16, "messages -prejoin-policy=buffer keeps for after the join; beyond it they are rejected")
+	flag.StringVar(&config.NameCollision, "name-collision", "replace", "what a join does with a client already holding its name: replace it, or replace-dead to replace only a client whose connection is gone and fail with 'name-taken' otherwise")
+	flag.IntVar(&config.MaxPreJoinMessages, "max-prejoin-messages", config.MaxPreJoinMessages, "messages of any kind allowed before a successful join (0 means unlimited)")
+	flag.BoolVar(&config.ChatSeenCounts, "chat-seen-counts", config.ChatSeenCounts, "broadcast aggregated seen counts when chat read receipts arrive")
+	flag.BoolVar(&config.CountHidden, "count-hidden", true, "include hidden clients in the occupancy shown to participants (room-stats, room-presence, whereami)")
+	flag.IntVar(&config.MaxPendingSetups, "max-pending-setups", config.MaxPendingSetups, "connections allowed between upgrade and join at once; more are shed with 503 (0 means unbounded)")
+	flag.DurationVar(&config.QoSLogInterval, "qos-log-interval", 0, "log per-room averages of the numeric metrics in 'qos-report' messages this often (0 disables)")
+	flag.IntVar(&config.RoomCreationLimit, "room-creation-limit", 0, "maximum rooms one authenticated user, or IP without authentication, may create per -room-creation-window (0 means unlimited)")
+	flag.DurationVar(&config.RoomCreationWindow, "room-creation-window", config.RoomCreationWindow, "window for -room-creation-limit")
+	flag.BoolVar(&config.FairBroadcast, "fair-broadcast", false, "queue large broadcasts per room and serve rooms round-robin, so one huge room can't starve the others")
+	flag.DurationVar(&config.RoomStatsInterval, "room-stats-interval", 0, "push 'room-stats' with client count and message rate to every room this often (0 disables)")
+	flag.Int64Var(&config.MaxMessageSize, "max-message-size", config.MaxMessageSize, "largest message in bytes a client may send; rooms can override it (0 means unlimited)")
+	flag.Int64Var(&config.MaxChunkedSize, "max-chunked-size", 1<<20, "largest message in bytes a client may send split into 'chunk' messages")
+	flag.DurationVar(&config.ChunkTimeout, "chunk-timeout", 30*time.Second, "how long a chunked transfer waits for its next chunk before it expires")
+	flag.DurationVar(&config.WriteTimeout, "write-timeout", config.WriteTimeout, "disconnect a client when a write to it takes longer than this, e.g. because it stopped reading (0 disables)")
+	flag.DurationVar(&config.KeepaliveInterval, "keepalive-interval", config.KeepaliveInterval, "send a 'keepalive' message after this much outbound silence, to keep proxies from closing idle connections (0 disables)")
+	flag.IntVar(&config.MaxDistinctTargets, "max-distinct-targets", 0, "disconnect clients with 'too-many-targets' once they address more than this many different targets within -distinct-target-window (0 disables the check)")
+	flag.DurationVar(&config.DistinctTargetWindow, "distinct-target-window", time.Minute, "window over which -max-distinct-targets counts distinct targets")
+	flag.Float64Var(&config.AbuseThreshold, "abuse-threshold", config.AbuseThreshold, "anomaly score at which a connection is reported as abusive (0 disables scoring)")
+	flag.StringVar(&config.AbuseAction, "abuse-action", config.AbuseAction, "what to do with abusive connections: log or disconnect")
+	flag.StringVar(&abuseWeights, "abuse-weights", "", "comma-separated event=weight overrides for the anomaly score")
+	flag.StringVar(&priorities, "priorities", "", "comma-separated class=priority overrides for relayed messages (classes: host, presenter, participant, observer; higher is delivered first)")
+	flag.BoolVar(&config.NoImplicitRooms, "no-implicit-rooms", config.NoImplicitRooms, "only allow joins to rooms created with PUT /admin/rooms/{name}; by default the first joiner creates a room")
+	flag.Float64Var(&config.RateLimit, "rate-limit", config.RateLimit, "messages per second each client may send (0 disables rate limiting)")
+	flag.IntVar(&config.RateBurst, "rate-burst", config.RateBurst, "messages a client may send in a burst above -rate-limit")
+	flag.Float64Var(&config.RoomBroadcastRate, "room-broadcast-rate", 0, "broadcasts per second all clients of a room may send together, e.g. chat and room-wide relays (0 disables; targeted signaling is never limited)")
+	flag.StringVar(&rateLimitExempt, "rate-limit-exempt", rateLimitExempt, "comma-separated message types that are never rate limited")
+	flag.StringVar(&config.WebhookURL, "webhook-url", config.WebhookURL, "URL that selected events are POSTed to as JSON (empty disables webhooks)")
+	flag.StringVar(&webhookEvents, "webhook-events", webhookEvents, "comma-separated events mirrored to -webhook-url")
+	flag.StringVar(&config.RoomStateURL, "room-state-url", "", "URL with a {room} placeholder that is fetched on join for the app-level state sent in 'room-state' (empty sends none)")
+	flag.StringVar(&config.GeoDB, "geo-db", "", "MaxMind country database (.mmdb) for filtering connections by country (empty disables the filter)")
+	flag.StringVar(&geoAllow, "geo-allow", "", "comma-separated ISO country codes that may connect; others are rejected")
+	flag.StringVar(&geoDeny, "geo-deny", "", "comma-separated ISO country codes that may not connect")
+	flag.StringVar(&config.SigningKey, "signing-key", "", "file with a base64 Ed25519 seed or private key to sign server messages with, or 'generate' for a new key per start; the public key is served at /signing-key (empty disables signing)")
+	flag.StringVar(&config.AuditLog, "audit-log", "", "connection audit trail: file:PATH for JSON lines, or an http(s) URL to POST records to (empty disables it)")
+	flag.StringVar(&logLevelName, "log-level", "debug", "log level: debug logs every message, info only connection and room events; changeable at runtime through POST /admin/loglevel")
+	flag.StringVar(&config.Metrics, "metrics", "none", "metrics implementation: none, or prometheus to serve /metrics")
+	flag.StringVar(&config.Tracing, "tracing", "none", "span exporter for the upgrade, join and forward paths: none, log, or otlp to send to -otlp-endpoint")
+	flag.StringVar(&config.OTLPEndpoint, "otlp-endpoint", "", "OTLP/HTTP traces URL for -tracing otlp, e.g. http://collector:4318/v1/traces")
+	flag.StringVar(&roomMappings, "room-mappings", "", "comma-separated room templates such as 'ticket-{ticketId}'; the first whose attributes a client supplies overrides its requested room")
+	flag.StringVar(&aliases, "room-aliases", "", "comma-separated alias=room pairs; joins to an alias enter the canonical room")
+	flag.StringVar(&reconnectable, "reconnectable", "", "comma-separated reason=true|false overrides of whether clients disconnected for a reason should reconnect, e.g. 'kicked=true'")
+	flag.StringVar(&closeCodes, "close-codes", "", "comma-separated reason=code overrides of the 4000-4999 WebSocket close code sent for each disconnect reason, e.g. 'kicked=4100'")
+	flag.StringVar(&routes, "routes", "", "comma-separated type=targeted|broadcast|server overrides of the message routing table")
+	flag.BoolVar(&config.EchoUnknownTypes, "echo-unknown-types", config.EchoUnknownTypes, "reply to unknown message types with an 'unknown-type' error (for debugging clients)")
+	flag.BoolVar(&config.PeerColors, "peer-colors", config.PeerColors, "assign each client a stable color and avatar seed in membership events")
+	flag.StringVar(&palette, "color-palette", "", "comma-separated colors for -peer-colors (empty uses the built-in palette)")
+	flag.DurationVar(&config.ReplayWindow, "replay-window", config.ReplayWindow, "require a nonce and timestamp on join/resume messages, accepting this clock skew (0 disables)")
+	flag.StringVar(&banner, "banner", "", "banner sent to every client on connect: text or JSON, or @path to read it from a file")
+	flag.StringVar(&config.AdminToken, "admin-token", config.AdminToken, "bearer token required by /rooms, /clients and /admin endpoints (empty leaves them open)")
+	flag.StringVar(&config.JWTSecret, "jwt-secret", config.JWTSecret, "HS256 secret for connection tokens (empty disables authentication)")
+	flag.IntVar(&config.MaxConnectionsPerUser, "max-connections-per-user", config.MaxConnectionsPerUser, "concurrent connections allowed per authenticated user (0 means unlimited)")
+	flag.Parse()
+
+	config.TURNURIs = splitList(turnURIs)
+	config.STUNURIs = splitList(stunURIs)
+	config.AllowedOrigins = splitList(origins)
+	config.RoomMappings = splitList(roomMappings)
+	config.ColorPalette = splitList(palette)
+	config.WebhookEvents = splitList(webhookEvents)
+	config.RateLimitExempt = make(map[string]bool)
+	for _, messageType := range splitList(rateLimitExempt) {
+		config.RateLimitExempt[messageType] = true
+	}
+	if len(config.ColorPalette) == 0 {
+		config.ColorPalette = defaultPalette
+	}
+	var err error
+	if config.Banner, err = loadBanner(banner); err != nil {
+		log.Fatal("Banner error:", err)
+	}
+	if config.Routes, err = parseRoutes(routes); err != nil {
+		log.Fatal("Routes error:", err)
+	}
+	if config.Reconnectable, err = parseReconnectable(reconnectable); err != nil {
+		log.Fatal("Reconnectable error:", err)
+	}
+	if config.CloseCodes, err = parseCloseCodes(closeCodes); err != nil {
+		log.Fatal("Close codes error:", err)
+	}
+	if config.AbuseWeights, err = parseAbuseWeights(abuseWeights); err != nil {
+		log.Fatal("Abuse weights error:", err)
+	}
+	if config.Priorities, err = parsePriorities(priorities); err != nil {
+		log.Fatal("Priorities error:", err)
+	}
+	level, err := parseLogLevel(logLevelName)
+	if err != nil {
+		log.Fatal("Log level error:", err)
+	}
+	logLevel.Set(level)
+	if metrics, err = newMetrics(config.Metrics); err != nil {
+		log.Fatal("Metrics error:", err)
+	}
+	if tracer, err = newTracer(config.Tracing, config.OTLPEndpoint); err != nil {
+		log.Fatal("Tracing error:", err)
+	}
+	if stateProvider, err = newStateProvider(config.RoomStateURL); err != nil {
+		log.Fatal("Room state error:", err)
+	}
+	if geoFilter, err = newGeoFilter(config.GeoDB, splitList(geoAllow), splitList(geoDeny)); err != nil {
+		log.Fatal("Geo filter error:", err)
+	}
+	if signer, err = newMessageSigner(config.SigningKey); err != nil {
+		log.Fatal("Signing key error:", err)
+	}
+	if server.Audit, err = newAuditLog(config.AuditLog); err != nil {
+		log.Fatal("Audit log error:", err)
+	}
+	if config.MinAppVersion != "" {
+		if _, err = parseVersion(config.MinAppVersion); err != nil {
+			log.Fatal("-min-app-version error:", err)
+		}
+	}
+	if err = server.Aliases.parse(aliases); err != nil {
+		log.Fatal("Room aliases error:", err)
+	}
+	if config.PreJoinPolicy != "reject" && config.PreJoinPolicy != "buffer" {
+		log.Fatal("-prejoin-policy must be 'reject' or 'buffer'")
+	}
+	if config.NameCollision != "replace" && config.NameCollision != "replace-dead" {
+		log.Fatal("-name-collision must be 'replace' or 'replace-dead'")
+	}
+	if config.ResumeStoreFull != "evict" && config.ResumeStoreFull != "refuse" {
+		log.Fatal("-resume-store-full must be 'evict' or 'refuse'")
+	}
+	if config.MaxDistinctTargets > 0 && config.DistinctTargetWindow <= 0 {
+		log.Fatal("-distinct-target-window must be positive")
+	}
+	if config.MaxChunkedSize <= 0 || config.ChunkTimeout <= 0 {
+		log.Fatal("-max-chunked-size and -chunk-timeout must be positive")
+	}
+	if config.BanDuration <= 0 {
+		log.Fatal("-ban-duration must be positive")
+	}
+	if config.AbuseAction != "log" && config.AbuseAction != "disconnect" {
+		log.Fatal("-abuse-action must be 'log' or 'disconnect'")
+	}
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
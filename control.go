@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// controlWriteWait bounds writing a pong or a close reply
+const controlWriteWait = time.Second
+
+// readAhead is how many messages the read goroutine may get ahead of
+// readMessages, see startReading
+const readAhead = 64
+
+// handleControlFrames installs the handlers for pings and close frames from
+// the client. gorilla runs them inside ReadMessage on the reading goroutine,
+// so a ping is answered as soon as the reader reaches it, independent of the
+// messages still waiting to be handled. Pongs are written with WriteControl,
+// which may run concurrently with writeMessages.
+func (c *Client) handleControlFrames() {
+	c.Socket.SetPingHandler(func(appData string) error {
+		err := c.Socket.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(controlWriteWait))
+		var netErr net.Error
+		if errors.Is(err, websocket.ErrCloseSent) || errors.As(err, &netErr) && netErr.Timeout() {
+			// The connection is closing, or the next write will fail anyway
+			return nil
+		}
+		return err
+	})
+	c.Socket.SetCloseHandler(func(code int, text string) error {
+		log.Printf("Client '%s' sent close frame %d %q", c.name(), code, text)
+		c.Socket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(controlWriteWait))
+		return nil
+	})
+}
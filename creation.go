@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// maxTrackedCreators is how many creators the limiter remembers before it
+// sweeps out those with no creations left in the window
+const maxTrackedCreators = 10000
+
+// roomCreationLimiter caps how many rooms one creator, an authenticated user
+// or else an IP address, may create per -room-creation-window. Joining
+// rooms that already exist is never limited.
+type roomCreationLimiter struct {
+	mutex   sync.Mutex
+	created map[string][]time.Time
+}
+
+func newRoomCreationLimiter() *roomCreationLimiter {
+	return &roomCreationLimiter{created: make(map[string][]time.Time)}
+}
+
+// allow records a room creation by creator and reports whether it is within
+// the limit
+func (l *roomCreationLimiter) allow(creator string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.created) >= maxTrackedCreators {
+		for other, times := range l.created {
+			if len(recentTimes(times, now)) == 0 {
+				delete(l.created, other)
+			}
+		}
+	}
+	times := recentTimes(l.created[creator], now)
+	if len(times) >= config.RoomCreationLimit {
+		l.created[creator] = times
+		log.Printf("Room creation by %s throttled: %d rooms created in the last %s", creator, len(times), config.RoomCreationWindow)
+		return false
+	}
+	l.created[creator] = append(times, now)
+	return true
+}
+
+// recentTimes drops the creation times that fell out of the window
+func recentTimes(times []time.Time, now time.Time) []time.Time {
+	for len(times) > 0 && now.Sub(times[0]) >= config.RoomCreationWindow {
+		times = times[1:]
+	}
+	return times
+}
+
+// creatorID identifies the client for room creation limits
+func (c *Client) creatorID() string {
+	if c.Subject != "" {
+		return "user " + c.Subject
+	}
+	return "IP " + c.RemoteIP
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sealed envelopes let clients encrypt signaling end-to-end so the server
+// can route it without being able to read or alter it. An envelope is a
+// normal signaling message whose payload is replaced by an opaque "sealed"
+// string (ciphertext, typically base64), next to plaintext routing headers:
+//
+//	{
+//	  "type":   "offer" | "answer" | "candidate",
+//	  "target": "<peer name>",      // or "target-slot": <index>
+//	  "room":   "<sender's room>",
+//	  "sealed": "<ciphertext>",
+//	  "correlationId": "<trace id>", // optional
+//	  "ttlMs":  <milliseconds>      // optional, see messageExpiry
+//	}
+//
+// The server checks the headers, never inspects "sealed", and forwards the
+// frame byte-for-byte. Keys are agreed between peers out of band.
+
+// envelopeFields are the only fields allowed in a sealed envelope
+var envelopeFields = map[string]bool{
+	"type":        true,
+	"target":      true,
+	"target-slot": true,
+	"room":        true,
+	"sealed":      true,
+	// Opaque tracing id, logged but not interpreted (see correlationTag)
+	"correlationId": true,
+	// How long the envelope stays worth delivering (see messageExpiry)
+	"ttlMs": true,
+}
+
+// isSealed reports whether a decoded message is a sealed envelope
+func isSealed(data map[string]interface{}) bool {
+	_, sealed := data["sealed"]
+	return sealed
+}
+
+// validateEnvelope checks the routing headers of a sealed envelope sent from roomName
+func validateEnvelope(data map[string]interface{}, roomName string) error {
+	if _, ok := data["sealed"].(string); !ok {
+		return errors.New("'sealed' must be a string")
+	}
+	room, _ := data["room"].(string)
+	if room == "" {
+		return errors.New("envelope is missing its 'room' header")
+	}
+	if room != roomName {
+		return fmt.Errorf("envelope 'room' header '%s' does not match the sender's room", room)
+	}
+	for field := range data {
+		if !envelopeFields[field] {
+			return fmt.Errorf("envelope carries plaintext field '%s'", field)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateEnvelope(t *testing.T) {
+	tests := []struct {
+		name     string
+		envelope map[string]interface{}
+		// want is part of the error, or "" for a valid envelope
+		want string
+	}{
+		{"headers only", map[string]interface{}{"type": "offer", "target": "bob", "room": "lobby", "sealed": "c2VhbGVk"}, ""},
+		{"with ttl and correlation id", map[string]interface{}{"type": "offer", "target": "bob", "room": "lobby", "sealed": "c2VhbGVk", "ttlMs": 5000.0, "correlationId": "c-1"}, ""},
+		{"plaintext payload", map[string]interface{}{"type": "offer", "target": "bob", "room": "lobby", "sealed": "c2VhbGVk", "sdp": "v=0"}, "plaintext field 'sdp'"},
+		{"other room", map[string]interface{}{"type": "offer", "target": "bob", "room": "elsewhere", "sealed": "c2VhbGVk"}, "does not match"},
+		{"sealed not a string", map[string]interface{}{"type": "offer", "target": "bob", "room": "lobby", "sealed": 1.0}, "must be a string"},
+	}
+	for _, test := range tests {
+		err := validateEnvelope(test.envelope, "lobby")
+		if test.want == "" && err != nil {
+			t.Errorf("%s: rejected with %v", test.name, err)
+		}
+		if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.want)
+		}
+	}
+}
+
+// TestSealedEnvelopeWithTTL relays a sealed offer that carries a TTL and
+// checks it reaches the target unchanged
+func TestSealedEnvelopeWithTTL(t *testing.T) {
+	room := t.Name()
+	alice := joinFake(t, room, "alice")
+	bob := joinFake(t, room, "bob")
+	alice.expect("new-user")
+
+	envelope := `{"type":"offer","target":"bob","room":"` + room + `","sealed":"c2VhbGVk","ttlMs":60000}`
+	alice.feedRaw([]byte(envelope))
+	if got := bob.expectRaw("offer"); string(got) != envelope {
+		t.Fatalf("bob got %s, want the envelope unchanged: %s", got, envelope)
+	}
+}
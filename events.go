@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each room keeps a short history of lifecycle events (joins, leaves,
+// moderation, rejections and server-initiated disconnects) for post-incident
+// analysis through GET /rooms/{name}/events. The history outlives the room,
+// so a call that has ended can still be inspected, until its log is evicted
+// for a newer room's.
+
+// Bounds of the event history
+const (
+	// maxRoomEvents is how many events a room keeps; the oldest are dropped first
+	maxRoomEvents = 256
+	// maxEventRooms is how many rooms keep a history; the least recently
+	// active room's history is dropped first
+	maxEventRooms = 1000
+)
+
+// roomEvent is one entry of a room's event history
+type roomEvent struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Client string    `json:"client,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// eventRing holds a room's latest events, oldest first from start
+type eventRing struct {
+	events []roomEvent
+	start  int
+}
+
+// roomEventStore keeps the event history of every room by name
+type roomEventStore struct {
+	mutex sync.Mutex
+	rooms map[string]*eventRing
+}
+
+func newRoomEventStore() *roomEventStore {
+	return &roomEventStore{rooms: make(map[string]*eventRing)}
+}
+
+// record appends an event to the history of room
+func (s *roomEventStore) record(room, eventType, client, detail string) {
+	event := roomEvent{Time: time.Now().UTC(), Type: eventType, Client: client, Detail: detail}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ring, exists := s.rooms[room]
+	if !exists {
+		if len(s.rooms) >= maxEventRooms {
+			s.evictIdlest()
+		}
+		ring = &eventRing{}
+		s.rooms[room] = ring
+	}
+	if len(ring.events) < maxRoomEvents {
+		ring.events = append(ring.events, event)
+		return
+	}
+	ring.events[ring.start] = event
+	ring.start = (ring.start + 1) % maxRoomEvents
+}
+
+// evictIdlest drops the history whose latest event is the oldest. The
+// caller must hold s.mutex.
+func (s *roomEventStore) evictIdlest() {
+	var idlest string
+	var idlestAt time.Time
+	for name, ring := range s.rooms {
+		if at := ring.latest(); idlest == "" || at.Before(idlestAt) {
+			idlest, idlestAt = name, at
+		}
+	}
+	delete(s.rooms, idlest)
+}
+
+// latest returns the time of the ring's newest event
+func (r *eventRing) latest() time.Time {
+	if len(r.events) == 0 {
+		return time.Time{}
+	}
+	return r.events[(r.start+len(r.events)-1)%len(r.events)].Time
+}
+
+// between returns the events of room from since up to until, oldest first;
+// zero bounds are open. It reports false when the room has no history.
+func (s *roomEventStore) between(room string, since, until time.Time) ([]roomEvent, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ring, exists := s.rooms[room]
+	if !exists {
+		return nil, false
+	}
+	events := make([]roomEvent, 0)
+	for i := range ring.events {
+		event := ring.events[(ring.start+i)%len(ring.events)]
+		if (since.IsZero() || !event.Time.Before(since)) && (until.IsZero() || !event.Time.After(until)) {
+			events = append(events, event)
+		}
+	}
+	return events, true
+}
+
+// handleRoomEvents returns a room's event history, optionally limited to
+// the RFC 3339 times in the 'since' and 'until' query parameters
+func handleRoomEvents(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.PathValue("name"))
+	var bounds [2]time.Time
+	for i, param := range []string{"since", "until"} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		bound, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			http.Error(w, "'"+param+"' must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		bounds[i] = bound
+	}
+	events, exists := server.Events.between(name, bounds[0], bounds[1])
+	if !exists {
+		http.Error(w, "no events recorded for room", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"room": name, "events": events})
+}
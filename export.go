@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// GET /admin/export snapshots the configuration of every room, as it would
+// be provisioned with PUT /admin/rooms/{name}, together with the room
+// aliases; POST /admin/import restores such a snapshot, e.g. on another
+// instance. Live state (clients, slots, hosts, bans, chat history) is not
+// part of it, nor are breakout rooms, which exist only for their main room's
+// call. Codec policies are left out as well: they are announced to clients
+// and go through PUT /admin/rooms/{name}/codec-policy.
+
+// roomConfigVersion is the version of the export format
+const roomConfigVersion = 1
+
+// roomConfig is the body of GET /admin/export and POST /admin/import
+type roomConfig struct {
+	Version int                     `json:"version"`
+	Rooms   map[string]roomSettings `json:"rooms"`
+	Aliases map[string]string       `json:"aliases"`
+}
+
+// settings returns a copy of the room's configuration as provisioning
+// settings. The caller must hold r.Mutex.
+func (r *Room) settings() roomSettings {
+	maxClients, maxMessageSize, queueWhenFull, broadcastRate := r.MaxClients, r.MaxMessageSize, r.QueueWhenFull, r.BroadcastRate
+	mode, topology, resumeGrace := r.mode(), r.topology(), r.ResumeGrace.String()
+	features := make(map[string]bool, len(r.Features))
+	for feature, enabled := range r.Features {
+		features[feature] = enabled
+	}
+	iceServers := append([]iceServer{}, r.ICEServers...)
+	return roomSettings{
+		MaxClients:     &maxClients,
+		MaxMessageSize: &maxMessageSize,
+		QueueWhenFull:  &queueWhenFull,
+		Mode:           &mode,
+		Topology:       &topology,
+		ResumeGrace:    &resumeGrace,
+		BroadcastRate:  &broadcastRate,
+		Features:       &features,
+		ICEServers:     &iceServers,
+	}
+}
+
+// aliases returns a copy of every alias and its target
+func (a *roomAliases) aliases() map[string]string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	aliases := make(map[string]string, len(a.targets))
+	for alias, target := range a.targets {
+		aliases[alias] = target
+	}
+	return aliases
+}
+
+// handleExport returns the configuration of every main room and the room aliases
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	export := roomConfig{Version: roomConfigVersion, Rooms: make(map[string]roomSettings), Aliases: server.Aliases.aliases()}
+	for _, room := range server.Rooms.List() {
+		room.Mutex.Lock()
+		if room.Parent == nil {
+			export.Rooms[room.Name] = room.settings()
+		}
+		room.Mutex.Unlock()
+	}
+	log.Printf("Exported the configuration of %d rooms and %d aliases", len(export.Rooms), len(export.Aliases))
+	writeJSON(w, http.StatusOK, export)
+}
+
+// handleImport provisions every room of an export and sets its aliases.
+// The whole body is validated first; a room or alias that can't be applied
+// then, such as a mode change of a room with clients, is reported in
+// 'errors' without stopping the others.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	var snapshot roomConfig
+	if err := json.NewDecoder(r.Body).Decode(&snapshot); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if snapshot.Version != roomConfigVersion {
+		http.Error(w, fmt.Sprintf("unsupported export version %d, want %d", snapshot.Version, roomConfigVersion), http.StatusBadRequest)
+		return
+	}
+	names := make([]string, 0, len(snapshot.Rooms))
+	for name, settings := range snapshot.Rooms {
+		if strings.TrimSpace(name) == "" {
+			http.Error(w, "room name must not be empty", http.StatusBadRequest)
+			return
+		}
+		if err := settings.validate(); err != nil {
+			http.Error(w, fmt.Sprintf("room '%s': %v", name, err), http.StatusBadRequest)
+			return
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	errs := make(map[string]string)
+	rooms := 0
+	for _, name := range names {
+		if _, err := provisionRoom(strings.TrimSpace(name), snapshot.Rooms[name]); err != nil {
+			errs[name] = err.Error()
+			continue
+		}
+		rooms++
+	}
+	aliases := 0
+	for alias, target := range snapshot.Aliases {
+		if err := server.Aliases.set(alias, target); err != nil {
+			errs["alias "+alias] = err.Error()
+			continue
+		}
+		aliases++
+	}
+	log.Printf("Imported the configuration of %d rooms and %d aliases (%d failed)", rooms, aliases, len(errs))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"rooms": rooms, "aliases": aliases, "errors": errs})
+}
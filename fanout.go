@@ -0,0 +1,144 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// broadcastChunkSize is how many recipients one fan-out job serves.
+// Broadcasts to rooms no larger than this are delivered inline.
+const broadcastChunkSize = 32
+
+var (
+	fanOutJobs      = make(chan func(), 256)
+	fanOutStartOnce sync.Once
+	fairStartOnce   sync.Once
+)
+
+// startFanOutWorkers launches the shared, bounded pool of fan-out workers
+func startFanOutWorkers() {
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		go func() {
+			for job := range fanOutJobs {
+				job()
+			}
+		}()
+	}
+}
+
+// fanOut calls deliver once per client of room, spreading large recipient
+// lists over the worker pool. It returns only after every delivery is done,
+// so messages reach each recipient in the order fanOut was called.
+func fanOut(room *Room, clients []*Client, deliver func(*Client)) {
+	if len(clients) <= broadcastChunkSize {
+		for _, client := range clients {
+			deliver(client)
+		}
+		return
+	}
+	if config.FairBroadcast {
+		fairStartOnce.Do(startFairWorkers)
+	} else {
+		fanOutStartOnce.Do(startFanOutWorkers)
+	}
+
+	var wg sync.WaitGroup
+	for start := 0; start < len(clients); start += broadcastChunkSize {
+		chunk := clients[start:min(start+broadcastChunkSize, len(clients))]
+		wg.Add(1)
+		job := func() {
+			defer wg.Done()
+			for _, client := range chunk {
+				deliver(client)
+			}
+		}
+		if config.FairBroadcast {
+			if !fairJobs.submit(room, job) {
+				job()
+			}
+			continue
+		}
+		select {
+		case fanOutJobs <- job:
+		default:
+			// Pool is saturated; serve this chunk from the caller
+			job()
+		}
+	}
+	wg.Wait()
+}
+
+// With -fair-broadcast, chunks wait in per-room queues instead of the shared
+// channel and workers take one chunk from each busy room in turn, so a huge
+// room's broadcast can't hold up the pool for everyone else.
+
+// fairJobs is the round-robin queue used with config.FairBroadcast
+var fairJobs = newFairQueue(cap(fanOutJobs))
+
+// fairQueue holds fan-out jobs per room and hands them out round-robin
+type fairQueue struct {
+	mutex   sync.Mutex
+	ready   *sync.Cond
+	jobs    map[*Room][]func()
+	rooms   []*Room
+	next    int
+	pending int
+	limit   int
+}
+
+func newFairQueue(limit int) *fairQueue {
+	q := &fairQueue{jobs: make(map[*Room][]func()), limit: limit}
+	q.ready = sync.NewCond(&q.mutex)
+	return q
+}
+
+// submit queues job for room and reports whether there was space for it
+func (q *fairQueue) submit(room *Room, job func()) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.pending >= q.limit {
+		return false
+	}
+	if len(q.jobs[room]) == 0 {
+		q.rooms = append(q.rooms, room)
+	}
+	q.jobs[room] = append(q.jobs[room], job)
+	q.pending++
+	q.ready.Signal()
+	return true
+}
+
+// take waits for a job and returns the next one in round-robin room order
+func (q *fairQueue) take() func() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for q.pending == 0 {
+		q.ready.Wait()
+	}
+	if q.next >= len(q.rooms) {
+		q.next = 0
+	}
+	room := q.rooms[q.next]
+	queued := q.jobs[room]
+	job := queued[0]
+	q.pending--
+	if len(queued) == 1 {
+		delete(q.jobs, room)
+		q.rooms = append(q.rooms[:q.next], q.rooms[q.next+1:]...)
+	} else {
+		q.jobs[room] = queued[1:]
+		q.next++
+	}
+	return job
+}
+
+// startFairWorkers launches the workers serving fairJobs
+func startFairWorkers() {
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		go func() {
+			for {
+				fairJobs.take()()
+			}
+		}()
+	}
+}
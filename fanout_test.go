@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// benchmarkRoom returns a room of size clients that aren't connected, whose
+// queues the benchmark drains itself
+func benchmarkRoom(name string, size int) *Room {
+	room := &Room{Name: name, Clients: make(map[string]*Client, size)}
+	for i := 0; i < size; i++ {
+		client := &Client{Send: make(chan outbound, 256), Done: make(chan struct{})}
+		client.setName(fmt.Sprintf("peer-%d", i))
+		client.setRoom(room)
+		room.Clients[client.name()] = client
+	}
+	return room
+}
+
+// drainRoom empties the send queues of a benchmark room
+func drainRoom(room *Room) {
+	for _, client := range room.Clients {
+		for len(client.Send) > 0 {
+			<-client.Send
+		}
+	}
+}
+
+// broadcastUnderLock is the broadcast from before the worker pool: one loop
+// over the room, holding its lock throughout
+func broadcastUnderLock(room *Room, message []byte) {
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+	for _, client := range room.Clients {
+		client.enqueue(message)
+	}
+}
+
+// benchmarkBroadcasts runs broadcast b.N times while another goroutine
+// takes the room lock, as a join would, and reports how long it waited
+func benchmarkBroadcasts(b *testing.B, room *Room, broadcast func()) {
+	var waited time.Duration
+	for i := 0; i < b.N; i++ {
+		started := make(chan struct{})
+		probed := make(chan time.Duration)
+		go func() {
+			<-started
+			begin := time.Now()
+			room.Mutex.Lock()
+			room.Mutex.Unlock()
+			probed <- time.Since(begin)
+		}()
+		close(started)
+		broadcast()
+		b.StopTimer()
+		waited += <-probed
+		drainRoom(room)
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(waited.Nanoseconds())/float64(b.N), "lock-wait-ns/op")
+}
+
+// BenchmarkBroadcastLargeRoom compares a broadcast served in the caller
+// under the room lock with one fanned out over the worker pool. Besides
+// the time per broadcast it reports how long a concurrent join would wait
+// for the room lock.
+func BenchmarkBroadcastLargeRoom(b *testing.B) {
+	message := signMessage([]byte(`{"type":"notice","text":"hello"}`))
+	for _, size := range []int{100, 1000, 5000} {
+		room := benchmarkRoom(b.Name(), size)
+		b.Run(fmt.Sprintf("clients=%d/under-lock", size), func(b *testing.B) {
+			benchmarkBroadcasts(b, room, func() { broadcastUnderLock(room, message) })
+		})
+		b.Run(fmt.Sprintf("clients=%d/worker-pool", size), func(b *testing.B) {
+			benchmarkBroadcasts(b, room, func() { room.Broadcast(message, "", false) })
+		})
+	}
+}
+
+// BenchmarkBroadcastMixedRooms broadcasts to one huge room and many
+// two-chunk rooms at once, with and without -fair-broadcast. Each operation
+// is one round of those broadcasts. It reports how long the small rooms'
+// broadcasts took on average, which is what fairness is meant to keep
+// short while the huge room holds the pool.
+func BenchmarkBroadcastMixedRooms(b *testing.B) {
+	message := signMessage([]byte(`{"type":"notice","text":"hello"}`))
+	huge := benchmarkRoom(b.Name()+"-huge", 4096)
+	small := make([]*Room, 16)
+	for i := range small {
+		small[i] = benchmarkRoom(fmt.Sprintf("%s-small-%d", b.Name(), i), 2*broadcastChunkSize)
+	}
+	fair := config.FairBroadcast
+	defer func() { config.FairBroadcast = fair }()
+	for _, fairBroadcast := range []bool{false, true} {
+		b.Run(fmt.Sprintf("fair=%t", fairBroadcast), func(b *testing.B) {
+			config.FairBroadcast = fairBroadcast
+			var smallTotal time.Duration
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				wg.Add(1 + len(small))
+				go func() {
+					defer wg.Done()
+					huge.Broadcast(message, "", false)
+				}()
+				took := make(chan time.Duration, len(small))
+				for _, room := range small {
+					go func() {
+						defer wg.Done()
+						start := time.Now()
+						room.Broadcast(message, "", false)
+						took <- time.Since(start)
+					}()
+				}
+				wg.Wait()
+				close(took)
+				for elapsed := range took {
+					smallTotal += elapsed
+				}
+				b.StopTimer()
+				drainRoom(huge)
+				for _, room := range small {
+					drainRoom(room)
+				}
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(smallTotal.Nanoseconds())/float64(b.N*len(small)), "small-room-ns/op")
+		})
+	}
+}
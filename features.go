@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Room features are flags the operator sets when provisioning a room, e.g.
+// {"chat": true, "recording": false}, and clients receive in 'joined' to
+// adapt their UI. The server treats them as opaque, except that it also
+// refuses chat in rooms where "chat" is false.
+
+// featureChat is the feature flag that gates chat and read receipts
+const featureChat = "chat"
+
+// featureEnabled reports whether the room has the named feature; features
+// that were never set count as enabled
+func (r *Room) featureEnabled(name string) bool {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	enabled, set := r.Features[name]
+	return !set || enabled
+}
+
+// requireFeature rejects a message that needs a feature the client's room
+// has disabled, and reports whether it may proceed
+func (c *Client) requireFeature(name, messageType string) bool {
+	if c.room().featureEnabled(name) {
+		return true
+	}
+	log.Printf("Rejected '%s' from '%s': feature '%s' is disabled in room '%s'", messageType, c.name(), name, c.room().Name)
+	c.trySend(errorMessage("feature-disabled", fmt.Sprintf("'%s' is disabled in room '%s'", name, c.room().Name)))
+	return false
+}
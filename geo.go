@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// GeoFilter decides whether a client address may connect, e.g. to enforce
+// regional access policy. It runs before the WebSocket upgrade; a rejected
+// client gets a 403 with the reason. Implementations must be safe for
+// concurrent use.
+type GeoFilter interface {
+	// Allow reports whether ip may connect and, if not, why. ip is nil when
+	// the client address doesn't parse, e.g. a forged X-Forwarded-For.
+	Allow(ip net.IP) (bool, string)
+}
+
+// geoFilter is the filter chosen with -geo-db; nil accepts every address
+var geoFilter GeoFilter
+
+// countryFilter accepts or rejects addresses by the ISO country code a
+// MaxMind DB, such as GeoLite2-Country, maps them to. With an allow list only
+// the listed countries get through, including none for addresses the
+// database doesn't know or that don't parse; the deny list rejects its
+// countries either way.
+// Loopback and private addresses are always accepted.
+type countryFilter struct {
+	db    *mmdbReader
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// newGeoFilter returns the filter for -geo-db and its country lists, nil when no database is set
+func newGeoFilter(path string, allow, deny []string) (GeoFilter, error) {
+	if path == "" {
+		if len(allow) > 0 || len(deny) > 0 {
+			return nil, fmt.Errorf("-geo-allow and -geo-deny need -geo-db")
+		}
+		return nil, nil
+	}
+	db, err := openMMDB(path)
+	if err != nil {
+		return nil, err
+	}
+	filter := &countryFilter{db: db, allow: make(map[string]bool), deny: make(map[string]bool)}
+	for _, country := range allow {
+		filter.allow[strings.ToUpper(country)] = true
+	}
+	for _, country := range deny {
+		filter.deny[strings.ToUpper(country)] = true
+	}
+	log.Printf("Geo filter loaded from '%s': allow %v, deny %v", path, allow, deny)
+	return filter, nil
+}
+
+func (f *countryFilter) Allow(ip net.IP) (bool, string) {
+	if ip == nil {
+		if len(f.allow) > 0 {
+			return false, "connections from unknown locations are not accepted"
+		}
+		return true, ""
+	}
+	if ip.IsLoopback() || ip.IsPrivate() {
+		return true, ""
+	}
+	country, err := f.country(ip)
+	if err != nil {
+		// A lookup failure is the database's fault, not the client's
+		log.Printf("Geo lookup of %s failed: %v", ip, err)
+		return true, ""
+	}
+	if f.deny[country] {
+		return false, fmt.Sprintf("connections from %s are not accepted", country)
+	}
+	if len(f.allow) > 0 && !f.allow[country] {
+		if country == "" {
+			return false, "connections from unknown locations are not accepted"
+		}
+		return false, fmt.Sprintf("connections from %s are not accepted", country)
+	}
+	return true, ""
+}
+
+// country returns the ISO code of the country of ip, falling back to the
+// country the network is registered in; empty when the database has neither
+func (f *countryFilter) country(ip net.IP) (string, error) {
+	record, err := f.db.lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	fields, _ := record.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := fields[key].(map[string]interface{})
+		if code, _ := country["iso_code"].(string); code != "" {
+			return strings.ToUpper(code), nil
+		}
+	}
+	return "", nil
+}
+
+// checkGeo applies the geo filter to the client address and reports whether
+// the connection may go on; a rejected client has already been answered
+func checkGeo(w http.ResponseWriter, r *http.Request) bool {
+	if geoFilter == nil {
+		return true
+	}
+	address := clientIP(r)
+	allowed, reason := geoFilter.Allow(net.ParseIP(address))
+	if allowed {
+		return true
+	}
+	log.Printf("Rejected WebSocket upgrade from %s: %s", address, reason)
+	metrics.IncCounter("signaling_upgrade_failures_total", "reason", "geo-blocked")
+	writeJSON(w, http.StatusForbidden, map[string]interface{}{
+		"type":    "error",
+		"code":    "geo-blocked",
+		"message": reason,
+	})
+	return false
+}
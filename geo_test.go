@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCountryFilterUnparseableAddress(t *testing.T) {
+	db := countryDB(t, 24, 6)
+	if allowed, _ := (&countryFilter{db: db, allow: map[string]bool{"DE": true}}).Allow(nil); allowed {
+		t.Error("an unparseable address got past the allow list")
+	}
+	if allowed, _ := (&countryFilter{db: db, deny: map[string]bool{"US": true}}).Allow(nil); !allowed {
+		t.Error("an unparseable address was rejected without an allow list")
+	}
+	if allowed, _ := (&countryFilter{db: db, allow: map[string]bool{"DE": true}}).Allow(net.ParseIP("1.2.3.4")); !allowed {
+		t.Error("an allowed country was rejected")
+	}
+}
+
+func TestCheckGeoForgedAddress(t *testing.T) {
+	filter, trustProxy := geoFilter, config.TrustProxy
+	t.Cleanup(func() { geoFilter, config.TrustProxy = filter, trustProxy })
+	geoFilter = &countryFilter{db: countryDB(t, 24, 6), allow: map[string]bool{"DE": true}}
+	config.TrustProxy = true
+
+	for forwarded, want := range map[string]bool{"x": false, "1.2.3.4": true, "8.8.8.8": false} {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.Header.Set("X-Forwarded-For", forwarded)
+		w := httptest.NewRecorder()
+		if allowed := checkGeo(w, r); allowed != want {
+			t.Errorf("X-Forwarded-For %q allowed=%t, want %t", forwarded, allowed, want)
+		}
+		if !want && w.Code != http.StatusForbidden {
+			t.Errorf("X-Forwarded-For %q rejected with status %d, want 403", forwarded, w.Code)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// glareWindow is how recent an unanswered offer must be to count as crossing
+const glareWindow = 2 * time.Second
+
+// offerRecord is the last unanswered offer between a pair of clients
+type offerRecord struct {
+	From, To string
+	At       time.Time
+}
+
+// pairKey identifies an unordered pair of client names
+func pairKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "\x00" + b
+}
+
+// isPolite decides the perfect-negotiation role of name against peer: the
+// greater name yields, so both sides agree without coordinating
+func isPolite(name, peer string) bool {
+	return name > peer
+}
+
+// noteSignal records an offer or answer from one client to another and
+// reports whether an offer crossed an unanswered offer going the other way
+func (r *Room) noteSignal(messageType, from, to string, now time.Time) bool {
+	key := pairKey(from, to)
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if messageType == "answer" {
+		delete(r.offers, key)
+		return false
+	}
+	if previous, exists := r.offers[key]; exists && previous.From == to && now.Sub(previous.At) <= glareWindow {
+		delete(r.offers, key)
+		return true
+	}
+	if r.offers == nil {
+		r.offers = make(map[string]offerRecord)
+	}
+	r.offers[key] = offerRecord{From: from, To: to, At: now}
+	return false
+}
+
+// forgetOffers drops the offer records involving name. The caller must hold r.Mutex.
+func (r *Room) forgetOffers(name string) {
+	for key, offer := range r.offers {
+		if offer.From == name || offer.To == name {
+			delete(r.offers, key)
+		}
+	}
+}
+
+// renameInOffers moves the offer records of a renamed client to its new
+// name, so its in-flight offers still match. The caller must hold r.Mutex.
+func (r *Room) renameInOffers(oldName, newName string) {
+	for key, offer := range r.offers {
+		if offer.From != oldName && offer.To != oldName {
+			continue
+		}
+		delete(r.offers, key)
+		if offer.From == oldName {
+			offer.From = newName
+		} else {
+			offer.To = newName
+		}
+		r.offers[pairKey(offer.From, offer.To)] = offer
+	}
+}
+
+// resolveGlare tells both sides of crossing offers which one is polite. The
+// sender gets a 'glare' notice; the offer to target is annotated with
+// 'polite', except sealed envelopes, which can't be altered and are
+// accompanied by a notice instead. It returns the message to forward.
+func (c *Client) resolveGlare(target *Client, data map[string]interface{}, message []byte, sealed bool) []byte {
+	log.Printf("Glare detected between '%s' and '%s' in room '%s'", c.name(), target.name(), c.room().Name)
+	if c.Protocol >= protocolGlareHints {
+		c.trySend(glareMessage(target.name(), isPolite(c.name(), target.name())))
+	}
+	if target.Protocol < protocolGlareHints {
+		return message
+	}
+	if sealed {
+		target.trySend(glareMessage(c.name(), isPolite(target.name(), c.name())))
+		return message
+	}
+	annotated, err := withFields(message, map[string]interface{}{"polite": isPolite(target.name(), c.name())})
+	if err != nil {
+		return message
+	}
+	return annotated
+}
+
+// glareMessage tells a client its role against peer after crossing offers
+func glareMessage(peer string, polite bool) []byte {
+	glareJSON, _ := json.Marshal(map[string]interface{}{
+		"type":   "glare",
+		"peer":   peer,
+		"polite": polite,
+	})
+	return glareJSON
+}
@@ -0,0 +1,31 @@
+package main
+
+// A client joining with "hidden": true, e.g. a recording bot, receives all
+// room traffic but doesn't appear to participants: it is left out of
+// 'user-list', 'new-user', 'leave' and membership deltas, takes no slot, and
+// never becomes host or publisher. Hidden joins need the admin token on the
+// WebSocket upgrade request, so they are refused when -admin-token is unset.
+// Hidden clients neither count towards nor are limited by room capacity;
+// -count-hidden=false also leaves them out of the occupancy shown to
+// participants.
+
+// visibleCount returns how many clients in the room are not hidden. The
+// caller must hold r.Mutex.
+func (r *Room) visibleCount() int {
+	count := 0
+	for _, client := range r.Clients {
+		if !client.Hidden {
+			count++
+		}
+	}
+	return count
+}
+
+// occupancy returns the client count shown to participants. The caller must
+// hold r.Mutex.
+func (r *Room) occupancy() int {
+	if config.CountHidden {
+		return len(r.Clients)
+	}
+	return r.visibleCount()
+}
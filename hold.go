@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// A client on hold stays connected but gets no room traffic: broadcasts and
+// targeted messages meant for it are queued, up to maxQueuedWhileHeld, and
+// delivered in order when the hold is released. Replies from the server to
+// the client's own requests are not held.
+
+// maxQueuedWhileHeld bounds the messages kept for a client on hold
+const maxQueuedWhileHeld = 256
+
+// holdIfPaused queues message when the client is on hold and reports whether
+// it did so, in which case the caller must not send it. Messages beyond the
+// cap are dropped.
+func (c *Client) holdIfPaused(message outbound) bool {
+	if !c.Paused.Load() {
+		return false
+	}
+	c.awayMutex.Lock()
+	defer c.awayMutex.Unlock()
+	// Re-check under the lock so a concurrent release can't strand the message
+	if !c.Paused.Load() {
+		return false
+	}
+	if len(c.heldQueue) >= maxQueuedWhileHeld {
+		log.Printf("Hold queue for client '%s' is full (%d messages). Message dropped.", c.name(), maxQueuedWhileHeld)
+		metrics.IncCounter("signaling_messages_dropped_total", "kind", "held")
+		return true
+	}
+	c.heldQueue = append(c.heldQueue, message)
+	return true
+}
+
+// setPaused puts the client on hold or releases it, flushing what was queued
+// meanwhile. The flush holds the queue lock, so messages sent concurrently
+// are delivered after the queued ones.
+func (c *Client) setPaused(paused bool) {
+	c.awayMutex.Lock()
+	if c.Paused.Swap(paused) == paused {
+		c.awayMutex.Unlock()
+		return
+	}
+	dropped := 0
+	if !paused {
+		for _, message := range c.heldQueue {
+			if !c.enqueueOutbound(message) {
+				dropped++
+			}
+		}
+		c.heldQueue = nil
+	}
+	c.awayMutex.Unlock()
+	if dropped > 0 {
+		log.Printf("Send buffer full for client '%s' while releasing hold. %d messages dropped.", c.name(), dropped)
+	}
+
+	holdMessage := map[string]interface{}{
+		"type":   "hold-state",
+		"paused": paused,
+	}
+	holdJSON, _ := json.Marshal(holdMessage)
+	c.trySend(holdJSON)
+	log.Printf("Client '%s' in room '%s' paused=%t", c.name(), c.room().Name, paused)
+}
+
+// holdPeer puts a peer of the host's room on hold or releases it. Only the
+// host may do so.
+func (c *Client) holdPeer(target string, paused bool) error {
+	room := c.room()
+	room.Mutex.Lock()
+	if room.Host != c.name() {
+		room.Mutex.Unlock()
+		return fmt.Errorf("only the host can put clients of room '%s' on hold", room.Name)
+	}
+	targetClient, exists := room.Clients[target]
+	room.Mutex.Unlock()
+	if !exists || target == c.name() {
+		return fmt.Errorf("no other client '%s' in room '%s'", target, room.Name)
+	}
+	targetClient.setPaused(paused)
+	return nil
+}
+
+// handleHold puts a client on hold or releases it
+func handleHold(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Room   string `json:"room"`
+		Client string `json:"client"`
+		Paused bool   `json:"paused"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Room == "" || req.Client == "" {
+		http.Error(w, "body must be JSON with a 'room' and a 'client'", http.StatusBadRequest)
+		return
+	}
+	room, exists := server.Rooms.Get(req.Room)
+	if !exists {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+	room.Mutex.Lock()
+	client, exists := room.Clients[req.Client]
+	room.Mutex.Unlock()
+	if !exists {
+		http.Error(w, "client not found", http.StatusNotFound)
+		return
+	}
+	client.setPaused(req.Paused)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"room": room.Name, "client": client.name(), "paused": req.Paused})
+}
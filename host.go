@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// electHost picks the longest-connected client as the new host, or "" when
+// the room is empty. The caller must hold r.Mutex.
+func (r *Room) electHost() string {
+	var host *Client
+	for _, client := range r.Clients {
+		if client.Hidden {
+			continue
+		}
+		if host == nil || client.ConnectedAt.Before(host.ConnectedAt) {
+			host = client
+		}
+	}
+	if host == nil {
+		return ""
+	}
+	log.Printf("Client '%s' is now host of room '%s'", host.name(), r.Name)
+	return host.name()
+}
+
+// broadcastHost announces the current host to everyone in the room
+func (r *Room) broadcastHost() {
+	r.Mutex.Lock()
+	host := r.Host
+	r.Mutex.Unlock()
+	hostChangedMessage := map[string]interface{}{
+		"type": "host-changed",
+		"host": host,
+	}
+	hostChangedJSON, _ := json.Marshal(hostChangedMessage)
+	r.Broadcast(hostChangedJSON, "", false)
+}
+
+// setRoomLock locks or unlocks the client's room. Only the host may do so.
+func (c *Client) setRoomLock(locked bool) error {
+	room := c.room()
+	room.Mutex.Lock()
+	if room.Host != c.name() {
+		room.Mutex.Unlock()
+		return fmt.Errorf("only the host can lock or unlock room '%s'", room.Name)
+	}
+	room.Locked = locked
+	room.admitWaiting()
+	room.Mutex.Unlock()
+	log.Printf("Room '%s' locked=%t by host '%s'", room.Name, locked, c.name())
+
+	lockStateMessage := map[string]interface{}{
+		"type":   "room-lock-state",
+		"locked": locked,
+		"by":     c.name(),
+	}
+	lockStateJSON, _ := json.Marshal(lockStateMessage)
+	room.Broadcast(lockStateJSON, "", false)
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// iceServer is one entry of an RTCPeerConnection iceServers list
+type iceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// defaultICEServers builds the server-wide list: the configured STUN URIs,
+// then the TURN URIs with freshly minted credentials for user
+func defaultICEServers(user string, now time.Time) []iceServer {
+	servers := make([]iceServer, 0, 2)
+	if len(config.STUNURIs) > 0 {
+		servers = append(servers, iceServer{URLs: config.STUNURIs})
+	}
+	if turnEnabled() && len(config.TURNURIs) > 0 {
+		credentials := newTURNCredentials(user, now)
+		servers = append(servers, iceServer{
+			URLs:       credentials.URIs,
+			Username:   credentials.Username,
+			Credential: credentials.Credential,
+		})
+	}
+	return servers
+}
+
+// iceServersFor returns the room's ICE server override, or the server-wide
+// list when the room has none
+func (r *Room) iceServersFor(user string, now time.Time) []iceServer {
+	r.Mutex.Lock()
+	override := r.ICEServers
+	r.Mutex.Unlock()
+	if override != nil {
+		return override
+	}
+	return defaultICEServers(user, now)
+}
+
+// maxMessageSize returns the room's read limit, or the server-wide limit
+// when the room has no override
+func (r *Room) maxMessageSize() int64 {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if r.MaxMessageSize > 0 {
+		return r.MaxMessageSize
+	}
+	return config.MaxMessageSize
+}
+
+// roomSettings is the body of PUT /admin/rooms/{name}; omitted fields are left unchanged
+type roomSettings struct {
+	MaxClients     *int   `json:"maxClients"`
+	MaxMessageSize *int64 `json:"maxMessageSize"`
+	QueueWhenFull  *bool  `json:"queueWhenFull"`
+	// Mode is "mesh" or "publish-subscribe"; it can only change while the room is empty
+	Mode *string `json:"mode"`
+	// Topology is "any", "targeted-only" or "broadcast-only"
+	Topology    *string `json:"topology"`
+	ResumeGrace *string `json:"resumeGrace"`
+	// BroadcastRate is the room's broadcasts per second; 0 uses -room-broadcast-rate
+	BroadcastRate *float64 `json:"broadcastRate"`
+	// Features replaces the room's feature flags; an empty map clears them
+	Features *map[string]bool `json:"features"`
+	// ICEServers replaces the server-wide list for the room; an empty list
+	// clears the override
+	ICEServers *[]iceServer `json:"iceServers"`
+}
+
+// handleProvisionRoom creates the named room if needed and applies its settings.
+// They take effect for clients joining afterwards.
+func handleProvisionRoom(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.PathValue("name"))
+	if name == "" {
+		http.Error(w, "room name must not be empty", http.StatusBadRequest)
+		return
+	}
+	var settings roomSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response, err := provisionRoom(name, settings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("Room '%s' provisioned: %v", name, response)
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// errModeNotEmpty rejects a mode change of a room that has clients
+var errModeNotEmpty = errors.New("the mode of a room can only change while it is empty")
+
+// validate checks the settings before any of them is applied
+func (s roomSettings) validate() error {
+	if s.ResumeGrace != nil {
+		if resumeGrace, err := time.ParseDuration(*s.ResumeGrace); err != nil || resumeGrace < 0 {
+			return errors.New("'resumeGrace' must be a non-negative duration")
+		}
+	}
+	if s.MaxClients != nil && *s.MaxClients < 0 {
+		return errors.New("'maxClients' must not be negative")
+	}
+	if s.BroadcastRate != nil && *s.BroadcastRate < 0 {
+		return errors.New("'broadcastRate' must not be negative")
+	}
+	if s.MaxMessageSize != nil && *s.MaxMessageSize < 0 {
+		return errors.New("'maxMessageSize' must not be negative")
+	}
+	if s.ICEServers != nil {
+		for _, ice := range *s.ICEServers {
+			if len(ice.URLs) == 0 {
+				return errors.New("every ICE server needs at least one URL")
+			}
+		}
+	}
+	if s.Mode != nil && *s.Mode != roomModeMesh && *s.Mode != roomModePublishSubscribe {
+		return fmt.Errorf("'mode' must be '%s' or '%s'", roomModeMesh, roomModePublishSubscribe)
+	}
+	if s.Topology != nil && *s.Topology != topologyAny && *s.Topology != topologyTargetedOnly && *s.Topology != topologyBroadcastOnly {
+		return fmt.Errorf("'topology' must be '%s', '%s' or '%s'", topologyAny, topologyTargetedOnly, topologyBroadcastOnly)
+	}
+	return nil
+}
+
+// provisionRoom creates the named room if needed and applies settings that
+// passed validate, returning the room's resulting settings. Nothing is
+// applied when it returns errModeNotEmpty.
+func provisionRoom(name string, settings roomSettings) (map[string]interface{}, error) {
+	room := server.GetOrCreateRoom(name)
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+	if settings.Mode != nil && *settings.Mode != room.mode() {
+		if len(room.Clients) > 0 {
+			return nil, errModeNotEmpty
+		}
+		room.Mode = *settings.Mode
+	}
+	if settings.Topology != nil {
+		room.Topology = *settings.Topology
+	}
+	if settings.MaxClients != nil {
+		room.MaxClients = *settings.MaxClients
+	}
+	if settings.MaxMessageSize != nil {
+		room.MaxMessageSize = *settings.MaxMessageSize
+	}
+	if settings.ResumeGrace != nil {
+		room.ResumeGrace, _ = time.ParseDuration(*settings.ResumeGrace)
+	}
+	if settings.BroadcastRate != nil {
+		room.BroadcastRate = *settings.BroadcastRate
+	}
+	if settings.QueueWhenFull != nil {
+		room.QueueWhenFull = *settings.QueueWhenFull
+		if !room.QueueWhenFull {
+			room.rejectWaiting(&joinError{Code: "room-full", Message: fmt.Sprintf("room '%s' is full", room.Name)})
+		}
+	}
+	room.admitWaiting()
+	if settings.Features != nil {
+		// Replaced rather than updated in place, so welcome can read it unlocked
+		room.Features = *settings.Features
+		if len(room.Features) == 0 {
+			room.Features = nil
+		}
+	}
+	if settings.ICEServers != nil {
+		room.ICEServers = *settings.ICEServers
+		if len(room.ICEServers) == 0 {
+			room.ICEServers = nil
+		}
+	}
+	return map[string]interface{}{
+		"name":           room.Name,
+		"maxClients":     room.MaxClients,
+		"maxMessageSize": room.MaxMessageSize,
+		"queueWhenFull":  room.QueueWhenFull,
+		"mode":           room.mode(),
+		"topology":       room.topology(),
+		"resumeGrace":    room.ResumeGrace.String(),
+		"broadcastRate":  room.BroadcastRate,
+		"iceServers":     room.ICEServers,
+		"features":       room.Features,
+	}, nil
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/websocket"
+)
+
+// awaitJoin reads messages from a freshly upgraded socket until the client
+// joins or resumes a session. Invalid messages are answered with an error;
+// after config.MaxJoinAttempts of them the connection is closed, as it is
+// after config.MaxPreJoinMessages messages of any kind. Other messages are
+// rejected with 'join-required', or with -prejoin-policy=buffer kept, up to
+// -prejoin-buffer of them, for readMessages to handle once the client is in
+// a room. It reports whether the client is now in a room; otherwise the
+// socket is closed.
+func (c *Client) awaitJoin() bool {
+	failures, received := 0, 0
+	// fail reports an invalid message and tells whether to keep waiting
+	fail := func(code, message string) bool {
+		failures++
+		if config.MaxJoinAttempts > 0 && failures >= config.MaxJoinAttempts {
+			log.Printf("Closing connection from %s after %d invalid join attempts", c.RemoteIP, failures)
+			rejectConnection(c.Socket, websocket.ClosePolicyViolation, code, message+" (too many invalid attempts)")
+			return false
+		}
+		if _, err := writeFrame(c.Socket, signMessage(errorMessage(code, message))); err != nil {
+			log.Println("WriteMessage error during initial join:", err)
+		}
+		return true
+	}
+
+	for {
+		_, message, err := c.Socket.ReadMessage()
+		if err != nil {
+			log.Printf("ReadMessage error during initial join from %s (%s): %v", c.RemoteIP, c.UserAgent, err)
+			c.Socket.Close()
+			return false
+		}
+		c.Traffic.Read.Add(int64(len(message)))
+		if received++; config.MaxPreJoinMessages > 0 && received > config.MaxPreJoinMessages {
+			log.Printf("Closing connection from %s (%s) after %d messages without a successful join", c.RemoteIP, c.UserAgent, config.MaxPreJoinMessages)
+			rejectConnection(c.Socket, websocket.ClosePolicyViolation, "too-many-messages", fmt.Sprintf("no successful join within %d messages", config.MaxPreJoinMessages))
+			return false
+		}
+		debugf("Initial message received: %s", message)
+		data, err := decodeFrame(message)
+		if err == errMalformedFrame {
+			log.Println("Malformed frame:", err)
+			c.suspect("invalid-json")
+			if !fail("malformed-frame", err.Error()) {
+				return false
+			}
+			continue
+		}
+		if err != nil {
+			log.Println("Invalid message format:", err)
+			c.suspect("invalid-json")
+			if !fail("invalid-json", "message is not valid JSON") {
+				return false
+			}
+			continue
+		}
+		messageType, _ := data["type"].(string)
+		if messageType == "resume" || messageType == "join" {
+			if err := checkReplay(data, time.Now()); err != nil {
+				log.Printf("Rejected '%s' from %s: %v", messageType, c.RemoteIP, err)
+				c.suspect("replay")
+				if !fail("replay-detected", err.Error()) {
+					return false
+				}
+				continue
+			}
+		}
+		switch messageType {
+		case "resume":
+			token, _ := data["token"].(string)
+			protocol, _ := data["protocol"].(float64)
+			c.Protocol = normalizeProtocol(int(protocol))
+			if err := c.resume(token); err != nil {
+				// The client is expected to fall back to a fresh 'join'
+				log.Println("Resume failed:", err)
+				writeFrame(c.Socket, signMessage(errorMessage("resume-expired", err.Error())))
+				continue
+			}
+			return true
+		case "join":
+			req, err := parseJoinMessage(data)
+			if err != nil {
+				log.Println("Invalid join message:", err)
+				if !fail("invalid-join", err.Error()) {
+					return false
+				}
+				continue
+			}
+			if err := c.join(req); err != nil {
+				if _, exists := server.Rooms.Get(req.Room); exists {
+					server.Events.record(req.Room, "join-rejected", req.Name, joinErrorCode(err))
+				}
+				rejectJoin(c.Socket, err)
+				return false
+			}
+			return true
+		default:
+			routed := config.Routes[messageType] != routeUnknown
+			if routed && config.PreJoinPolicy == "buffer" && len(c.preJoin) < config.PreJoinBuffer {
+				log.Printf("Buffered '%s' from %s until it joins", messageType, c.RemoteIP)
+				c.preJoin = append(c.preJoin, message)
+				continue
+			}
+			log.Println("Expected 'join' message, received:", messageType)
+			if routed {
+				c.suspect("prejoin-signal")
+			}
+			if !fail("join-required", fmt.Sprintf("expected a 'join' message, got '%s'", messageType)) {
+				return false
+			}
+		}
+	}
+}
+
+// joinRequest holds the fields a client supplies to enter a room,
+// whether they arrive in a 'join' message or in the URL query string
+type joinRequest struct {
+	Name     string
+	Room     string
+	Protocol int
+	// Attributes describe the client, e.g. a ticket id; a matching
+	// -room-mappings template picks the room from them
+	Attributes map[string]string
+	// Role is rolePublisher or roleSubscriber in publish-subscribe rooms
+	Role string
+	// AppVersion is the client application's version, e.g. "2.3.1"
+	AppVersion string
+	// CorrelationID is the client's optional trace id for the join
+	CorrelationID string
+	// Hidden asks to join without appearing to participants; see hidden.go
+	Hidden bool
+}
+
+// parseJoinMessage extracts and validates a joinRequest from a decoded 'join' message
+func parseJoinMessage(data map[string]interface{}) (joinRequest, error) {
+	attributes := make(map[string]string)
+	if fields, ok := data["attributes"].(map[string]interface{}); ok {
+		for key, value := range fields {
+			if text, ok := value.(string); ok {
+				attributes[key] = text
+			}
+		}
+	}
+	_, mapped := mappedRoom(attributes)
+
+	nameInterface, nameExists := data["name"]
+	roomInterface, roomExists := data["room"]
+	if !nameExists || (!roomExists && !mapped) {
+		return joinRequest{}, errors.New("missing name or room")
+	}
+	name, ok := nameInterface.(string)
+	if !ok {
+		return joinRequest{}, errors.New("'name' field is not a string")
+	}
+	roomName, ok := roomInterface.(string)
+	if !ok && !mapped {
+		return joinRequest{}, errors.New("'room' field is not a string")
+	}
+	protocol, _ := data["protocol"].(float64)
+	role, _ := data["role"].(string)
+	appVersion, _ := data["appVersion"].(string)
+	hidden, _ := data["hidden"].(bool)
+	req := joinRequest{Name: name, Room: roomName, Protocol: int(protocol), Attributes: attributes, Role: role, AppVersion: appVersion, CorrelationID: correlationID(data), Hidden: hidden}
+	if err := req.validate(); err != nil {
+		return joinRequest{}, err
+	}
+	return req, nil
+}
+
+// reservedNames can't be used as client names because they read as server or
+// routing sentinels in messages; matched case-insensitively
+var reservedNames = map[string]bool{
+	"server":    true,
+	"system":    true,
+	"host":      true,
+	"all":       true,
+	"everyone":  true,
+	"*":         true,
+	"null":      true,
+	"undefined": true,
+}
+
+// validate normalizes the request in place and rejects empty, reserved or
+// control-character names and empty rooms. A room mapped from the client's
+// attributes replaces the requested one.
+func (j *joinRequest) validate() error {
+	if room, ok := mappedRoom(j.Attributes); ok {
+		j.Room = room
+	}
+	j.Name = strings.TrimSpace(j.Name)
+	j.Room = strings.TrimSpace(j.Room)
+	j.Protocol = normalizeProtocol(j.Protocol)
+	if j.Name == "" {
+		return errors.New("'name' must not be empty")
+	}
+	if reservedNames[strings.ToLower(j.Name)] {
+		return fmt.Errorf("'name' %q is reserved", j.Name)
+	}
+	if strings.IndexFunc(j.Name, unicode.IsControl) >= 0 {
+		return errors.New("'name' must not contain control characters")
+	}
+	if j.Room == "" {
+		return errors.New("'room' must not be empty")
+	}
+	if j.Role != "" && j.Role != rolePublisher && j.Role != roleSubscriber {
+		return fmt.Errorf("'role' must be '%s' or '%s'", rolePublisher, roleSubscriber)
+	}
+	return nil
+}
+
+// joinError is a join rejection carrying the error code reported to the client
+type joinError struct {
+	Code    string
+	Message string
+	// RetryAfter is how long until the join may succeed, when known
+	RetryAfter time.Duration
+}
+
+func (e *joinError) Error() string {
+	return e.Message
+}
+
+// joinErrorCode returns the client-facing code of a join failure
+func joinErrorCode(err error) string {
+	var joinErr *joinError
+	if errors.As(err, &joinErr) {
+		return joinErr.Code
+	}
+	return "join-rejected"
+}
+
+// join adds the client to the requested room, sends it the current user list
+// and announces it to the other clients. On error the client has not joined.
+func (c *Client) join(req joinRequest) (err error) {
+	log.Printf("Client '%s' is joining room '%s'", req.Name, req.Room)
+	span := tracer.Start("signaling.join", req.CorrelationID, "room", req.Room, "client", req.Name, "message.type", "join")
+	defer func() {
+		if err != nil {
+			span.SetAttribute("error.code", joinErrorCode(err))
+		}
+		span.End()
+	}()
+	if err := checkVersion(req.Protocol, req.AppVersion); err != nil {
+		return err
+	}
+	if req.Hidden && !c.adminAuthorized {
+		return &joinError{Code: "unauthorized", Message: "hidden joins need the admin token"}
+	}
+	c.Protocol = req.Protocol
+	c.AppVersion = req.AppVersion
+	c.role = req.Role
+	c.Hidden = req.Hidden
+	_, c.stickyRoom = mappedRoom(req.Attributes)
+
+	// Get or create the room and add the client to it, retrying if the room
+	// was deleted between the lookup and the admission
+	for {
+		room, err := server.openRoom(req.Room, c.creatorID())
+		if err != nil {
+			return err
+		}
+		err = c.admit(room, req.Name, true)
+		if joinErrorCode(err) == "room-full" && room.queuesJoins() {
+			err = c.waitInQueue(room, req.Name)
+		}
+		if err == errRoomDeleted {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		c.announceJoin()
+		return nil
+	}
+}
+
+// errRoomDeleted is returned by admit for a room removed from the store
+var errRoomDeleted = &joinError{Code: "room-deleted", Message: "room was deleted"}
+
+// admit checks the room's join rules and inserts the client under the room
+// lock. With evict set, a client already holding the name is disconnected;
+// otherwise the name must be free.
+func (c *Client) admit(room *Room, name string, evict bool) error {
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+	return c.admitLocked(room, name, evict, false)
+}
+
+// admitLocked is admit for callers holding room.Mutex. Unless the client
+// comes from the room's join queue, it can't take a place while others
+// are queued for one.
+func (c *Client) admitLocked(room *Room, name string, evict, queued bool) error {
+	if room.deleted {
+		return errRoomDeleted
+	}
+	if remaining := room.banRemaining(c, name, time.Now()); remaining > 0 {
+		return bannedError(room.Name, remaining)
+	}
+	if room.Locked {
+		return &joinError{Code: "room-locked", Message: fmt.Sprintf("room '%s' is locked", room.Name)}
+	}
+	if !c.Hidden {
+		if err := room.claimPublisher(name, c.role); err != nil {
+			return err
+		}
+	}
+	existingClient, exists := room.Clients[name]
+	dead := exists && existingClient.disconnecting()
+	// A name is never passed between a hidden and a visible client
+	replace := exists && evict && existingClient.Hidden == c.Hidden && (dead || config.NameCollision == "replace")
+	full := len(room.waiting) > 0 && !queued
+	if capacity := room.capacity(); (full || capacity > 0 && room.visibleCount() >= capacity) && !replace && !c.Hidden {
+		return &joinError{Code: "room-full", Message: fmt.Sprintf("room '%s' is full (%d clients)", room.Name, capacity)}
+	}
+	// Check if a client with the same name already exists in the room
+	if exists {
+		if !replace {
+			return &joinError{Code: "name-taken", Message: fmt.Sprintf("name '%s' is already taken in room '%s'", name, room.Name)}
+		}
+		// The check and the replacement both happen under the room lock, so of
+		// concurrent joins with one name exactly one ends up in the map. The
+		// evicted connection's own cleanup either ran first, in which case the
+		// name was free, or sees takenOver and neither removes nor announces it.
+		if dead {
+			log.Printf("Client with name '%s' in room '%s' is already disconnecting. Taking over its name.", name, room.Name)
+		} else {
+			log.Printf("Client with name '%s' already exists in room '%s'. Removing existing client.", name, room.Name)
+			existingClient.disconnect(websocket.CloseNormalClosure, "replaced")
+		}
+		existingClient.takenOver.Store(true)
+		server.Events.record(room.Name, "replaced", name, "")
+		room.retireUsage(existingClient)
+		delete(room.Clients, name)
+	}
+	c.setName(name)
+	c.setRoom(room)
+	c.roomUsageBase = c.usage()
+	room.Clients[c.name()] = c
+	if c.Hidden {
+		return nil
+	}
+	room.assignSlot(c.name())
+	if room.Mode == roomModePublishSubscribe && c.role == rolePublisher {
+		room.Publisher = c.name()
+	}
+	if room.Host == "" {
+		room.Host = c.name()
+		log.Printf("Client '%s' is now host of room '%s'", c.name(), room.Name)
+	}
+	return nil
+}
+
+// announceJoin confirms the join to the client, sends it the user list and
+// broadcasts 'new-user' to the rest of its room
+func (c *Client) announceJoin() {
+	room := c.room()
+	log.Printf("Client '%s' added to room '%s'. Current clients in room: %v", c.name(), room.Name, room.ClientList())
+	c.readLimit.Store(room.maxMessageSize())
+	c.welcome(false)
+
+	if !c.Hidden {
+		// Broadcast the new user to other clients in the room
+		room.broadcastMembership([]string{c.name()}, nil, c.name(), true)
+		room.broadcastSlots()
+		room.Mutex.Lock()
+		publishing := room.Publisher == c.name()
+		room.Mutex.Unlock()
+		if publishing {
+			room.broadcastPublisher()
+		}
+		room.updateAdvisory(c)
+	}
+	server.Webhooks.emit("join", map[string]interface{}{"room": room.Name, "name": c.name()})
+	server.Audit.record("join", c, room.Name, "")
+	detail := ""
+	if c.Hidden {
+		detail = "hidden"
+	}
+	server.Events.record(room.Name, "join", c.name(), detail)
+}
+
+// welcome sends the client its 'joined' confirmation and the user list
+func (c *Client) welcome(resumed bool) {
+	room := c.room()
+	if c.SessionID == "" && room.resumeGrace() > 0 {
+		c.SessionID = server.Sessions.Issue(c)
+	}
+
+	room.Mutex.Lock()
+	host := room.Host
+	slot := room.slotOf(c.name())
+	codecPolicy := room.CodecPolicy
+	mode, publisher := room.Mode, room.Publisher
+	topology := room.Topology
+	features := room.Features
+	room.Mutex.Unlock()
+
+	// Confirm the join, embedding TURN credentials and ICE servers when they are configured
+	joinedMessage := map[string]interface{}{
+		"type":     "joined",
+		"name":     c.name(),
+		"room":     room.Name,
+		"host":     host,
+		"slot":     slot,
+		"protocol": c.Protocol,
+	}
+	if c.Hidden {
+		joinedMessage["hidden"] = true
+	}
+	if c.SessionID != "" {
+		joinedMessage["resumeToken"] = c.SessionID
+		joinedMessage["resumed"] = resumed
+	}
+	if turnEnabled() {
+		joinedMessage["turn"] = newTURNCredentials(c.name(), time.Now())
+	}
+	if codecPolicy != nil {
+		joinedMessage["codecPolicy"] = codecPolicy
+	}
+	if mode == roomModePublishSubscribe {
+		joinedMessage["mode"] = mode
+		joinedMessage["publisher"] = publisher
+	}
+	if topology != "" && topology != topologyAny {
+		joinedMessage["topology"] = topology
+	}
+	if len(features) > 0 {
+		joinedMessage["features"] = features
+	}
+	if iceServers := room.iceServersFor(c.name(), time.Now()); len(iceServers) > 0 {
+		joinedMessage["iceServers"] = iceServers
+	}
+	if config.PeerColors {
+		joinedMessage["appearance"] = appearanceOf(c.name())
+	}
+	joinedJSON, _ := json.Marshal(joinedMessage)
+	c.trySend(joinedJSON)
+
+	// Initialize userList as an empty slice
+	userList := make([]string, 0)
+
+	// Send user-list to the new client
+	room.Mutex.Lock()
+	for name, client := range room.Clients {
+		if name != c.name() && !client.Hidden {
+			userList = append(userList, name)
+		}
+	}
+	room.Mutex.Unlock()
+
+	userListMessage := map[string]interface{}{
+		"type":     "user-list",
+		"users":    userList,
+		"versions": room.versionsOf(userList),
+	}
+	if config.PeerColors {
+		userListMessage["appearance"] = appearancesOf(userList)
+	}
+	userListJSON, _ := json.Marshal(userListMessage)
+	c.trySend(userListJSON)
+	debugf("User list sent to client '%s' in room '%s'", c.name(), room.Name)
+	c.sendRoomState()
+}
+
+// switchRoom moves the client to another room over the same socket. The
+// destination is checked first, so on error the client stays where it was.
+func (c *Client) switchRoom(roomName string) error {
+	if c.stickyRoom {
+		return &joinError{Code: "room-assigned", Message: "the room was assigned by the server and can't be changed"}
+	}
+	req := joinRequest{Name: c.name(), Room: roomName}
+	if err := req.validate(); err != nil {
+		return &joinError{Code: "invalid-join", Message: err.Error()}
+	}
+	oldRoom := c.room()
+	if req.Room == oldRoom.Name {
+		return &joinError{Code: "invalid-join", Message: fmt.Sprintf("already in room '%s'", req.Room)}
+	}
+	log.Printf("Client '%s' is switching from room '%s' to room '%s'", c.name(), oldRoom.Name, req.Room)
+
+	room, err := server.openRoom(req.Room, c.creatorID())
+	if err != nil {
+		return err
+	}
+	return c.moveTo(room, req.Name)
+}
+
+// moveTo transfers the client into room under name, announcing its leave in
+// the old room and its join in the new one. It must run on the client's own
+// goroutine; on error the client stays where it was.
+func (c *Client) moveTo(room *Room, name string) error {
+	oldRoom, oldName := c.room(), c.name()
+	if err := c.admit(room, name, false); err != nil {
+		return err
+	}
+	oldRoom.RemoveClient(oldName)
+	c.announceJoin()
+	return nil
+}
+
+// rename changes the client's name, moving its entry in the room's client map
+// and announcing the change to everyone in the room
+func (c *Client) rename(newName string) error {
+	req := joinRequest{Name: newName, Room: c.room().Name}
+	if err := req.validate(); err != nil {
+		return err
+	}
+	room := c.room()
+	if c.Hidden {
+		return errors.New("hidden clients can't rename")
+	}
+
+	room.Mutex.Lock()
+	oldName := c.name()
+	if req.Name == oldName {
+		room.Mutex.Unlock()
+		return nil
+	}
+	if _, exists := room.Clients[req.Name]; exists {
+		room.Mutex.Unlock()
+		return fmt.Errorf("name '%s' is already taken in room '%s'", req.Name, room.Name)
+	}
+	delete(room.Clients, oldName)
+	c.setName(req.Name)
+	room.Clients[c.name()] = c
+	if room.Host == oldName {
+		room.Host = c.name()
+	}
+	if room.Publisher == oldName {
+		room.Publisher = c.name()
+	}
+	if slot := room.slotOf(oldName); slot >= 0 {
+		room.Slots[slot] = c.name()
+	}
+	room.renameInOffers(oldName, c.name())
+	room.renameInChats(oldName, c.name())
+	room.Mutex.Unlock()
+	log.Printf("Client '%s' renamed to '%s' in room '%s'", oldName, c.name(), room.Name)
+
+	renamedMessage := map[string]interface{}{
+		"type":    "renamed",
+		"oldName": oldName,
+		"newName": c.name(),
+	}
+	renamedJSON, _ := json.Marshal(renamedMessage)
+	room.Broadcast(renamedJSON, "", false)
+	room.broadcastSlots()
+	// The client may be the advised relay
+	room.updateAdvisory(nil)
+	server.Presence.notify(room.Name)
+	return nil
+}
+
+// freeName returns name, or name with the lowest numeric suffix ("name-2",
+// "name-3", ...) that no client in the room is using
+func (r *Room) freeName(name string) string {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	candidate := name
+	for i := 2; ; i++ {
+		if _, taken := r.Clients[candidate]; !taken {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestRenameDuringRelay renames a client while a peer's chat is fanned out
+// to it, so the race detector sees the name being read by the fan-out
+// workers and the writer as it changes
+func TestRenameDuringRelay(t *testing.T) {
+	room := t.Name()
+	renamer := joinTest(t, room, "renamer")
+	sender := joinTest(t, room, "sender")
+	sender.drain()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			sender.send(map[string]interface{}{"type": "chat", "text": fmt.Sprint(i)})
+		}
+	}()
+	last := ""
+	for i := 0; i < 50; i++ {
+		last = fmt.Sprintf("renamer-%d", i)
+		renamer.send(map[string]interface{}{"type": "rename", "name": last})
+	}
+	wg.Wait()
+	renamer.drain()
+
+	waitFor(t, 5*time.Second, "the last rename", func() bool {
+		client := roomClients(room)[last]
+		return client != nil && client.name() == last
+	})
+	if clients := roomClients(room); len(clients) != 2 {
+		t.Fatalf("room has %d clients after renames, want 2: %v", len(clients), clients)
+	}
+}
+
+// TestSwitchRoomDuringForward switches a client between two rooms while a
+// peer forwards offers to it. The frames are queued up front on fake
+// sockets, so nothing but the server orders the switcher's room changes and
+// the forwarder's reads of them.
+func TestSwitchRoomDuringForward(t *testing.T) {
+	rooms := [2]string{t.Name() + "-a", t.Name() + "-b"}
+	switcher := joinFake(t, rooms[0], "switcher")
+	var forwarders sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		forwarder := joinFake(t, rooms[0], fmt.Sprint("forwarder-", i))
+		forwarders.Add(1)
+		go func() {
+			defer forwarders.Done()
+			for j := 0; j < 5000; j++ {
+				forwarder.feed(map[string]interface{}{"type": "offer", "target": "switcher", "sdp": fmt.Sprint(j)})
+			}
+		}()
+	}
+
+	const switches = 1000
+	for i := 1; i <= switches; i++ {
+		switcher.feed(map[string]interface{}{"type": "switch-room", "room": rooms[i%2]})
+	}
+	forwarders.Wait()
+
+	// The offers keep the switcher's send queue full, so its replies may be
+	// dropped; ask until one arrives, which it does after the last switch
+	var where map[string]interface{}
+	waitFor(t, 20*time.Second, "the switcher's whereami reply", func() bool {
+		switcher.feed(map[string]interface{}{"type": "whereami"})
+		data, ok := switcher.await("whereami", 100*time.Millisecond)
+		return ok && json.Unmarshal(data, &where) == nil
+	})
+	// An even number of switches ends in the first room
+	if where["room"] != rooms[0] {
+		t.Fatalf("switcher ended in room %v, want '%s'", where["room"], rooms[0])
+	}
+	if clients := roomClients(rooms[1]); len(clients) != 0 {
+		t.Fatalf("room '%s' kept clients after the switcher left: %v", rooms[1], clients)
+	}
+}
+
+// TestConcurrentSameNameJoins joins many connections under one name at once.
+// Each join replaces the client holding the name, so exactly one must end up
+// in the room, with every other connection closed and nothing left behind.
+func TestConcurrentSameNameJoins(t *testing.T) {
+	room := t.Name()
+	goroutines := runtime.NumGoroutine()
+	sockets := make([]*fakeSocket, 20)
+	for i := range sockets {
+		sockets[i] = serveFake(t, "/ws")
+	}
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, socket := range sockets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			socket.feed(map[string]interface{}{"type": "join", "room": room, "name": "alice"})
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	var survivor *fakeSocket
+	waitFor(t, 5*time.Second, "all but one connection to be replaced", func() bool {
+		open := 0
+		for _, socket := range sockets {
+			if !socket.isClosed() {
+				open++
+				survivor = socket
+			}
+		}
+		return open == 1
+	})
+	survivor.expect("joined")
+	clients := roomClients(room)
+	if len(clients) != 1 || clients["alice"] == nil || clients["alice"].Socket != survivor {
+		t.Fatalf("room holds %v, want only the open connection as 'alice'", clients)
+	}
+	alice := clients["alice"]
+	r, _ := server.Rooms.Get(room)
+	r.Mutex.Lock()
+	slots, host := append([]string(nil), r.Slots...), r.Host
+	r.Mutex.Unlock()
+	taken := 0
+	for _, name := range slots {
+		if name != "" {
+			taken++
+		}
+	}
+	if taken != 1 || host != "alice" {
+		t.Fatalf("room has slots %q and host %q, want one slot and host for 'alice'", slots, host)
+	}
+	server.Sessions.mutex.Lock()
+	for token, session := range server.Sessions.sessions {
+		if session.Client.room() == r && session.Client != alice {
+			t.Errorf("resume session %s still held by a replaced client", token)
+		}
+	}
+	server.Sessions.mutex.Unlock()
+
+	survivor.Close()
+	waitFor(t, 5*time.Second, "the room to empty", func() bool { return len(roomClients(room)) == 0 })
+	waitFor(t, 5*time.Second, "the connections' goroutines to exit", func() bool { return runtime.NumGoroutine() <= goroutines })
+}
+
+// TestTakeoverDuringDisconnect hangs up a client at the moment a new
+// connection joins under its name, so the old client's cleanup interleaves
+// with the takeover. Whichever runs first, the new client must keep the name
+// and the room must see alice leave at most once, never after she rejoined.
+func TestTakeoverDuringDisconnect(t *testing.T) {
+	waitFor(t, 5*time.Second, "earlier tests' clients to be cleaned up", func() bool { return server.connected.Load() == 0 })
+	for i := 0; i < 50; i++ {
+		room := fmt.Sprintf("%s-%d", t.Name(), i)
+		carol := joinFake(t, room, "carol")
+		old := joinFake(t, room, "alice")
+		carol.expect("new-user")
+		newer := serveFake(t, "/ws")
+
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			old.hangUp(websocket.CloseGoingAway)
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			newer.feed(map[string]interface{}{"type": "join", "room": room, "name": "alice"})
+		}()
+		close(start)
+		wg.Wait()
+		newer.expect("joined")
+		// The old client's cleanup is done once only carol and the new alice count as connected
+		waitFor(t, 5*time.Second, "the old connection's cleanup", func() bool { return old.isClosed() && server.connected.Load() == 2 })
+
+		clients := roomClients(room)
+		if len(clients) != 2 || clients["alice"] == nil || clients["alice"].Socket != newer {
+			t.Fatalf("round %d: room holds %v, want carol and the new connection as 'alice'", i, clients)
+		}
+		r, _ := server.Rooms.Get(room)
+		r.Mutex.Lock()
+		slots := append([]string(nil), r.Slots...)
+		r.Mutex.Unlock()
+		taken := 0
+		for _, name := range slots {
+			if name != "" {
+				taken++
+			}
+		}
+		if taken != 2 {
+			t.Fatalf("round %d: room has slots %q, want one each for carol and alice", i, slots)
+		}
+
+		// Carol sees alice leave and rejoin, or just rejoin, and nothing after it
+		carol.feed(map[string]interface{}{"type": "whereami"})
+		var seen []string
+		for {
+			data, ok := carol.next(time.Now().Add(5 * time.Second))
+			if !ok {
+				t.Fatalf("round %d: timed out waiting for carol's whereami", i)
+			}
+			var message map[string]interface{}
+			json.Unmarshal(data, &message)
+			if message["type"] == "whereami" {
+				break
+			}
+			if (message["type"] == "leave" || message["type"] == "new-user") && message["name"] == "alice" {
+				seen = append(seen, message["type"].(string))
+			}
+		}
+		if got := fmt.Sprint(seen); got != "[new-user]" && got != "[leave new-user]" {
+			t.Fatalf("round %d: carol saw alice %v, want a rejoin after at most one leave", i, seen)
+		}
+
+		carol.Close()
+		newer.Close()
+		waitFor(t, 5*time.Second, "the room to empty", func() bool { return len(roomClients(room)) == 0 })
+		waitFor(t, 5*time.Second, "the connections' cleanup", func() bool { return server.connected.Load() == 0 })
+	}
+}
+
+// TestReadReceiptAfterSenderRename acknowledges a chat message after its
+// sender and then its reader rename, so the receipt must follow both names
+func TestReadReceiptAfterSenderRename(t *testing.T) {
+	room := t.Name()
+	alice := joinFake(t, room, "alice")
+	bob := joinFake(t, room, "bob")
+	alice.expect("new-user")
+
+	alice.feed(map[string]interface{}{"type": "chat", "text": "hello"})
+	id := bob.expect("chat")["id"]
+	alice.feed(map[string]interface{}{"type": "rename", "name": "anna"})
+	bob.expect("renamed")
+
+	bob.feed(map[string]interface{}{"type": "read-receipt", "id": id})
+	if receipt := alice.expect("read-receipt"); receipt["id"] != id || receipt["by"] != "bob" {
+		t.Fatalf("anna got receipt %v, want message %v read by bob", receipt, id)
+	}
+
+	bob.feed(map[string]interface{}{"type": "rename", "name": "bea"})
+	alice.expect("renamed")
+	r, _ := server.Rooms.Get(room)
+	r.Mutex.Lock()
+	seenBy := r.chats[id.(string)].SeenBy
+	renamed, stale := seenBy["bea"], seenBy["bob"]
+	r.Mutex.Unlock()
+	if !renamed || stale {
+		t.Fatalf("message %v seen by bea %v and bob %v after the reader's rename, want only bea", id, renamed, stale)
+	}
+}
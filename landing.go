@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// version is the server version, set at build time with
+// -ldflags "-X main.version=1.2.3"; otherwise the module version is used
+var version = ""
+
+// serverVersion returns the version reported on the landing page
+func serverVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "devel"
+}
+
+// handleLanding describes the running instance: its version, the endpoints
+// it serves and which optional features this configuration enables
+func handleLanding(w http.ResponseWriter, r *http.Request) {
+	endpoints := []string{"/ws", "/healthz", "/turn-credentials", "/rooms", "/clients/{name}", "/admin/..."}
+	if _, ok := metrics.(http.Handler); ok {
+		endpoints = append(endpoints, "/metrics")
+	}
+	if signer != nil {
+		endpoints = append(endpoints, "/signing-key")
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"name":      "webrtc-teste signaling server",
+		"version":   serverVersion(),
+		"endpoints": endpoints,
+		"draining":  server.Draining.Load(),
+		"features": map[string]bool{
+			"jwtAuth":             config.JWTSecret != "",
+			"adminAuth":           config.AdminToken != "",
+			"turn":                turnEnabled(),
+			"resume":              config.ResumeGrace > 0,
+			"implicitRooms":       !config.NoImplicitRooms,
+			"sdpValidation":       config.ValidateSDP,
+			"replayProtection":    config.ReplayWindow > 0,
+			"rateLimit":           config.RateLimit > 0,
+			"roomCreationLimit":   config.RoomCreationLimit > 0,
+			"originAllowlist":     len(config.AllowedOrigins) > 0,
+			"webhooks":            server.Webhooks != nil,
+			"auditLog":            server.Audit != nil,
+			"signedMessages":      signer != nil,
+			"roomStats":           config.RoomStatsInterval > 0,
+			"qosLog":              config.QoSLogInterval > 0,
+			"peerColors":          config.PeerColors,
+			"msgpack":             true,
+			"minimumVersionCheck": config.MinProtocol > 0 || config.MinAppVersion != "",
+		},
+	})
+}
+
+// handleHealth reports whether the instance takes new connections
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if server.Draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "draining"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The loadtest subcommand measures the server under synthetic load:
+//
+//	ws loadtest -rooms 50 -clients 4 -rate 10 -duration 30s [-- server flags]
+//
+// Every client joins its room and then sends 'dtmf' messages to the next
+// client of the room at -rate messages per second. Without -url the server
+// runs in the same process, configured by the flags after "--" and with its
+// log discarded, so the goroutine and heap peaks cover it; they include the
+// two goroutines the load generator runs per client. The result is printed
+// as one JSON object, to be kept for comparison between runs.
+
+// loadResult is the outcome of a load test
+type loadResult struct {
+	URL            string      `json:"url"`
+	Rooms          int         `json:"rooms"`
+	ClientsPerRoom int         `json:"clientsPerRoom"`
+	RatePerClient  float64     `json:"ratePerClient"`
+	Duration       string      `json:"duration"`
+	Connected      int         `json:"connected"`
+	Sent           int64       `json:"sent"`
+	Received       int64       `json:"received"`
+	Dropped        int64       `json:"dropped"`
+	Errors         int64       `json:"errors"`
+	LatencyMs      loadLatency `json:"latencyMs"`
+	PeakGoroutines int         `json:"peakGoroutines,omitempty"`
+	PeakHeapBytes  uint64      `json:"peakHeapBytes,omitempty"`
+}
+
+// loadLatency summarizes how long messages took from sender to target
+type loadLatency struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// loadClient is one simulated client; latencies is only touched by its reader
+type loadClient struct {
+	socket    *websocket.Conn
+	name      string
+	peer      string
+	latencies []time.Duration
+	read      chan struct{}
+}
+
+// runLoadTest runs the loadtest subcommand and returns its exit status
+func runLoadTest(args []string) int {
+	flags := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	url := flags.String("url", "", "WebSocket URL of the server under test (empty runs one in-process)")
+	rooms := flags.Int("rooms", 10, "number of rooms")
+	clients := flags.Int("clients", 4, "clients per room (at least 2)")
+	rate := flags.Float64("rate", 5, "messages per second each client sends")
+	duration := flags.Duration("duration", 10*time.Second, "how long clients send messages")
+	drain := flags.Duration("drain", time.Second, "how long to wait for messages in flight after sending stops")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *rooms < 1 || *clients < 2 || *rate <= 0 || *duration <= 0 {
+		fmt.Fprintln(os.Stderr, "loadtest: -rooms must be at least 1, -clients at least 2, and -rate and -duration positive")
+		return 2
+	}
+
+	inProcess := *url == ""
+	if inProcess {
+		os.Args = append([]string{os.Args[0]}, flags.Args()...)
+		parseFlags()
+		log.SetOutput(io.Discard)
+		server.startServices()
+		registerHandlers()
+		testServer := httptest.NewServer(http.DefaultServeMux)
+		defer testServer.Close()
+		*url = "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws"
+	}
+
+	result := loadResult{
+		URL:            *url,
+		Rooms:          *rooms,
+		ClientsPerRoom: *clients,
+		RatePerClient:  *rate,
+		Duration:       duration.String(),
+	}
+	var joined []*loadClient
+	for r := 0; r < *rooms; r++ {
+		for i := 0; i < *clients; i++ {
+			client := &loadClient{
+				name: fmt.Sprintf("load-%d", i),
+				peer: fmt.Sprintf("load-%d", (i+1)%*clients),
+				read: make(chan struct{}),
+			}
+			if err := client.join(*url, fmt.Sprintf("load-%d", r)); err != nil {
+				fmt.Fprintf(os.Stderr, "loadtest: client %s of room %d: %v\n", client.name, r, err)
+				result.Errors++
+				continue
+			}
+			joined = append(joined, client)
+		}
+	}
+	result.Connected = len(joined)
+
+	var sent, received, errorCount atomic.Int64
+	for _, client := range joined {
+		go client.readAll(&received, &errorCount)
+	}
+
+	stopSampling := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		var stats runtime.MemStats
+		for {
+			if inProcess {
+				result.PeakGoroutines = max(result.PeakGoroutines, runtime.NumGoroutine())
+				runtime.ReadMemStats(&stats)
+				result.PeakHeapBytes = max(result.PeakHeapBytes, stats.HeapAlloc)
+			}
+			select {
+			case <-ticker.C:
+			case <-stopSampling:
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(*duration)
+	interval := time.Duration(float64(time.Second) / *rate)
+	var senders sync.WaitGroup
+	for _, client := range joined {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for now := range ticker.C {
+				if now.After(deadline) {
+					return
+				}
+				message, _ := json.Marshal(map[string]interface{}{
+					"type":   "dtmf",
+					"target": client.peer,
+					"tones":  "1",
+					"sentAt": time.Now().UnixNano(),
+				})
+				if err := client.socket.WriteMessage(websocket.TextMessage, message); err != nil {
+					return
+				}
+				sent.Add(1)
+			}
+		}()
+	}
+	senders.Wait()
+	time.Sleep(*drain)
+	close(stopSampling)
+	<-sampled
+
+	var latencies []time.Duration
+	for _, client := range joined {
+		client.socket.Close()
+		<-client.read
+		latencies = append(latencies, client.latencies...)
+	}
+	if inProcess {
+		server.background.cancel()
+	}
+
+	result.Sent, result.Received = sent.Load(), received.Load()
+	result.Dropped = result.Sent - result.Received
+	result.Errors += errorCount.Load()
+	result.LatencyMs = summarizeLatencies(latencies)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		fmt.Fprintln(os.Stderr, "loadtest:", err)
+		return 1
+	}
+	return 0
+}
+
+// join connects the client and waits until it has joined room
+func (c *loadClient) join(url, room string) error {
+	socket, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return err
+	}
+	joinJSON, _ := json.Marshal(map[string]interface{}{"type": "join", "room": room, "name": c.name})
+	if err := socket.WriteMessage(websocket.TextMessage, joinJSON); err != nil {
+		socket.Close()
+		return err
+	}
+	socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, message, err := socket.ReadMessage()
+		if err != nil {
+			socket.Close()
+			return err
+		}
+		var reply struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(message, &reply)
+		switch reply.Type {
+		case "joined":
+			socket.SetReadDeadline(time.Time{})
+			c.socket = socket
+			return nil
+		case "error":
+			socket.Close()
+			return fmt.Errorf("join rejected: %s", reply.Message)
+		}
+	}
+}
+
+// readAll counts the messages the client receives until its socket closes,
+// timing those sent by the load generator
+func (c *loadClient) readAll(received, errorCount *atomic.Int64) {
+	defer close(c.read)
+	for {
+		_, message, err := c.socket.ReadMessage()
+		if err != nil {
+			return
+		}
+		var data struct {
+			Type   string `json:"type"`
+			SentAt int64  `json:"sentAt"`
+		}
+		if json.Unmarshal(message, &data) != nil {
+			continue
+		}
+		switch data.Type {
+		case "dtmf":
+			received.Add(1)
+			c.latencies = append(c.latencies, time.Since(time.Unix(0, data.SentAt)))
+		case "error":
+			errorCount.Add(1)
+		}
+	}
+}
+
+// summarizeLatencies returns percentiles of latencies in milliseconds
+func summarizeLatencies(latencies []time.Duration) loadLatency {
+	if len(latencies) == 0 {
+		return loadLatency{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	at := func(q float64) float64 {
+		return float64(latencies[int(q*float64(len(latencies)-1))]) / float64(time.Millisecond)
+	}
+	return loadLatency{P50: at(0.50), P95: at(0.95), P99: at(0.99), Max: at(1)}
+}
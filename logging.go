@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// logLevel is the active log level, set with -log-level and changed at
+// runtime through POST /admin/loglevel. The per-message lines (every message
+// received, forwarded, broadcast and written) are debug; everything else is
+// logged at info and always shown.
+var logLevel slog.LevelVar
+
+// debugf logs like log.Printf when the debug level is enabled
+func debugf(format string, args ...interface{}) {
+	if logLevel.Level() <= slog.LevelDebug {
+		log.Output(2, fmt.Sprintf(format, args...))
+	}
+}
+
+// parseLogLevel accepts the levels the server distinguishes: debug and info
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil || level != slog.LevelDebug && level != slog.LevelInfo {
+		return 0, fmt.Errorf("log level must be 'debug' or 'info', got %q", name)
+	}
+	return level, nil
+}
+
+// handleLogLevel reports (GET) or changes (POST {"level": "debug"}) the log level
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "body must be JSON with a 'level'", http.StatusBadRequest)
+			return
+		}
+		level, err := parseLogLevel(req.Level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if previous := logLevel.Level(); previous != level {
+			logLevel.Set(level)
+			log.Printf("Log level changed from %s to %s", previous, level)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"level": strings.ToLower(logLevel.Level().String())})
+}
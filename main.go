@@ -1,20 +1,132 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 // Client represents a single WebSocket connection
 type Client struct {
-	Name   string
-	Socket *websocket.Conn
-	Send   chan []byte
-	Room   *Room
+	// currentName and currentRoom are set on the client's own goroutine as
+	// it joins, renames, switches rooms or resumes, and read from fan-out
+	// workers, other clients and admin handlers; see name and room
+	currentName atomic.Pointer[string]
+	currentRoom atomic.Pointer[Room]
+	// Protocol is the protocol version the client reported at join
+	Protocol int
+	// AppVersion is the application version the client reported at join, if any
+	AppVersion string
+	Socket     socketConn
+	Send       chan outbound
+	// Connection metadata captured at upgrade time; it never changes, so any
+	// goroutine may read it
+	UserAgent   string
+	RemoteIP    string
+	ConnectedAt time.Time
+	// Subject is the authenticated user, empty when authentication is off
+	Subject string
+	// adminAuthorized is set when the upgrade request carried the admin token
+	adminAuthorized bool
+	// Hidden keeps the client out of what participants see of the room; see hidden.go
+	Hidden bool
+	// abuse scores anomalous behaviour of the connection
+	abuse abuseScore
+	// targets tracks the distinct targets the client addressed recently
+	targets targetTracker
+	// preJoin holds the messages buffered before the join under -prejoin-policy=buffer
+	preJoin [][]byte
+	// chunks holds the chunked transfers being reassembled, by transfer id
+	chunks map[string]*chunkTransfer
+	// awayQueue holds targeted messages that arrived while the client's slot
+	// was held for resume
+	awayQueue []outbound
+	awayMutex sync.Mutex
+	// Paused holds room traffic for the client in heldQueue, guarded by awayMutex
+	Paused    atomic.Bool
+	heldQueue []outbound
+	// role is the role the client joined with, e.g. rolePublisher
+	role string
+	// stickyRoom is set when the room was mapped from the client's
+	// attributes, which pins the client to it
+	stickyRoom bool
+	// rate limits how fast the client may send messages
+	rate rateBucket
+	// readLimit is the read limit of the client's room, applied by the read goroutine
+	readLimit atomic.Int64
+	// incoming carries messages from the read goroutine; readErr is why it stopped
+	incoming chan []byte
+	readErr  error
+	readOnce sync.Once
+	// leaveSetup gives up the connection's setup slot early; nil when unbounded
+	leaveSetup func()
+	// closing is set once the server started closing the connection; no new
+	// messages are accepted. closeFrame hands the close frame to the writer,
+	// which sets writing while it runs and closes writerDone when it stops.
+	closing    atomic.Bool
+	closeFrame chan []byte
+	writing    atomic.Bool
+	writerDone chan struct{}
+	// Done is closed once the client is cleaned up; Send is never closed so
+	// concurrent fan-out can't panic on a departed client
+	Done chan struct{}
+
+	// backlogSince is when the send queue reached the high-water mark (unix nanos, 0 if below)
+	backlogSince atomic.Int64
+	slowOnce     sync.Once
+
+	// SessionID is the resume token issued to the client, if any
+	SessionID string
+	// replaced is set when a resumed connection takes over this client's slot
+	replaced atomic.Bool
+	// takenOver is set when a new join takes over this client's name, under the room lock
+	takenOver atomic.Bool
+	// Commands carries work that must run on the client's read goroutine
+	Commands chan func()
+
+	// Traffic counts the bytes read from and written to the socket
+	Traffic byteCounters
+	// roomUsageBase is the client's usage when it entered its room, guarded by the room mutex
+	roomUsageBase usage
+}
+
+// name returns the client's current name, empty before it joins
+func (c *Client) name() string {
+	if name := c.currentName.Load(); name != nil {
+		return *name
+	}
+	return ""
+}
+
+// setName changes the client's name. Only the client's own goroutine
+// changes it, under the lock of the room the client is entered in.
+func (c *Client) setName(name string) {
+	c.currentName.Store(&name)
+}
+
+// room returns the client's current room, nil before it joins
+func (c *Client) room() *Room {
+	return c.currentRoom.Load()
+}
+
+// setRoom moves the client to room. Only the client's own goroutine changes
+// it, under the room's lock.
+func (c *Client) setRoom(room *Room) {
+	c.currentRoom.Store(room)
 }
 
 // Room represents a room where clients can join and communicate
@@ -22,278 +134,1134 @@ type Room struct {
 	Name    string
 	Clients map[string]*Client
 	Mutex   sync.Mutex
+	// Host is the name of the client allowed to moderate the room
+	Host string
+	// Locked rejects new joins while set
+	Locked bool
+	// Slots holds client names by slot index; "" marks a free slot
+	Slots []string
+	// ResumeGrace overrides the server-wide resume window when non-zero
+	ResumeGrace time.Duration
+	// MaxClients overrides the server-wide room capacity when non-zero
+	MaxClients int
+	// MaxMessageSize overrides the server-wide read limit when non-zero
+	MaxMessageSize int64
+	// Mode is roomModeMesh or roomModePublishSubscribe; empty means mesh
+	Mode string
+	// Publisher is the publishing client of a publish-subscribe room
+	Publisher string
+	// Topology is topologyAny, topologyTargetedOnly or topologyBroadcastOnly; empty means any
+	Topology string
+	// Features are the room's feature flags, sent to joining clients; see features.go
+	Features map[string]bool
+	// BroadcastRate overrides the server-wide room broadcast budget when non-zero
+	BroadcastRate float64
+	// broadcasts is the room's broadcast budget, guarded by Mutex
+	broadcasts rateBucket
+	// QueueWhenFull makes joins to the full room wait in line instead of failing
+	QueueWhenFull bool
+	// waiting holds the joins queued for a free place, in order
+	waiting []*joinWaiter
+	// CodecPolicy is the operator's codec policy, sent to joining clients
+	CodecPolicy json.RawMessage
+	// Parent is the main room of a breakout room, nil for main rooms
+	Parent *Room
+	// ICEServers overrides the server-wide ICE server list when set
+	ICEServers []iceServer
+	// deleted is set once the room is removed from the store
+	deleted bool
+	// retiredUsage is the traffic of clients that have left the room
+	retiredUsage usage
+	// messageCount counts the messages clients sent in the room
+	messageCount atomic.Int64
+	// Recent chat messages, tracked for read receipts
+	chatSequence int64
+	chats        map[string]*chatRecord
+	chatOrder    []string
+	// offers holds the last unanswered offer per pair, for glare detection
+	offers map[string]offerRecord
+	// bans maps banned identities ("user X", "name X" or "IP Y") to when the ban expires
+	bans map[string]time.Time
+	// advised is set while the room is advised to use a star topology, with advisedRelay as its relay
+	advised      bool
+	advisedRelay string
+	// advisoryMutex orders advisory updates, so the last one sent is the
+	// latest; it is taken before Mutex
+	advisoryMutex sync.Mutex
+	// stateWaiters are the clients waiting for the room state snapshot being
+	// fetched, nil when no fetch is running; guarded by Mutex
+	stateWaiters []*Client
 }
 
 // Server maintains multiple rooms and their clients
 type Server struct {
-	Rooms map[string]*Room
-	Mutex sync.Mutex
+	Rooms RoomStore
+	// Sessions holds the resume tokens of joined clients
+	Sessions *resumeStore
+	// Webhooks mirrors selected events to an HTTP endpoint; nil when disabled
+	Webhooks *webhookPoster
+	// Audit records connection lifecycle events; nil when disabled
+	Audit *auditLog
+	// background owns the server's sweepers and queues for shutdown
+	background *backgroundTasks
+	// Creations limits how many rooms each creator may create
+	Creations *roomCreationLimiter
+	// Aliases redirects old room names to canonical rooms
+	Aliases *roomAliases
+	// Presence tracks presence subscriptions across rooms
+	Presence *presenceHub
+	// Events keeps the recent lifecycle events of each room
+	Events *roomEventStore
+	// Nonces remembers join and resume nonces for replay protection
+	Nonces *nonceCache
+	// userConnections counts open connections per authenticated subject
+	userConnections map[string]int
+	userMutex       sync.Mutex
+	// Draining rejects new connections while existing ones keep running
+	Draining atomic.Bool
+	// connected counts clients past the join, for the connected-clients gauge
+	connected atomic.Int64
+	// setupSlots is a semaphore bounding connections in the pre-join setup phase; nil means unbounded
+	setupSlots chan struct{}
 }
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins; adjust in production
-	},
+	// msgpack is listed first so it wins when a client offers both
+	Subprotocols: []string{subprotocolMsgpack, subprotocolJSON},
+	CheckOrigin:  checkOrigin,
+	Error:        upgradeError,
 }
 
 // Global server instance
 var server = Server{
-	Rooms: make(map[string]*Room),
+	Rooms:    newMemoryRoomStore(),
+	Sessions: newResumeStore(),
+	Nonces:   newNonceCache(),
+	Presence: newPresenceHub(),
+	Aliases:  newRoomAliases(),
+	Events:   newRoomEventStore(),
+
+	Creations: newRoomCreationLimiter(),
+
+	background: newBackgroundTasks(),
+
+	userConnections: make(map[string]int),
+}
+
+// openRoom returns the room clients asked to enter, following room
+// aliases to the canonical room. By default rooms are created on demand;
+// with -no-implicit-rooms only rooms provisioned through
+// PUT /admin/rooms/{name} exist, and others are rejected with 'room-not-found'.
+// Rooms created for a client count against its creator's room creation
+// limit; creator is empty for operator actions, which are not limited.
+func (s *Server) openRoom(roomName, creator string) (*Room, error) {
+	roomName = s.Aliases.resolve(roomName)
+	if !config.NoImplicitRooms {
+		if creator != "" && config.RoomCreationLimit > 0 {
+			if _, exists := s.Rooms.Get(roomName); !exists && !s.Creations.allow(creator, time.Now()) {
+				return nil, &joinError{Code: "room-creation-limited", Message: fmt.Sprintf("too many rooms created, try again within %s", config.RoomCreationWindow)}
+			}
+		}
+		return s.GetOrCreateRoom(roomName), nil
+	}
+	room, exists := s.Rooms.Get(roomName)
+	if !exists {
+		return nil, &joinError{Code: "room-not-found", Message: fmt.Sprintf("room '%s' does not exist", roomName)}
+	}
+	return room, nil
 }
 
 // GetOrCreateRoom finds a room by name or creates a new one
 func (s *Server) GetOrCreateRoom(roomName string) *Room {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-
-	if room, exists := s.Rooms[roomName]; exists {
+	room, created := s.Rooms.GetOrCreate(roomName)
+	if created {
+		log.Printf("Room '%s' created.", roomName)
+		s.Webhooks.emit("room-created", map[string]interface{}{"room": roomName})
+	} else {
 		log.Printf("Room '%s' found. Reusing existing room.", roomName)
-		return room
 	}
-	room := &Room{
-		Name:    roomName,
-		Clients: make(map[string]*Client),
-	}
-	s.Rooms[roomName] = room
-	log.Printf("Room '%s' created.", roomName)
 	return room
 }
 
+// capacity is the maximum number of clients in the room, 0 meaning unlimited
+func (r *Room) capacity() int {
+	if r.MaxClients > 0 {
+		return r.MaxClients
+	}
+	return config.MaxClients
+}
+
 // ClientList returns a list of client names in the room
 func (r *Room) ClientList() []string {
 	r.Mutex.Lock()
 	defer r.Mutex.Unlock()
 	clientNames := make([]string, 0, len(r.Clients))
-	for name := range r.Clients {
-		clientNames = append(clientNames, name)
+	for name, client := range r.Clients {
+		if !client.Hidden {
+			clientNames = append(clientNames, name)
+		}
 	}
 	return clientNames
 }
 
-// Broadcast sends a message to all clients in the room except the sender
-func (r *Room) Broadcast(message []byte, exclude string) {
-	r.Mutex.Lock()
-	defer r.Mutex.Unlock()
+// Broadcast sends a server message to all clients in the room, skipping the
+// client named exclude when hasExclude is set
+func (r *Room) Broadcast(message []byte, exclude string, hasExclude bool) {
+	r.Relay(signMessage(message), exclude, hasExclude)
+}
+
+// Relay is Broadcast for messages carrying client content, which are never signed
+func (r *Room) Relay(message []byte, exclude string, hasExclude bool) {
+	r.broadcastEach(exclude, hasExclude, outbound{}, func(*Client) [][]byte {
+		return [][]byte{message}
+	})
+}
 
+// RelayFrom is Relay for a message from sender, queued with the sender's
+// priority and dropped if still queued for a recipient at expires
+func (r *Room) RelayFrom(sender *Client, message []byte, exclude string, hasExclude bool, expires time.Time) {
+	r.broadcastEach(exclude, hasExclude, sender.relayed(nil, expires), func(*Client) [][]byte {
+		return [][]byte{message}
+	})
+}
+
+// broadcastEach sends every client in the room the messages picked for it,
+// as they are, queued like template; server messages must already be
+// signed. Recipients are snapshotted under the lock and served outside of it.
+func (r *Room) broadcastEach(exclude string, hasExclude bool, template outbound, pick func(*Client) [][]byte) {
+	start := time.Now()
+	defer func() { metrics.ObserveHistogram("signaling_broadcast_seconds", time.Since(start).Seconds()) }()
+	r.Mutex.Lock()
+	recipients := make([]*Client, 0, len(r.Clients))
 	for name, client := range r.Clients {
-		if name != exclude {
-			select {
-			case client.Send <- message:
-				log.Printf("Message broadcasted to '%s' in room '%s'", name, r.Name)
-			default:
-				log.Printf("Send buffer full for client '%s' in room '%s'. Message dropped.", name, r.Name)
+		if !hasExclude || name != exclude {
+			recipients = append(recipients, client)
+		}
+	}
+	r.Mutex.Unlock()
+
+	fanOut(r, recipients, func(client *Client) {
+		for _, message := range pick(client) {
+			queued := template
+			queued.data = message
+			if client.holdIfPaused(queued) {
+				continue
+			}
+			if client.enqueueOutbound(queued) {
+				debugf("Message broadcasted to '%s' in room '%s'", client.name(), r.Name)
+			} else {
+				log.Printf("Send buffer full for client '%s' in room '%s'. Message dropped.", client.name(), r.Name)
+				metrics.IncCounter("signaling_messages_dropped_total", "kind", "broadcast")
 			}
 		}
+	})
+}
+
+// trySend queues a server message for the client without blocking and
+// reports whether it was accepted
+func (c *Client) trySend(message []byte) bool {
+	return c.enqueue(signMessage(message))
+}
+
+// enqueue is trySend for messages that are relayed or already signed
+func (c *Client) enqueue(message []byte) bool {
+	return c.enqueueOutbound(outbound{data: message})
+}
+
+// enqueueOutbound is enqueue for a message that may carry an expiry
+func (c *Client) enqueueOutbound(message outbound) bool {
+	if c.closing.Load() {
+		return false
+	}
+	select {
+	case <-c.Done:
+		return false
+	default:
+	}
+	defer c.checkBacklog()
+	select {
+	case c.Send <- message:
+		return true
+	default:
+		return false
 	}
 }
 
 // RemoveClient removes a client from the room
 func (r *Room) RemoveClient(clientName string) {
 	r.Mutex.Lock()
+	client, exists := r.Clients[clientName]
+	hidden := exists && client.Hidden
+	hostChanged := r.detach(clientName)
+	r.Mutex.Unlock()
+	r.announceLeave(clientName, hostChanged, hidden)
+}
+
+// RemoveClientIfCurrent removes the client only if it still holds its name in
+// the room, so a stale connection can't remove the one that replaced it
+func (r *Room) RemoveClientIfCurrent(client *Client) bool {
+	r.Mutex.Lock()
+	if r.Clients[client.name()] != client {
+		r.Mutex.Unlock()
+		return false
+	}
+	hostChanged := r.detach(client.name())
+	r.Mutex.Unlock()
+	r.announceLeave(client.name(), hostChanged, client.Hidden)
+	return true
+}
+
+// detach drops a client's entry, slot and host role and reports whether the
+// host changed. The caller must hold r.Mutex.
+func (r *Room) detach(clientName string) bool {
+	if client, exists := r.Clients[clientName]; exists {
+		r.retireUsage(client)
+		server.Audit.record("leave", client, r.Name, "")
+	}
 	delete(r.Clients, clientName)
+	r.releaseSlot(clientName)
+	r.forgetOffers(clientName)
 	log.Printf("Client '%s' removed from room '%s'", clientName, r.Name)
-	r.Mutex.Unlock()
-	// Broadcast 'leave' message to others in the room
-	leaveMessage := map[string]interface{}{
-		"type": "leave",
-		"name": clientName,
+	hostChanged := false
+	if r.Host == clientName {
+		r.Host = r.electHost()
+		hostChanged = r.Host != ""
+	}
+	if len(r.Clients) == 0 {
+		// Nobody is left to unlock the room
+		r.Locked = false
+	}
+	return hostChanged
+}
+
+// announceLeave tells the room that a client left; the leave of a hidden
+// client is not announced
+func (r *Room) announceLeave(clientName string, hostChanged, hidden bool) {
+	server.Webhooks.emit("leave", map[string]interface{}{"room": r.Name, "name": clientName})
+	server.Events.record(r.Name, "leave", clientName, "")
+	if !hidden {
+		// Broadcast the departure to others in the room
+		r.broadcastMembership(nil, []string{clientName}, "", false)
+		if hostChanged {
+			r.broadcastHost()
+		}
+		r.broadcastSlots()
+		if r.releasePublisher(clientName) {
+			r.broadcastPublisher()
+		}
+		r.updateAdvisory(nil)
 	}
-	leaveJSON, _ := json.Marshal(leaveMessage)
-	r.Broadcast(leaveJSON, "")
+	r.Mutex.Lock()
+	r.admitWaiting()
+	r.Mutex.Unlock()
 }
 
 // handleWebSocket manages incoming WebSocket connections
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	log.Println("New WebSocket connection attempt")
+	if !checkGeo(w, r) {
+		return
+	}
+	// Bound how many connections can be between upgrade and join at once
+	var leaveSetup func()
+	if server.setupSlots != nil {
+		select {
+		case server.setupSlots <- struct{}{}:
+			leaveSetup = sync.OnceFunc(func() { <-server.setupSlots })
+			defer leaveSetup()
+		default:
+			log.Printf("Shedding connection from %s: %d connections already setting up", clientIP(r), cap(server.setupSlots))
+			metrics.IncCounter("signaling_connections_shed_total")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server is busy, try again", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	span := tracer.Start("websocket.upgrade", r.URL.Query().Get("correlationId"), "client.address", clientIP(r))
 	socket, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Upgrade error:", err)
+		noteUpgradeError(err)
+		span.SetAttribute("error", err.Error())
+		span.End()
+		return
+	}
+	span.End()
+	metrics.IncCounter("signaling_connections_total")
+	serveSocket(socket, r, leaveSetup)
+}
+
+// serveSocket runs an upgraded connection from the join on, for as long as
+// the client needs its request handler. leaveSetup gives up the
+// connection's setup slot and may be nil.
+func serveSocket(socket socketConn, r *http.Request, leaveSetup func()) {
+	socket.SetReadLimit(config.MaxMessageSize)
+	userAgent, remoteIP := r.UserAgent(), clientIP(r)
+	log.Printf("WebSocket connection established from %s (%s)", remoteIP, userAgent)
+
+	if server.Draining.Load() {
+		log.Println("Server is draining. Rejecting new connection.")
+		rejectConnection(socket, websocket.CloseTryAgainLater, "draining", "server is draining, try another instance")
+		return
+	}
+
+	subject, err := authenticate(r)
+	if err != nil {
+		log.Printf("Authentication failed for %s: %v", remoteIP, err)
+		rejectConnection(socket, websocket.ClosePolicyViolation, "unauthorized", err.Error())
+		return
+	}
+	if err := server.acquireUserConnection(subject); err != nil {
+		rejectConnection(socket, websocket.ClosePolicyViolation, "user-connection-limit", err.Error())
 		return
 	}
-	log.Println("WebSocket connection established")
+	// Until readMessages takes over the connection, release it here
+	started := false
+	defer func() {
+		if !started {
+			server.releaseUserConnection(subject)
+		}
+	}()
+
+	// A client may join through the URL query string instead of a 'join' message
+	query := r.URL.Query()
+	queryJoin := query.Has("name") || query.Has("room")
+	joinReq := joinRequest{Name: query.Get("name"), Room: query.Get("room"), Attributes: queryAttributes(query)}
+	joinReq.Protocol, _ = strconv.Atoi(query.Get("protocol"))
+	joinReq.Role = query.Get("role")
+	joinReq.AppVersion = query.Get("appVersion")
+	joinReq.CorrelationID = query.Get("correlationId")
+	if queryJoin {
+		if err := joinReq.validate(); err != nil {
+			log.Println("Invalid query join:", err)
+			rejectConnection(socket, websocket.ClosePolicyViolation, "invalid-join", err.Error())
+			return
+		}
+	}
 
-	// Create the client with empty Name and Room
+	// Create the client without a name or room
 	client := &Client{
-		Name:   "",
 		Socket: socket,
-		Send:   make(chan []byte, 256),
-	}
+		Send:   make(chan outbound, 256),
+		Done:   make(chan struct{}),
 
-	// Start writing messages for the client
-	go client.writeMessages()
+		Commands: make(chan func()),
 
-	// Read initial messages until we get a 'join' message
-	for {
-		_, message, err := socket.ReadMessage()
+		closeFrame: make(chan []byte, 1),
+		writerDone: make(chan struct{}),
+
+		UserAgent:   userAgent,
+		RemoteIP:    remoteIP,
+		ConnectedAt: time.Now(),
+		Subject:     subject,
+
+		adminAuthorized: hasAdminToken(r),
+		leaveSetup:      leaveSetup,
+	}
+	client.handleControlFrames()
+	server.Audit.record("connect", client, "", "")
+	defer func() {
+		if !started {
+			close(client.Done)
+			server.Audit.record("disconnect", client, "", "join-failed")
+		}
+	}()
+
+	if config.Banner != nil {
+		written, err := writeFrame(socket, signMessage(config.Banner))
 		if err != nil {
-			log.Println("ReadMessage error during initial join:", err)
+			log.Println("WriteMessage error while sending banner:", err)
 			socket.Close()
 			return
 		}
-		log.Printf("Initial message received: %s", message)
-		var data map[string]interface{}
-		if err := json.Unmarshal(message, &data); err != nil {
-			log.Println("Invalid message format:", err)
-			continue
-		}
-		messageType, _ := data["type"].(string)
-		if messageType == "join" {
-			nameInterface, nameExists := data["name"]
-			roomInterface, roomExists := data["room"]
-			if !nameExists || !roomExists {
-				log.Println("Invalid join message: missing name or room")
-				continue
-			}
-			name, ok := nameInterface.(string)
-			if !ok {
-				log.Println("Invalid join message: 'name' field is not a string")
-				continue
-			}
-			roomName, ok := roomInterface.(string)
-			if !ok {
-				log.Println("Invalid join message: 'room' field is not a string")
-				continue
-			}
-			log.Printf("Client '%s' is joining room '%s'", name, roomName)
-			client.Name = name
-
-			// Get or create the room and add the client to it
-			room := server.GetOrCreateRoom(roomName)
-			client.Room = room
-
-			room.Mutex.Lock()
-			// Check if a client with the same name already exists in the room
-			if existingClient, exists := room.Clients[client.Name]; exists {
-				log.Printf("Client with name '%s' already exists in room '%s'. Removing existing client.", client.Name, room.Name)
-				existingClient.Socket.Close()
-				delete(room.Clients, client.Name)
-			}
-			room.Clients[client.Name] = client
-			room.Mutex.Unlock()
-			log.Printf("Client '%s' added to room '%s'. Current clients in room: %v", client.Name, room.Name, room.ClientList())
-
-			// Initialize userList as an empty slice
-			userList := make([]string, 0)
-
-			// Send user-list to the new client
-			room.Mutex.Lock()
-			for name := range room.Clients {
-				if name != client.Name {
-					userList = append(userList, name)
-				}
-			}
-			room.Mutex.Unlock()
+		client.Traffic.Written.Add(int64(written))
+	}
 
-			userListMessage := map[string]interface{}{
-				"type":  "user-list",
-				"users": userList,
-			}
-			userListJSON, _ := json.Marshal(userListMessage)
-			client.Send <- userListJSON
-			log.Printf("User list sent to client '%s' in room '%s'", client.Name, room.Name)
-
-			// Broadcast new-user to other clients in the room
-			newUserMessage := map[string]interface{}{
-				"type": "new-user",
-				"name": client.Name,
-			}
-			newUserJSON, _ := json.Marshal(newUserMessage)
-			room.Broadcast(newUserJSON, client.Name)
-			log.Printf("New user '%s' broadcasted in room '%s'", client.Name, room.Name)
+	if queryJoin {
+		log.Printf("Client '%s' joining room '%s' from query parameters", joinReq.Name, joinReq.Room)
+		if err := client.join(joinReq); err != nil {
+			rejectJoin(socket, err)
+			return
+		}
+		started = true
+		metrics.SetGauge("signaling_clients_connected", float64(server.connected.Add(1)))
+		go client.writeMessages()
+		go client.readMessages()
+		return
+	}
 
-			// Now that the client is fully initialized, start reading messages
-			go client.readMessages()
+	// Read initial messages until we get a 'join' or 'resume' message
+	if !client.awaitJoin() {
+		return
+	}
 
-			break // Exit the loop after processing 'join'
-		} else {
-			log.Println("Expected 'join' message, received:", messageType)
+	// Now that the client is fully initialized, start writing and reading messages
+	started = true
+	metrics.SetGauge("signaling_clients_connected", float64(server.connected.Add(1)))
+	go client.writeMessages()
+	go client.readMessages()
+}
+
+// clientIP resolves the address of the remote peer, honoring proxy headers
+// only when the server is configured to trust them
+func clientIP(r *http.Request) string {
+	if config.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return realIP
 		}
 	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// errorMessage builds an 'error' message with a machine-readable code
+func errorMessage(code, message string) []byte {
+	errorJSON, _ := json.Marshal(map[string]interface{}{
+		"type":    "error",
+		"code":    code,
+		"message": message,
+	})
+	return errorJSON
+}
+
+// rejectConnection writes an error directly to a socket that has no writer yet and closes it
+func rejectConnection(socket socketConn, closeCode int, code, message string) {
+	writeRejection(socket, closeCode, map[string]interface{}{
+		"type":          "error",
+		"code":          code,
+		"message":       message,
+		"reconnectable": isReconnectable(code),
+	})
+}
+
+// writeRejection is rejectConnection for a prepared 'error' message
+func writeRejection(socket socketConn, closeCode int, rejection map[string]interface{}) {
+	code, _ := rejection["code"].(string)
+	metrics.IncCounter("signaling_rejections_total", "code", code)
+	rejectionJSON, _ := json.Marshal(rejection)
+	rejectionJSON = signMessage(rejectionJSON)
+	if _, err := writeFrame(socket, rejectionJSON); err != nil {
+		log.Println("WriteMessage error while rejecting connection:", err)
+	}
+	socket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCodeFor(code, closeCode), code), time.Now().Add(time.Second))
+	socket.Close()
+}
+
+// rejectJoin reports a failed join to the client and closes the connection
+func rejectJoin(socket socketConn, err error) {
+	code := joinErrorCode(err)
+	log.Printf("Join rejected (%s): %v", code, err)
+	rejection := map[string]interface{}{
+		"type":          "error",
+		"code":          code,
+		"message":       err.Error(),
+		"reconnectable": isReconnectable(code),
+	}
+	var joinErr *joinError
+	if errors.As(err, &joinErr) && joinErr.RetryAfter > 0 {
+		rejection["retryAfter"] = joinErr.RetryAfter.Seconds()
+	}
+	writeRejection(socket, websocket.ClosePolicyViolation, rejection)
 }
 
 // readMessages listens for incoming messages from the client and routes them
 func (c *Client) readMessages() {
+	// An abnormal drop counts as a permanent leave
+	exit := leaving
+	reason := "connection-lost"
 	defer func() {
-		log.Printf("Client '%s' readMessages exiting", c.Name)
-		c.Room.RemoveClient(c.Name)
+		log.Printf("Client '%s' readMessages exiting", c.name())
+		if c.closing.Load() {
+			// Let writeMessages flush and send the close frame first
+			select {
+			case <-c.writerDone:
+			case <-time.After(config.CloseGrace):
+			}
+		}
 		c.Socket.Close()
-		close(c.Send)
-		log.Printf("Client '%s' has been cleaned up", c.Name)
+		close(c.Done)
+		switch {
+		case c.replaced.Load():
+			reason = "replaced"
+			log.Printf("Client '%s' was replaced by a resumed connection", c.name())
+		case c.takenOver.Load():
+			// The new client already holds the name, so there is nothing to remove or announce
+			reason = "replaced"
+			log.Printf("Client '%s' was replaced by a new connection under its name", c.name())
+			server.Sessions.Drop(c)
+		case exit == leavingTemporarily && c.holdForResume():
+			log.Printf("Client '%s' disconnected. Slot held in room '%s' for resume.", c.name(), c.room().Name)
+		default:
+			c.room().RemoveClientIfCurrent(c)
+			server.Sessions.Drop(c)
+		}
+		server.Presence.unsubscribe(c)
+		metrics.SetGauge("signaling_clients_connected", float64(server.connected.Add(-1)))
+		server.releaseUserConnection(c.Subject)
+		server.Audit.record("disconnect", c, c.room().Name, reason)
+		log.Printf("Client '%s' from %s (%s) disconnected after %s and has been cleaned up", c.name(), c.RemoteIP, c.UserAgent, time.Since(c.ConnectedAt).Round(time.Second))
 	}()
 
+	// Socket reads happen on their own goroutine so this one can also run
+	// commands that change the client's name or room
+	messages := c.startReading()
+
+	// handle routes one message and reports whether the client left with it
+	handle := func(message []byte) bool {
+		if exit = c.handleMessage(message); exit == staying {
+			return false
+		}
+		reason = "left"
+		if exit == leavingTemporarily {
+			reason = "left-temporarily"
+		}
+		c.close(websocket.CloseNormalClosure, reason)
+		return true
+	}
+
+	// Messages buffered before the join come first, in the order they were sent
+	preJoin := c.preJoin
+	c.preJoin = nil
+	for _, message := range preJoin {
+		if handle(message) {
+			return
+		}
+	}
+
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				reason = disconnectReason(c.readErr)
+				return
+			}
+			if handle(message) {
+				return
+			}
+		case command := <-c.Commands:
+			command()
+		}
+	}
+}
+
+// startReading starts the goroutine reading the socket, once, and returns
+// the channel it delivers messages on. The channel is closed, after readErr
+// is set, when reading fails. It buffers readAhead messages so the reader
+// keeps reaching control frames while a burst of messages is handled; only a
+// client that stays further ahead than that has its pings wait, behind its
+// own messages.
+func (c *Client) startReading() <-chan []byte {
+	c.readOnce.Do(func() {
+		c.incoming = make(chan []byte, readAhead)
+		go c.readSocket()
+	})
+	return c.incoming
+}
+
+// readSocket reads messages into c.incoming until the socket fails or the
+// client is cleaned up
+func (c *Client) readSocket() {
+	defer close(c.incoming)
+	applied := config.MaxMessageSize
 	for {
+		// The socket may only be configured from the goroutine reading it
+		if limit := c.readLimit.Load(); limit != applied {
+			c.Socket.SetReadLimit(limit)
+			applied = limit
+		}
 		_, message, err := c.Socket.ReadMessage()
 		if err != nil {
 			log.Println("ReadMessage error:", err)
-			break
+			c.readErr = err
+			return
+		}
+		c.Traffic.Read.Add(int64(len(message)))
+		select {
+		case c.incoming <- message:
+		case <-c.Done:
+			return
+		}
+	}
+}
+
+// departure tells readMessages whether and how a client is leaving
+type departure int
+
+const (
+	staying departure = iota
+	// leaving releases the client's slot and broadcasts 'leave'
+	leaving
+	// leavingTemporarily holds the slot for resume, like the grace period
+	leavingTemporarily
+)
+
+// handleMessage routes one message from a joined client and reports whether
+// the client asked to leave
+func (c *Client) handleMessage(message []byte) departure {
+	debugf("Message received from client '%s' in room '%s': %s", c.name(), c.room().Name, message)
+
+	// Parse the incoming message
+	data, err := decodeFrame(message)
+	if err == errMalformedFrame {
+		log.Printf("Malformed frame from client '%s': %v", c.name(), err)
+		c.suspect("invalid-json")
+		c.trySend(errorMessage("malformed-frame", err.Error()))
+		return staying
+	}
+	if err != nil {
+		log.Println("Invalid message format from client:", err)
+		c.suspect("invalid-json")
+		return staying
+	}
+
+	messageType, _ := data["type"].(string)
+	if _, routed := config.Routes[messageType]; routed {
+		metrics.IncCounter("signaling_messages_total", "type", messageType)
+	} else {
+		// Arbitrary client-chosen types would make the label set unbounded
+		metrics.IncCounter("signaling_messages_total", "type", "other")
+	}
+	if !c.allowMessage(messageType) {
+		c.trySend(errorMessage("rate-limited", "too many messages, slow down"))
+		return staying
+	}
+	c.room().messageCount.Add(1)
+	if code, err := c.room().checkTopology(messageType, data); err != nil {
+		log.Printf("Dropped '%s' from '%s': %v%s", messageType, c.name(), err, correlationTag(data))
+		c.trySend(errorMessage(code, err.Error()))
+		return staying
+	}
+
+	switch config.Routes[messageType] {
+	case routeTargeted:
+		c.forward(messageType, data, message)
+	case routeBroadcast:
+		c.relayToRoom(messageType, data, message)
+	case routeServer:
+		return c.handleServerMessage(messageType, data, message)
+	default:
+		log.Printf("Unknown message type '%s' from client '%s'", messageType, c.name())
+		c.suspect("unknown-type")
+		if config.EchoUnknownTypes {
+			c.trySend(errorMessage("unknown-type", fmt.Sprintf("unknown message type '%s'", messageType)))
 		}
-		log.Printf("Message received from client '%s' in room '%s': %s", c.Name, c.Room.Name, message)
+	}
+	return staying
+}
 
-		// Parse the incoming message
-		var data map[string]interface{}
-		if err := json.Unmarshal(message, &data); err != nil {
-			log.Println("Invalid message format from client:", err)
-			continue
+// handleServerMessage handles the message types the server acts on itself;
+// message is the frame data was decoded from
+func (c *Client) handleServerMessage(messageType string, data map[string]interface{}, message []byte) departure {
+	switch messageType {
+	case "chat":
+		if c.requireFeature(featureChat, messageType) {
+			c.relayChat(data)
+		}
+	case "read-receipt":
+		if !c.requireFeature(featureChat, messageType) {
+			break
+		}
+		if err := c.relayReadReceipt(data); err != nil {
+			log.Printf("Read receipt from '%s' rejected: %v", c.name(), err)
+			c.trySend(errorMessage("unknown-chat", err.Error()))
+		}
+	case "rename":
+		newName, _ := data["name"].(string)
+		if err := c.rename(newName); err != nil {
+			log.Printf("Rename of client '%s' rejected: %v", c.name(), err)
+			c.trySend(errorMessage("rename-rejected", err.Error()))
+		}
+	case "lock-room", "unlock-room":
+		if err := c.setRoomLock(messageType == "lock-room"); err != nil {
+			log.Printf("Client '%s' cannot change lock of room '%s': %v", c.name(), c.room().Name, err)
+			c.trySend(errorMessage("not-host", err.Error()))
+		}
+	case "qos-report":
+		c.relayQoS(data, message)
+	case "whereami":
+		c.sendWhereAmI()
+	case "chunk":
+		return c.receiveChunk(data)
+	case "hold", "unhold":
+		target, _ := data["target"].(string)
+		if err := c.holdPeer(target, messageType == "hold"); err != nil {
+			log.Printf("Client '%s' cannot change hold of '%s': %v", c.name(), target, err)
+			c.trySend(errorMessage("invalid-hold", err.Error()))
+		}
+	case "kick", "ban":
+		target, _ := data["target"].(string)
+		seconds, _ := data["duration"].(float64)
+		byIP, _ := data["ip"].(bool)
+		reason, ban := "kicked", time.Duration(0)
+		if withBan, _ := data["ban"].(bool); messageType == "ban" || withBan {
+			reason, ban = "banned", banDuration(seconds)
+		}
+		if err := c.removePeer(target, reason, ban, byIP); err != nil {
+			log.Printf("Client '%s' cannot %s '%s': %v", c.name(), messageType, target, err)
+			c.trySend(errorMessage("invalid-"+messageType, err.Error()))
+		}
+	case "move-to-breakout", "return-from-breakout":
+		if err := c.requireHost(); err != nil {
+			log.Printf("Client '%s' cannot manage breakout rooms: %v", c.name(), err)
+			c.trySend(errorMessage("not-host", err.Error()))
+			break
 		}
+		names := stringList(data["clients"])
+		if messageType == "move-to-breakout" {
+			breakout, _ := data["breakout"].(string)
+			go c.moveToBreakout(breakout, names)
+		} else {
+			go c.returnFromBreakout(names)
+		}
+	case "subscribe-presence":
+		members, _ := data["members"].(bool)
+		if err := server.Presence.subscribe(c, stringList(data["rooms"]), members); err != nil {
+			c.trySend(errorMessage("invalid-subscription", err.Error()))
+		}
+	case "switch-room":
+		roomName, _ := data["room"].(string)
+		c.suspect("room-switch")
+		if err := c.switchRoom(roomName); err != nil {
+			log.Printf("Client '%s' cannot switch to room '%s': %v", c.name(), roomName, err)
+			c.trySend(errorMessage(joinErrorCode(err), err.Error()))
+		}
+	case "leave":
+		// Handle client leaving. A temporary leave (page navigation, planned
+		// reconnect) keeps the slot for resume; anything else is permanent.
+		if temporary, _ := data["temporary"].(bool); temporary {
+			log.Printf("Client '%s' is leaving room '%s' temporarily", c.name(), c.room().Name)
+			return leavingTemporarily
+		}
+		log.Printf("Client '%s' is leaving room '%s'", c.name(), c.room().Name)
+		return leaving
+	}
+	return staying
+}
 
-		messageType, _ := data["type"].(string)
+// isSignal reports whether messageType is WebRTC signaling the server can validate
+func isSignal(messageType string) bool {
+	return messageType == "offer" || messageType == "answer" || messageType == "candidate"
+}
 
-		switch messageType {
-		case "offer", "answer", "candidate":
-			target, _ := data["target"].(string)
-			if target == "" {
-				log.Println("Message missing 'target' field")
-				continue
+// forward relays a targeted message to a peer in the sender's room
+func (c *Client) forward(messageType string, data map[string]interface{}, message []byte) {
+	target, _ := data["target"].(string)
+	if slot, ok := data["target-slot"].(float64); ok && target == "" {
+		// Positional addressing: resolve the slot to its current holder
+		target = c.room().slotHolder(int(slot))
+	}
+	trace := correlationTag(data)
+	span := tracer.Start("signaling.forward", correlationID(data), "room", c.room().Name, "client", c.name(), "message.type", messageType)
+	outcome := "dropped"
+	defer func() {
+		span.SetAttribute("signal.target", target)
+		span.SetAttribute("signal.outcome", outcome)
+		span.End()
+	}()
+	fanOut := false
+	if c.room().isPublishSubscribe() {
+		var err error
+		if target, fanOut, err = c.room().signalTarget(c.name(), target); err != nil {
+			log.Printf("Dropped '%s' from '%s': %v%s", messageType, c.name(), err, trace)
+			c.trySend(errorMessage("no-publisher", err.Error()))
+			return
+		}
+	}
+	if target == "" && !fanOut {
+		log.Printf("Message of type '%s' from '%s' missing 'target' field%s", messageType, c.name(), trace)
+		return
+	}
+	if !fanOut {
+		c.noteTarget(target)
+	}
+	sealed := isSealed(data)
+	if sealed {
+		if err := validateEnvelope(data, c.room().Name); err != nil {
+			log.Printf("Rejected sealed '%s' from '%s': %v%s", messageType, c.name(), err, trace)
+			c.trySend(errorMessage("bad-envelope", err.Error()))
+			return
+		}
+	}
+	if config.ValidateSDP && !sealed && isSignal(messageType) {
+		if code, err := validateSignal(messageType, data); err != nil {
+			log.Printf("Rejected '%s' from '%s': %v%s", messageType, c.name(), err, trace)
+			c.trySend(errorMessage(code, err.Error()))
+			return
+		}
+	}
+	if fanOut {
+		c.room().RelayFrom(c, message, c.name(), true, messageExpiry(data))
+		outcome = "fanned-out"
+		debugf("Message of type '%s' from publisher '%s' fanned out to room '%s'%s", messageType, c.name(), c.room().Name, trace)
+		return
+	}
+	// Send the message to a specific target within the same room
+	c.room().Mutex.Lock()
+	targetClient, exists := c.room().Clients[target]
+	c.room().Mutex.Unlock()
+	if exists {
+		// Ensure the target client is in the same room
+		if targetClient.room().Name == c.room().Name {
+			if (messageType == "offer" || messageType == "answer") && c.room().noteSignal(messageType, c.name(), target, time.Now()) {
+				message = c.resolveGlare(targetClient, data, message, sealed)
 			}
-			// Send the message to a specific target within the same room
-			c.Room.Mutex.Lock()
-			targetClient, exists := c.Room.Clients[target]
-			c.Room.Mutex.Unlock()
-			if exists {
-				// Ensure the target client is in the same room
-				if targetClient.Room.Name == c.Room.Name {
-					select {
-					case targetClient.Send <- message:
-						log.Printf("Message of type '%s' from '%s' forwarded to '%s' in room '%s'", messageType, c.Name, target, c.Room.Name)
-					default:
-						log.Printf("Send buffer full for client '%s'. Message dropped.", target)
-					}
-				} else {
-					log.Printf("Target client '%s' is not in the same room '%s'", target, c.Room.Name)
-				}
+			if targetClient.deliver(c.relayed(message, messageExpiry(data))) {
+				outcome = "forwarded"
+				debugf("Message of type '%s' from '%s' forwarded to '%s' in room '%s'%s", messageType, c.name(), target, c.room().Name, trace)
 			} else {
-				log.Printf("Target client '%s' not found in room '%s'", target, c.Room.Name)
+				log.Printf("Send buffer full for client '%s'. Message dropped.%s", target, trace)
+				metrics.IncCounter("signaling_messages_dropped_total", "kind", "targeted")
 			}
-		case "leave":
-			// Handle client leaving
-			log.Printf("Client '%s' is leaving room '%s'", c.Name, c.Room.Name)
-			c.Socket.Close()
-			return
-		default:
-			// Unknown message type; ignore or handle as needed
-			log.Printf("Unknown message type '%s' from client '%s'", messageType, c.Name)
+		} else {
+			log.Printf("Target client '%s' is not in the same room '%s'%s", target, c.room().Name, trace)
 		}
+	} else {
+		log.Printf("Target client '%s' not found in room '%s'%s", target, c.room().Name, trace)
+		c.suspect("missing-target")
+	}
+}
+
+// errClientGone is returned when a command targets a client that has disconnected
+var errClientGone = errors.New("client is no longer connected")
+
+// do runs fn on the client's own goroutine and waits for its result, so fn
+// may safely change the client's name or room
+func (c *Client) do(fn func() error) error {
+	result := make(chan error, 1)
+	select {
+	case c.Commands <- func() { result <- fn() }:
+	case <-c.Done:
+		return errClientGone
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-c.Done:
+		return errClientGone
 	}
 }
 
 // writeMessages sends outgoing messages from the client's send channel
 func (c *Client) writeMessages() {
+	c.writing.Store(true)
 	defer func() {
-		log.Printf("Client '%s' writeMessages exiting", c.Name)
+		log.Printf("Client '%s' writeMessages exiting", c.name())
 		c.Socket.Close()
+		close(c.writerDone)
 	}()
-	for message := range c.Send {
-		if err := c.Socket.WriteMessage(websocket.TextMessage, message); err != nil {
-			log.Println("WriteMessage error:", err)
-			break
+	queued := make([]outbound, 0, maxBatchSize)
+	batch := make([][]byte, 0, maxBatchSize)
+
+	// keepalive fires once the connection has been quiet for the interval
+	var keepalive <-chan time.Time
+	var keepaliveTimer *time.Timer
+	if config.KeepaliveInterval > 0 {
+		keepaliveTimer = time.NewTimer(config.KeepaliveInterval)
+		defer keepaliveTimer.Stop()
+		keepalive = keepaliveTimer.C
+	}
+	for {
+		select {
+		case <-keepalive:
+			if err := c.writeBatch([][]byte{signMessage(keepaliveMessage)}); err != nil {
+				log.Println("WriteMessage error:", err)
+				return
+			}
+			keepaliveTimer.Reset(config.KeepaliveInterval)
+		case message := <-c.Send:
+			// Drain whatever else is already queued so it can share the write
+			queued = append(queued[:0], message)
+		drain:
+			for len(queued) < maxBatchSize {
+				select {
+				case message := <-c.Send:
+					queued = append(queued, message)
+				default:
+					break drain
+				}
+			}
+			batch = c.liveBatch(batch[:0], queued, time.Now())
+			if err := c.writeBatch(batch); err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					log.Printf("Client '%s' from %s stopped reading; write timed out after %s. Disconnecting.", c.name(), c.RemoteIP, config.WriteTimeout)
+					metrics.IncCounter("signaling_write_timeouts_total")
+				} else {
+					log.Println("WriteMessage error:", err)
+				}
+				return
+			}
+			c.checkBacklog()
+			if keepaliveTimer != nil {
+				if !keepaliveTimer.Stop() {
+					<-keepaliveTimer.C
+				}
+				keepaliveTimer.Reset(config.KeepaliveInterval)
+			}
+		case closeMessage := <-c.closeFrame:
+			c.flushAndClose(closeMessage)
+			return
+		case <-c.Done:
+			return
+		}
+	}
+}
+
+// keepaliveMessage is sent on quiet connections so proxies see traffic
+var keepaliveMessage = []byte(`{"type":"keepalive"}`)
+
+// writeBatch writes queued messages in order: as one array frame to
+// clients that negotiated batched frames, otherwise one frame per message
+func (c *Client) writeBatch(batch [][]byte) error {
+	if c.Protocol >= protocolBatchedFrames && len(batch) > 1 {
+		frame := make([]byte, 0, 2+len(batch)*128)
+		frame = append(frame, '[')
+		for i, message := range batch {
+			if i > 0 {
+				frame = append(frame, ',')
+			}
+			frame = append(frame, message...)
 		}
-		log.Printf("Message sent to client '%s': %s", c.Name, message)
+		frame = append(frame, ']')
+		written, err := writeFrame(c.Socket, frame)
+		if err != nil {
+			return err
+		}
+		c.Traffic.Written.Add(int64(written))
+		debugf("Batch of %d messages sent to client '%s'", len(batch), c.name())
+		return nil
 	}
+	for _, message := range batch {
+		written, err := writeFrame(c.Socket, message)
+		if err != nil {
+			return err
+		}
+		c.Traffic.Written.Add(int64(written))
+		debugf("Message sent to client '%s': %s", c.name(), message)
+	}
+	return nil
 }
 
 // main initializes the server and routes
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		os.Exit(runLoadTest(os.Args[2:]))
+	}
+	parseFlags()
+	server.startServices()
+	registerHandlers()
+
+	listener, err := listen(config.Addr)
+	if err != nil {
+		log.Fatal("Listen error:", err)
+	}
+	httpServer := &http.Server{}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Println("Shutting down server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Println("Shutdown error:", err)
+		}
+		disconnectAll(shutdownCtx, websocket.CloseGoingAway, "shutdown")
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Println("Background tasks did not stop in time:", err)
+		}
+	}()
+
+	log.Printf("Starting WebSocket server on %s", config.Addr)
+	if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+	log.Println("Server stopped")
+}
+
+// startServices sets up the server state that depends on the configuration
+// and starts its background tasks
+func (s *Server) startServices() {
+	if config.MaxPendingSetups > 0 {
+		s.setupSlots = make(chan struct{}, config.MaxPendingSetups)
+	}
+	if s.Webhooks = newWebhookPoster(config.WebhookURL, config.WebhookEvents); s.Webhooks != nil {
+		s.goBackground("webhooks", s.Webhooks.run)
+	}
+	if s.Audit != nil {
+		s.goBackground("audit-log", s.Audit.sink.run)
+	}
+
+	if exporter, ok := tracer.(*otlpExporter); ok {
+		s.goBackground("trace-export", exporter.run)
+	}
+	s.goBackground("ban-sweeper", func(ctx context.Context) { everyTick(ctx, time.Minute, sweepBans) })
+	s.goBackground("resume-sweeper", func(ctx context.Context) { s.Sessions.sweep(ctx, time.Second) })
+	if config.QoSLogInterval > 0 {
+		qosLog = &qosAggregator{rooms: make(map[string]*qosAggregate)}
+		s.goBackground("qos-log", func(ctx context.Context) { qosLog.run(ctx, config.QoSLogInterval) })
+	}
+	if config.RoomStatsInterval > 0 {
+		s.goBackground("room-stats", func(ctx context.Context) { broadcastRoomStats(ctx, config.RoomStatsInterval) })
+	}
+}
+
+// registerHandlers registers the server's endpoints on the default ServeMux
+func registerHandlers() {
 	http.HandleFunc("/ws", handleWebSocket)
-	log.Println("Starting WebSocket server on :3000")
-	log.Fatal(http.ListenAndServe(":3000", nil))
+	http.HandleFunc("GET /rooms", requireAdmin(withCompression(handleRooms)))
+	http.HandleFunc("GET /rooms/{name}/events", requireAdmin(withCompression(handleRoomEvents)))
+	http.HandleFunc("GET /clients/{name}", requireAdmin(withCompression(handleClient)))
+	http.HandleFunc("/admin/drain", requireAdmin(withCompression(handleDrain)))
+	http.HandleFunc("POST /admin/merge", requireAdmin(withCompression(handleMerge)))
+	http.HandleFunc("POST /admin/revoke-session", requireAdmin(withCompression(handleRevokeSession)))
+	http.HandleFunc("GET /admin/usage", requireAdmin(withCompression(handleUsage)))
+	http.HandleFunc("PUT /admin/rooms/{name}", requireAdmin(withCompression(handleProvisionRoom)))
+	http.HandleFunc("PUT /admin/rooms/{name}/codec-policy", requireAdmin(withCompression(handleCodecPolicy)))
+	http.HandleFunc("GET /admin/loglevel", requireAdmin(withCompression(handleLogLevel)))
+	http.HandleFunc("POST /admin/loglevel", requireAdmin(withCompression(handleLogLevel)))
+	http.HandleFunc("POST /admin/hold", requireAdmin(withCompression(handleHold)))
+	http.HandleFunc("GET /admin/export", requireAdmin(withCompression(handleExport)))
+	http.HandleFunc("POST /admin/import", requireAdmin(withCompression(handleImport)))
+	http.HandleFunc("PUT /admin/aliases/{alias}", requireAdmin(withCompression(handleRoomAlias)))
+	http.HandleFunc("DELETE /admin/aliases/{alias}", requireAdmin(withCompression(handleRoomAlias)))
+	http.HandleFunc("GET /turn-credentials", handleTURNCredentials)
+	http.HandleFunc("GET /{$}", handleLanding)
+	http.HandleFunc("GET /healthz", handleHealth)
+	http.HandleFunc("GET /signing-key", handleSigningKey)
+	if exporter, ok := metrics.(http.Handler); ok {
+		http.Handle("GET /metrics", exporter)
+	}
+}
+
+// listen opens a TCP listener, or a Unix domain socket when addr is
+// "unix:<path>" or a filesystem path. A stale socket file is replaced, and the
+// file is removed again when the listener closes.
+func listen(addr string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if !isUnix && strings.Contains(addr, "/") {
+		path, isUnix = addr, true
+	}
+	if !isUnix {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(true)
+	return listener, nil
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testURL is the WebSocket endpoint of the server every test talks to
+var testURL string
+
+// TestMain starts the server in process, configured like a default run, with
+// metrics tests can read back
+func TestMain(m *testing.M) {
+	parseFlags()
+	metrics = testMetrics{newPrometheusMetrics()}
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	server.startServices()
+	registerHandlers()
+	testServer := httptest.NewServer(http.DefaultServeMux)
+	testURL = "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws"
+	code := m.Run()
+	testServer.Close()
+	os.Exit(code)
+}
+
+// testClient is a WebSocket client of the test server
+type testClient struct {
+	t    testing.TB
+	conn *websocket.Conn
+	// writeMutex serializes writes from the test and its helper goroutines
+	writeMutex sync.Mutex
+}
+
+// dialTest connects a client without joining
+func dialTest(t testing.TB) *testClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(testURL, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	tc := &testClient{t: t, conn: conn}
+	t.Cleanup(func() { conn.Close() })
+	return tc
+}
+
+// joinTest connects a client and joins name to room, waiting for 'joined'
+func joinTest(t testing.TB, room, name string) *testClient {
+	t.Helper()
+	tc := dialTest(t)
+	tc.send(map[string]interface{}{"type": "join", "room": room, "name": name})
+	tc.expect("joined")
+	return tc
+}
+
+// send writes a message, failing the test if it can't
+func (tc *testClient) send(message map[string]interface{}) {
+	tc.t.Helper()
+	data, _ := json.Marshal(message)
+	if err := tc.sendRaw(data); err != nil {
+		tc.t.Fatalf("send: %v", err)
+	}
+}
+
+// sendRaw writes a frame as it is
+func (tc *testClient) sendRaw(data []byte) error {
+	tc.writeMutex.Lock()
+	defer tc.writeMutex.Unlock()
+	return tc.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// read returns the next message as raw bytes
+func (tc *testClient) read(timeout time.Duration) ([]byte, error) {
+	tc.conn.SetReadDeadline(time.Now().Add(timeout))
+	_, data, err := tc.conn.ReadMessage()
+	return data, err
+}
+
+// expectRaw reads until a message of messageType arrives and returns it as
+// received, failing the test after five seconds
+func (tc *testClient) expectRaw(messageType string) []byte {
+	tc.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := tc.read(time.Until(deadline))
+		if err != nil {
+			tc.t.Fatalf("waiting for '%s': %v", messageType, err)
+		}
+		var message map[string]interface{}
+		if json.Unmarshal(data, &message) == nil && message["type"] == messageType {
+			return data
+		}
+	}
+}
+
+// expect is expectRaw for a decoded message
+func (tc *testClient) expect(messageType string) map[string]interface{} {
+	tc.t.Helper()
+	var message map[string]interface{}
+	json.Unmarshal(tc.expectRaw(messageType), &message)
+	return message
+}
+
+// drain reads and discards messages until the connection closes, so the
+// server never blocks on this client
+func (tc *testClient) drain() {
+	go func() {
+		tc.conn.SetReadDeadline(time.Time{})
+		for {
+			if _, _, err := tc.conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// waitFor polls cond until it holds, failing the test after timeout
+func waitFor(t testing.TB, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %s waiting for %s", timeout, what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// roomClients returns a snapshot of the named room's client map
+func roomClients(name string) map[string]*Client {
+	room, exists := server.Rooms.Get(name)
+	if !exists {
+		return nil
+	}
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+	clients := make(map[string]*Client, len(room.Clients))
+	for clientName, client := range room.Clients {
+		clients[clientName] = client
+	}
+	return clients
+}
+
+// recordedCounters are the counters tests read. Other series are dropped:
+// every update takes the registry's lock, which would order the goroutines
+// of busy tests and hide their races from the race detector.
+var recordedCounters = map[string]bool{
+	"signaling_messages_dropped_total":        true,
+	"signaling_write_timeouts_total":          true,
+	"signaling_resume_sessions_evicted_total": true,
+	"signaling_resume_sessions_refused_total": true,
+}
+
+// testMetrics records the counters in recordedCounters
+type testMetrics struct {
+	*prometheusMetrics
+}
+
+func (m testMetrics) IncCounter(name string, tags ...string) {
+	if recordedCounters[name] {
+		m.prometheusMetrics.IncCounter(name, tags...)
+	}
+}
+
+func (testMetrics) SetGauge(string, float64, ...string)         {}
+func (testMetrics) ObserveHistogram(string, float64, ...string) {}
+
+// counterValue reads a counter from the test server's metrics
+func counterValue(name string, tags ...string) float64 {
+	registry := metrics.(testMetrics).prometheusMetrics
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.counters[name][labels(tags)]
+}
+
+// TestDropOnFullSendQueue stalls a client's writer until its send queue is
+// full, then checks that targeted and broadcast messages to it are dropped
+// and counted without holding up the sender or the room
+func TestDropOnFullSendQueue(t *testing.T) {
+	room := t.Name()
+	alice := joinFake(t, room, "alice")
+	bob := joinFake(t, room, "bob")
+	alice.expect("new-user")
+	bobClient := roomClients(room)["bob"]
+
+	// Once the writer blocks on a batch, nothing drains the queue
+	bob.stall()
+	defer bob.unstall()
+	offer := func(sdp string) {
+		alice.feed(map[string]interface{}{"type": "offer", "target": "bob", "sdp": sdp})
+	}
+	offer("blocked")
+	waitFor(t, 5*time.Second, "bob's writer to block", func() bool { return bob.blockedWrites() > 0 })
+	for i := 0; i < cap(bobClient.Send); i++ {
+		offer(fmt.Sprint(i))
+	}
+	waitFor(t, 5*time.Second, "bob's send queue to fill", func() bool { return len(bobClient.Send) == cap(bobClient.Send) })
+
+	targeted := counterValue("signaling_messages_dropped_total", "kind", "targeted")
+	offer("dropped")
+	waitFor(t, 5*time.Second, "the offer to be dropped", func() bool {
+		return counterValue("signaling_messages_dropped_total", "kind", "targeted") > targeted
+	})
+
+	broadcast := counterValue("signaling_messages_dropped_total", "kind", "broadcast")
+	r, _ := server.Rooms.Get(room)
+	returned := make(chan struct{})
+	go func() {
+		r.Broadcast([]byte(`{"type":"notice"}`), "", false)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("broadcast blocked on the full queue")
+	}
+	waitFor(t, 5*time.Second, "the broadcast to bob to be dropped", func() bool {
+		return counterValue("signaling_messages_dropped_total", "kind", "broadcast") > broadcast
+	})
+	alice.expect("notice")
+
+	// Alice is still served while bob is stuck
+	alice.feed(map[string]interface{}{"type": "whereami"})
+	alice.expect("whereami")
+}
+
+// TestWriteTimeoutDisconnects connects a peer that never reads and checks
+// that the first timed-out write tears its connection down and removes it
+// from the room within a bounded time
+func TestWriteTimeoutDisconnects(t *testing.T) {
+	room := t.Name()
+	alice := joinFake(t, room, "alice")
+	bob := joinFake(t, room, "bob")
+	alice.expect("new-user")
+
+	bob.limitDeadlines(50 * time.Millisecond)
+	bob.stall()
+	timeouts := counterValue("signaling_write_timeouts_total")
+	alice.feed(map[string]interface{}{"type": "offer", "target": "bob", "sdp": "v=0"})
+	waitFor(t, 5*time.Second, "bob's writer to block", func() bool { return bob.blockedWrites() > 0 })
+	blocked := time.Now()
+
+	if leave := alice.expect("leave"); leave["name"] != "bob" {
+		t.Fatalf("alice got %v, want bob's leave", leave)
+	}
+	if elapsed := time.Since(blocked); elapsed > 2*time.Second {
+		t.Fatalf("bob was removed %s after his write blocked, want well within 2s", elapsed)
+	}
+	if !bob.isClosed() {
+		t.Fatal("bob's socket is still open after the write timed out")
+	}
+	if _, exists := roomClients(room)["bob"]; exists {
+		t.Fatal("bob is still in the room after the write timed out")
+	}
+	if counterValue("signaling_write_timeouts_total") != timeouts+1 {
+		t.Fatal("the write timeout was not counted")
+	}
+}
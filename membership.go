@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// Protocol versions a client can report at join. Version 1 is the original
+// protocol; from version 2 on, membership changes arrive as a single
+// 'membership-delta' event instead of 'new-user' and 'leave'. From version 3
+// on, messages queued together may arrive as one frame holding a JSON array,
+// and from version 4 on crossing offers carry a 'polite' hint (see glare.go).
+const (
+	protocolLegacy          = 1
+	protocolMembershipDelta = 2
+	protocolBatchedFrames   = 3
+	protocolGlareHints      = 4
+)
+
+// maxBatchSize caps how many queued messages are coalesced into one frame
+const maxBatchSize = 64
+
+// normalizeProtocol maps a missing or invalid version to the legacy protocol
+func normalizeProtocol(version int) int {
+	if version < protocolLegacy {
+		return protocolLegacy
+	}
+	return version
+}
+
+// broadcastMembership announces clients entering or leaving the room, as
+// 'membership-delta' to clients that speak it and as the legacy
+// 'new-user'/'leave' events to everyone else
+func (r *Room) broadcastMembership(added, removed []string, exclude string, hasExclude bool) {
+	delta := map[string]interface{}{
+		"type":    "membership-delta",
+		"added":   nonNil(added),
+		"removed": nonNil(removed),
+	}
+	if config.PeerColors {
+		delta["appearance"] = appearancesOf(added)
+	}
+	versions := r.versionsOf(added)
+	if len(added) > 0 {
+		delta["versions"] = versions
+	}
+	deltaJSON, _ := json.Marshal(delta)
+	legacy := make([][]byte, 0, len(added)+len(removed))
+	for _, name := range added {
+		newUser := map[string]interface{}{"type": "new-user", "name": name}
+		if version, known := versions[name]; known {
+			newUser["protocol"] = version.Protocol
+			if version.AppVersion != "" {
+				newUser["appVersion"] = version.AppVersion
+			}
+		}
+		if config.PeerColors {
+			look := appearanceOf(name)
+			newUser["color"] = look.Color
+			newUser["avatarSeed"] = look.AvatarSeed
+		}
+		newUserJSON, _ := json.Marshal(newUser)
+		legacy = append(legacy, newUserJSON)
+	}
+	for _, name := range removed {
+		leaveJSON, _ := json.Marshal(map[string]interface{}{"type": "leave", "name": name})
+		legacy = append(legacy, leaveJSON)
+	}
+
+	deltaJSON = signMessage(deltaJSON)
+	for i := range legacy {
+		legacy[i] = signMessage(legacy[i])
+	}
+	r.broadcastEach(exclude, hasExclude, outbound{}, func(client *Client) [][]byte {
+		if client.Protocol >= protocolMembershipDelta {
+			return [][]byte{deltaJSON}
+		}
+		return legacy
+	})
+	log.Printf("Membership change broadcasted in room '%s': added %v, removed %v", r.Name, added, removed)
+	server.Presence.notify(r.Name)
+}
+
+// nonNil turns a nil slice into an empty one so it encodes as []
+func nonNil(names []string) []string {
+	if names == nil {
+		return []string{}
+	}
+	return names
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics receives the server's instrumentation. Tags are alternating
+// key/value pairs. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// IncCounter adds one to a counter
+	IncCounter(name string, tags ...string)
+	// SetGauge records the current value of a gauge
+	SetGauge(name string, value float64, tags ...string)
+	// ObserveHistogram records one sample, e.g. a duration in seconds
+	ObserveHistogram(name string, value float64, tags ...string)
+}
+
+// metrics is the implementation chosen at startup with -metrics
+var metrics Metrics = noopMetrics{}
+
+// newMetrics returns the Metrics implementation named by -metrics
+func newMetrics(kind string) (Metrics, error) {
+	switch kind {
+	case "", "none":
+		return noopMetrics{}, nil
+	case "prometheus":
+		return newPrometheusMetrics(), nil
+	}
+	return nil, fmt.Errorf("unknown metrics implementation '%s'", kind)
+}
+
+// noopMetrics discards everything
+type noopMetrics struct{}
+
+func (noopMetrics) IncCounter(string, ...string)                {}
+func (noopMetrics) SetGauge(string, float64, ...string)         {}
+func (noopMetrics) ObserveHistogram(string, float64, ...string) {}
+
+// histogramBuckets are the upper bounds of every Prometheus histogram, in seconds
+var histogramBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// histogram is one labelled Prometheus histogram series
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// prometheusMetrics keeps series in memory and serves them in the Prometheus
+// text exposition format on /metrics
+type prometheusMetrics struct {
+	mutex      sync.Mutex
+	counters   map[string]map[string]float64
+	gauges     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+func newPrometheusMetrics() *prometheusMetrics {
+	return &prometheusMetrics{
+		counters:   make(map[string]map[string]float64),
+		gauges:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// labels renders tags as a Prometheus label set, sorted by key
+func labels(tags []string) string {
+	pairs := make([]string, 0, len(tags)/2)
+	for i := 0; i+1 < len(tags); i += 2 {
+		pairs = append(pairs, tags[i]+"="+strconv.Quote(tags[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (p *prometheusMetrics) IncCounter(name string, tags ...string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.counters[name] == nil {
+		p.counters[name] = make(map[string]float64)
+	}
+	p.counters[name][labels(tags)]++
+}
+
+func (p *prometheusMetrics) SetGauge(name string, value float64, tags ...string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.gauges[name] == nil {
+		p.gauges[name] = make(map[string]float64)
+	}
+	p.gauges[name][labels(tags)] = value
+}
+
+func (p *prometheusMetrics) ObserveHistogram(name string, value float64, tags ...string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.histograms[name] == nil {
+		p.histograms[name] = make(map[string]*histogram)
+	}
+	key := labels(tags)
+	h := p.histograms[name][key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(histogramBuckets))}
+		p.histograms[name][key] = h
+	}
+	for i, bound := range histogramBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// ServeHTTP writes every series in the text exposition format
+func (p *prometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeSeries(w, "counter", p.counters)
+	writeSeries(w, "gauge", p.gauges)
+	for _, name := range sortedKeys(p.histograms) {
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		for _, key := range sortedKeys(p.histograms[name]) {
+			h := p.histograms[name][key]
+			for i, bound := range histogramBuckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(key, "le", strconv.FormatFloat(bound, 'g', -1, 64)), h.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(key, "le", "+Inf"), h.count)
+			fmt.Fprintf(w, "%s_sum%s %g\n", name, key, h.sum)
+			fmt.Fprintf(w, "%s_count%s %d\n", name, key, h.count)
+		}
+	}
+}
+
+// writeSeries writes the counters or gauges of every name
+func writeSeries(w http.ResponseWriter, kind string, series map[string]map[string]float64) {
+	for _, name := range sortedKeys(series) {
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		for _, key := range sortedKeys(series[name]) {
+			fmt.Fprintf(w, "%s%s %g\n", name, key, series[name][key])
+		}
+	}
+}
+
+// withLabel adds one label to a rendered label set
+func withLabel(set, key, value string) string {
+	label := key + "=" + strconv.Quote(value)
+	if set == "" {
+		return "{" + label + "}"
+	}
+	return set[:len(set)-1] + "," + label + "}"
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbReader looks up addresses in a MaxMind DB file (.mmdb), the format of
+// the GeoIP2 and GeoLite2 databases. The file is read into memory whole.
+// See https://maxmind.github.io/MaxMind-DB/ for the format.
+type mmdbReader struct {
+	buffer     []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// dataStart and dataEnd delimit the data section, between the search
+	// tree and the metadata
+	dataStart, dataEnd uint
+	// ipv4Start is the node of ::/96, where IPv4 lookups in an IPv6 tree begin
+	ipv4Start uint
+}
+
+// mmdbMetadataMarker precedes the metadata map at the end of the file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// errMMDBCorrupt is returned for files that don't parse as a MaxMind DB
+var errMMDBCorrupt = errors.New("invalid MaxMind DB file")
+
+// openMMDB reads and validates the MaxMind DB at path
+func openMMDB(path string) (*mmdbReader, error) {
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	at := bytes.LastIndex(buffer, mmdbMetadataMarker)
+	if at < 0 {
+		return nil, fmt.Errorf("%s: no MaxMind DB metadata found", path)
+	}
+	metadataStart := uint(at + len(mmdbMetadataMarker))
+	decoder := mmdbDecoder{buffer: buffer[metadataStart:]}
+	value, _, err := decoder.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", path, errMMDBCorrupt)
+	}
+	nodeCount, _ := metadata["node_count"].(uint64)
+	recordSize, _ := metadata["record_size"].(uint64)
+	ipVersion, _ := metadata["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, recordSize)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("%s: unsupported IP version %d", path, ipVersion)
+	}
+	reader := &mmdbReader{
+		buffer:     buffer,
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+		dataEnd:    uint(at),
+	}
+	// The data section follows the tree and 16 zero bytes
+	reader.dataStart = reader.nodeCount*reader.recordSize/4 + 16
+	if reader.dataStart > reader.dataEnd {
+		return nil, fmt.Errorf("%s: %w", path, errMMDBCorrupt)
+	}
+	if reader.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < reader.nodeCount; i++ {
+			node = reader.record(node, 0)
+		}
+		reader.ipv4Start = node
+	}
+	return reader, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a tree node
+func (m *mmdbReader) record(node, bit uint) uint {
+	b := m.buffer[node*m.recordSize/4:]
+	switch m.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record for ip, or nil when the database has none
+func (m *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	address, node := ip.To4(), uint(0)
+	if address != nil && m.ipVersion == 6 {
+		node = m.ipv4Start
+	} else if address == nil {
+		if m.ipVersion == 4 {
+			return nil, nil
+		}
+		address = ip.To16()
+	}
+	for i := 0; i < len(address)*8 && node < m.nodeCount; i++ {
+		bit := uint(address[i/8]>>(7-i%8)) & 1
+		node = m.record(node, bit)
+	}
+	if node == m.nodeCount {
+		return nil, nil
+	}
+	if node < m.nodeCount {
+		return nil, errMMDBCorrupt
+	}
+	offset := node - m.nodeCount - 16
+	if m.dataStart+offset >= m.dataEnd {
+		return nil, errMMDBCorrupt
+	}
+	decoder := mmdbDecoder{buffer: m.buffer[m.dataStart:m.dataEnd]}
+	value, _, err := decoder.decode(offset)
+	return value, err
+}
+
+// mmdbDecoder decodes values of a MaxMind DB data section, in which
+// pointers are offsets from the start of buffer
+type mmdbDecoder struct {
+	buffer []byte
+	// values is how many more values the current decode may visit
+	values int
+}
+
+// mmdbMaxDepth bounds how deeply maps and arrays nest, so a file whose
+// pointers make a map or array contain itself fails instead of recursing
+// without end
+const mmdbMaxDepth = 32
+
+// mmdbMaxValues bounds the values one decode visits. Pointers let a small
+// file reference the same map many times over, which the depth alone
+// doesn't bound.
+const mmdbMaxValues = 1 << 16
+
+// MaxMind DB data types
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// decode decodes the value at offset and returns it with the offset after it.
+// Unsigned integers decode to uint64, int32 to int64, and uint128 to []byte.
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	d.values = mmdbMaxValues
+	return d.decodeAt(offset, 0)
+}
+
+// decodeAt is decode for a value nested depth maps and arrays deep
+func (d *mmdbDecoder) decodeAt(offset, depth uint) (interface{}, uint, error) {
+	if d.values--; d.values < 0 {
+		return nil, 0, fmt.Errorf("%w: more than %d values in one record", errMMDBCorrupt, mmdbMaxValues)
+	}
+	kind, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if kind == mmdbPointer {
+		target, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		// The format doesn't allow a pointer to a pointer
+		if targetKind, _, _, err := d.control(target); err != nil {
+			return nil, 0, err
+		} else if targetKind == mmdbPointer {
+			return nil, 0, fmt.Errorf("%w: pointer to a pointer", errMMDBCorrupt)
+		}
+		value, _, err := d.decodeAt(target, depth)
+		return value, next, err
+	}
+	if kind == mmdbMap || kind == mmdbArray {
+		if depth >= mmdbMaxDepth {
+			return nil, 0, fmt.Errorf("%w: data nested more than %d levels deep", errMMDBCorrupt, mmdbMaxDepth)
+		}
+		// Every entry takes at least a byte, so a larger size can't be real
+		if size > uint(len(d.buffer))-offset {
+			return nil, 0, errMMDBCorrupt
+		}
+	}
+	switch kind {
+	case mmdbMap:
+		value := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			if value[name], offset, err = d.decodeAt(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return value, offset, nil
+	case mmdbArray:
+		value := make([]interface{}, size)
+		for i := range value {
+			if value[i], offset, err = d.decodeAt(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return value, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(d.buffer)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	payload, next := d.buffer[offset:offset+size], offset+size
+	switch kind {
+	case mmdbString:
+		return string(payload), next, nil
+	case mmdbBytes, mmdbUint128:
+		return append([]byte(nil), payload...), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(payload))), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		var value uint64
+		for _, b := range payload {
+			value = value<<8 | uint64(b)
+		}
+		return value, next, nil
+	case mmdbInt32:
+		var value uint32
+		for _, b := range payload {
+			value = value<<8 | uint32(b)
+		}
+		return int64(int32(value)), next, nil
+	}
+	return nil, 0, fmt.Errorf("%w: unexpected data type %d", errMMDBCorrupt, kind)
+}
+
+// control reads the control byte at offset and returns the type and size of
+// the value it introduces and the offset of the value's payload. The size of
+// a pointer is its raw control bits.
+func (d *mmdbDecoder) control(offset uint) (kind, size, next uint, err error) {
+	if offset >= uint(len(d.buffer)) {
+		return 0, 0, 0, errMMDBCorrupt
+	}
+	control := d.buffer[offset]
+	offset++
+	kind = uint(control >> 5)
+	if kind == mmdbPointer {
+		return kind, uint(control & 0x1f), offset, nil
+	}
+	if kind == mmdbExtended {
+		if offset >= uint(len(d.buffer)) {
+			return 0, 0, 0, errMMDBCorrupt
+		}
+		kind = 7 + uint(d.buffer[offset])
+		offset++
+	}
+	size = uint(control & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > uint(len(d.buffer)) {
+			return 0, 0, 0, errMMDBCorrupt
+		}
+		var value uint
+		for _, b := range d.buffer[offset : offset+extra] {
+			value = value<<8 | uint(b)
+		}
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + value
+		case 2:
+			size = 285 + value
+		default:
+			size = 65821 + value
+		}
+	}
+	return kind, size, offset, nil
+}
+
+// pointer resolves a pointer whose control bits are bits and whose payload
+// starts at offset; it returns the target and the offset after the pointer
+func (d *mmdbDecoder) pointer(bits, offset uint) (uint, uint, error) {
+	length := bits>>3 + 1
+	if offset+length > uint(len(d.buffer)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	var value uint
+	for _, b := range d.buffer[offset : offset+length] {
+		value = value<<8 | uint(b)
+	}
+	switch length {
+	case 1:
+		value = (bits&0x7)<<8 | value
+	case 2:
+		value = ((bits&0x7)<<16 | value) + 2048
+	case 3:
+		value = ((bits&0x7)<<24 | value) + 526336
+	}
+	return value, offset + length, nil
+}
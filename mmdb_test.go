@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// mmdbPointerTo encodes as a pointer to an offset in the data section
+type mmdbPointerTo uint
+
+// mmdbBuilder writes small MaxMind DB files for tests
+type mmdbBuilder struct {
+	data     []byte
+	networks []mmdbNetwork
+}
+
+// mmdbNetwork maps a network to the offset of its record in the data section
+type mmdbNetwork struct {
+	network *net.IPNet
+	offset  uint
+}
+
+// mmdbControl encodes the control byte, and any extended type and size
+// bytes, of a value of kind with size
+func mmdbControl(kind, size uint) []byte {
+	var sizeBits byte
+	var extra []byte
+	switch {
+	case size < 29:
+		sizeBits = byte(size)
+	case size < 285:
+		sizeBits, extra = 29, []byte{byte(size - 29)}
+	case size < 65821:
+		sizeBits, extra = 30, binary.BigEndian.AppendUint16(nil, uint16(size-285))
+	default:
+		sizeBits, extra = 31, binary.BigEndian.AppendUint32(nil, uint32(size-65821))[1:]
+	}
+	if kind <= 7 {
+		return append([]byte{byte(kind)<<5 | sizeBits}, extra...)
+	}
+	return append([]byte{sizeBits, byte(kind - 7)}, extra...)
+}
+
+// mmdbEncode encodes a string, uint64, bool, map, array or pointer
+func mmdbEncode(value interface{}) []byte {
+	switch value := value.(type) {
+	case string:
+		return append(mmdbControl(mmdbString, uint(len(value))), value...)
+	case uint64:
+		payload := binary.BigEndian.AppendUint64(nil, value)
+		for len(payload) > 0 && payload[0] == 0 {
+			payload = payload[1:]
+		}
+		return append(mmdbControl(mmdbUint64, uint(len(payload))), payload...)
+	case bool:
+		size := uint(0)
+		if value {
+			size = 1
+		}
+		return mmdbControl(mmdbBool, size)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		encoded := mmdbControl(mmdbMap, uint(len(value)))
+		for _, key := range keys {
+			encoded = append(encoded, mmdbEncode(key)...)
+			encoded = append(encoded, mmdbEncode(value[key])...)
+		}
+		return encoded
+	case []interface{}:
+		encoded := mmdbControl(mmdbArray, uint(len(value)))
+		for _, element := range value {
+			encoded = append(encoded, mmdbEncode(element)...)
+		}
+		return encoded
+	case mmdbPointerTo:
+		// Only the 11-bit form, which is all these small files need
+		return []byte{mmdbPointer<<5 | byte(value>>8&0x7), byte(value)}
+	}
+	panic("mmdbEncode: unsupported value")
+}
+
+// add appends value to the data section and returns its offset
+func (b *mmdbBuilder) add(value interface{}) uint {
+	return b.addRaw(mmdbEncode(value))
+}
+
+// addRaw appends encoded data, valid or not, and returns its offset
+func (b *mmdbBuilder) addRaw(encoded []byte) uint {
+	offset := uint(len(b.data))
+	b.data = append(b.data, encoded...)
+	return offset
+}
+
+// insert maps the network in CIDR notation to the record at offset
+func (b *mmdbBuilder) insert(cidr string, offset uint) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	b.networks = append(b.networks, mmdbNetwork{network, offset})
+}
+
+// write builds the search tree and writes the database to a temporary
+// file, returning its path. In an IPv6 database IPv4 networks go under
+// ::/96, as in MaxMind's own files.
+func (b *mmdbBuilder) write(t *testing.T, recordSize, ipVersion uint) string {
+	t.Helper()
+	// Each node is a pair of records: a node index, or ^uint(0) for no
+	// data, or a data offset marked with dataRecord
+	const empty, dataRecord = ^uint(0), uint(1) << 40
+	nodes := [][2]uint{{empty, empty}}
+	for _, network := range b.networks {
+		address, prefix := network.network.IP.To4(), 0
+		ones, _ := network.network.Mask.Size()
+		if address == nil || ipVersion == 6 {
+			if address != nil {
+				prefix = 96
+			}
+			address = network.network.IP.To16()
+		}
+		if address == nil || len(address) == 16 && ipVersion == 4 {
+			t.Fatalf("network %s doesn't fit an IPv%d database", network.network, ipVersion)
+		}
+		bits := prefix + ones
+		node := 0
+		for i := 0; i < bits; i++ {
+			bit := 0
+			if i >= prefix {
+				bit = int(address[i/8]>>(7-i%8)) & 1
+			}
+			if i == bits-1 {
+				nodes[node][bit] = dataRecord | network.offset
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]uint{empty, empty})
+				nodes[node][bit] = uint(len(nodes) - 1)
+			}
+			node = int(nodes[node][bit])
+		}
+	}
+
+	nodeCount := uint(len(nodes))
+	value := func(record uint) uint {
+		switch {
+		case record == empty:
+			return nodeCount
+		case record&dataRecord != 0:
+			return nodeCount + 16 + record&^dataRecord
+		}
+		return record
+	}
+	var file []byte
+	for _, node := range nodes {
+		left, right := value(node[0]), value(node[1])
+		switch recordSize {
+		case 24:
+			file = append(file, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			file = append(file, byte(left>>16), byte(left>>8), byte(left), byte(left>>24<<4|right>>24&0xf), byte(right>>16), byte(right>>8), byte(right))
+		default:
+			file = binary.BigEndian.AppendUint32(file, uint32(left))
+			file = binary.BigEndian.AppendUint32(file, uint32(right))
+		}
+	}
+	file = append(file, make([]byte, 16)...)
+	file = append(file, b.data...)
+	file = append(file, mmdbMetadataMarker...)
+	file = append(file, mmdbEncode(map[string]interface{}{
+		"node_count":                  uint64(nodeCount),
+		"record_size":                 uint64(recordSize),
+		"ip_version":                  uint64(ipVersion),
+		"database_type":               "Test-Country",
+		"binary_format_major_version": uint64(2),
+	})...)
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// countryDB writes a database of DE at 1.2.3.0/24 and, through a pointer to
+// a shared record, a US registered country at 8.8.8.0/24; an IPv6 database
+// also has FR at 2001:db8::/32
+func countryDB(t *testing.T, recordSize, ipVersion uint) *mmdbReader {
+	t.Helper()
+	var b mmdbBuilder
+	b.insert("1.2.3.0/24", b.add(map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "DE", "names": map[string]interface{}{"en": "Germany"}},
+	}))
+	unitedStates := b.add(map[string]interface{}{"iso_code": "US"})
+	b.insert("8.8.8.0/24", b.add(map[string]interface{}{"registered_country": mmdbPointerTo(unitedStates)}))
+	if ipVersion == 6 {
+		b.insert("2001:db8::/32", b.add(map[string]interface{}{"country": map[string]interface{}{"iso_code": "FR"}}))
+	}
+	db, err := openMMDB(b.write(t, recordSize, ipVersion))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return db
+}
+
+func TestMMDBLookup(t *testing.T) {
+	for _, recordSize := range []uint{24, 28, 32} {
+		for _, ipVersion := range []uint{4, 6} {
+			db := countryDB(t, recordSize, ipVersion)
+			filter := &countryFilter{db: db}
+			tests := []struct {
+				ip   string
+				want string
+			}{
+				{"1.2.3.4", "DE"},
+				{"1.2.3.255", "DE"},
+				{"1.2.4.1", ""},
+				{"8.8.8.8", "US"},
+				{"9.9.9.9", ""},
+				{"2001:db8::1", map[uint]string{4: "", 6: "FR"}[ipVersion]},
+				{"2001:db9::1", ""},
+			}
+			for _, test := range tests {
+				country, err := filter.country(net.ParseIP(test.ip))
+				if err != nil {
+					t.Errorf("%d-bit IPv%d database: lookup of %s: %v", recordSize, ipVersion, test.ip, err)
+					continue
+				}
+				if country != test.want {
+					t.Errorf("%d-bit IPv%d database: %s is in %q, want %q", recordSize, ipVersion, test.ip, country, test.want)
+				}
+			}
+		}
+	}
+}
+
+func TestMMDBRecord28(t *testing.T) {
+	// node 0 holds 0x0abcdef on the left and 0x5123456 on the right; the
+	// middle byte carries the high nibble of each
+	db := &mmdbReader{buffer: []byte{0xab, 0xcd, 0xef, 0x05, 0x12, 0x34, 0x56}, recordSize: 28}
+	if left := db.record(0, 0); left != 0x0abcdef {
+		t.Errorf("left record %#x, want 0xabcdef", left)
+	}
+	if right := db.record(0, 1); right != 0x5123456 {
+		t.Errorf("right record %#x, want 0x5123456", right)
+	}
+}
+
+func TestMMDBCorrupt(t *testing.T) {
+	nested := interface{}(map[string]interface{}{"iso_code": "DE"})
+	for i := 0; i <= mmdbMaxDepth; i++ {
+		nested = []interface{}{nested}
+	}
+	tests := []struct {
+		name string
+		// record appends the record the test network maps to and returns its offset
+		record func(b *mmdbBuilder) uint
+		want   string
+	}{
+		{
+			name: "pointer to a pointer",
+			record: func(b *mmdbBuilder) uint {
+				target := b.add(map[string]interface{}{"iso_code": "DE"})
+				pointer := b.add(mmdbPointerTo(target))
+				return b.add(map[string]interface{}{"country": mmdbPointerTo(pointer)})
+			},
+			want: "pointer to a pointer",
+		},
+		{
+			name: "map containing itself",
+			record: func(b *mmdbBuilder) uint {
+				// A one-entry map whose value points back at the map
+				offset := uint(len(b.data))
+				b.addRaw(mmdbControl(mmdbMap, 1))
+				b.addRaw(mmdbEncode("country"))
+				b.addRaw(mmdbEncode(mmdbPointerTo(offset)))
+				return offset
+			},
+			want: "nested",
+		},
+		{
+			name: "pointers fanning out",
+			record: func(b *mmdbBuilder) uint {
+				// Arrays of two pointers to the array below, within the
+				// depth bound but doubling the values to visit at each level
+				offset := b.add("DE")
+				for i := 0; i < 20; i++ {
+					offset = b.add([]interface{}{mmdbPointerTo(offset), mmdbPointerTo(offset)})
+				}
+				return offset
+			},
+			want: "values",
+		},
+		{
+			name:   "nested too deep",
+			record: func(b *mmdbBuilder) uint { return b.add(nested) },
+			want:   "nested",
+		},
+		{
+			name:   "array larger than the file",
+			record: func(b *mmdbBuilder) uint { return b.addRaw(mmdbControl(mmdbArray, 1<<20)) },
+			want:   "invalid MaxMind DB",
+		},
+		{
+			name: "truncated string",
+			record: func(b *mmdbBuilder) uint {
+				encoded := mmdbEncode(map[string]interface{}{"country": "Germany"})
+				return b.addRaw(encoded[:len(encoded)-3])
+			},
+			want: "invalid MaxMind DB",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, recordSize := range []uint{24, 28, 32} {
+				var b mmdbBuilder
+				b.insert("1.2.3.0/24", test.record(&b))
+				db, err := openMMDB(b.write(t, recordSize, 6))
+				if err != nil {
+					t.Fatalf("open: %v", err)
+				}
+				_, err = db.lookup(net.ParseIP("1.2.3.4"))
+				if !errors.Is(err, errMMDBCorrupt) || !strings.Contains(err.Error(), test.want) {
+					t.Fatalf("%d-bit database: lookup error %v, want one mentioning %q", recordSize, err, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// checkOrigin decides whether a WebSocket upgrade from r's Origin is allowed.
+// Listed origins (-allowed-origins) are always accepted. Otherwise the
+// default stays dev-friendly: with an empty list every origin is accepted,
+// and so are clients that send none. -strict-origin removes that fallback,
+// so only listed origins get through and an empty list rejects everything.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	for _, allowed := range config.AllowedOrigins {
+		if origin != "" && strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	if !config.StrictOrigin && (len(config.AllowedOrigins) == 0 || origin == "") {
+		return true
+	}
+	log.Printf("Rejected WebSocket upgrade from %s: origin %q is not allowed", clientIP(r), origin)
+	return false
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// codecPolicyRequest is the body of PUT /admin/rooms/{name}/codec-policy
+type codecPolicyRequest struct {
+	// Policy is the room's codec policy, opaque to the server
+	Policy json.RawMessage `json:"policy"`
+	// Announce includes the policy in the 'policy-changed' broadcast;
+	// otherwise clients are only told to renegotiate
+	Announce bool `json:"announce"`
+}
+
+// handleCodecPolicy sets a room's codec policy and tells everyone in it to
+// renegotiate. The server can't enforce codecs in media; it only distributes
+// the signal, and clients that ignore it keep their current media.
+func handleCodecPolicy(w http.ResponseWriter, r *http.Request) {
+	room, exists := server.Rooms.Get(r.PathValue("name"))
+	if !exists {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+	var req codecPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Policy) == 0 {
+		http.Error(w, "body must be JSON with a 'policy'", http.StatusBadRequest)
+		return
+	}
+	room.Mutex.Lock()
+	room.CodecPolicy = req.Policy
+	clients := len(room.Clients)
+	room.Mutex.Unlock()
+	log.Printf("Codec policy of room '%s' changed: %s", room.Name, req.Policy)
+
+	policyChanged := map[string]interface{}{
+		"type":        "policy-changed",
+		"renegotiate": true,
+	}
+	if req.Announce {
+		policyChanged["policy"] = req.Policy
+	}
+	policyChangedJSON, _ := json.Marshal(policyChanged)
+	room.Broadcast(policyChangedJSON, "", false)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"room":     room.Name,
+		"policy":   req.Policy,
+		"notified": clients,
+	})
+}
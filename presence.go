@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// maxPresenceRooms bounds how many rooms one client can watch
+const maxPresenceRooms = 100
+
+// presenceHub tracks which clients watch the occupancy of which rooms
+type presenceHub struct {
+	mutex sync.Mutex
+	// watchers maps a room name to its subscribers and whether each wants member names
+	watchers map[string]map[*Client]bool
+	// watching maps a subscriber to the rooms it watches
+	watching map[*Client][]string
+}
+
+func newPresenceHub() *presenceHub {
+	return &presenceHub{
+		watchers: make(map[string]map[*Client]bool),
+		watching: make(map[*Client][]string),
+	}
+}
+
+// subscribe replaces the rooms client watches and sends it a snapshot of
+// each. An empty list just unsubscribes.
+func (h *presenceHub) subscribe(client *Client, rooms []string, members bool) error {
+	if len(rooms) > maxPresenceRooms {
+		return fmt.Errorf("at most %d rooms can be watched", maxPresenceRooms)
+	}
+	h.mutex.Lock()
+	h.removeLocked(client)
+	for _, room := range rooms {
+		if h.watchers[room] == nil {
+			h.watchers[room] = make(map[*Client]bool)
+		}
+		h.watchers[room][client] = members
+	}
+	if len(rooms) > 0 {
+		h.watching[client] = rooms
+	}
+	h.mutex.Unlock()
+	log.Printf("Client '%s' watches presence of rooms %v", client.name(), rooms)
+
+	for _, name := range rooms {
+		client.trySend(presenceMessage(name, members))
+	}
+	return nil
+}
+
+// unsubscribe drops every subscription of client
+func (h *presenceHub) unsubscribe(client *Client) {
+	h.mutex.Lock()
+	h.removeLocked(client)
+	h.mutex.Unlock()
+}
+
+// removeLocked drops client's subscriptions. The caller must hold h.mutex.
+func (h *presenceHub) removeLocked(client *Client) {
+	for _, room := range h.watching[client] {
+		delete(h.watchers[room], client)
+		if len(h.watchers[room]) == 0 {
+			delete(h.watchers, room)
+		}
+	}
+	delete(h.watching, client)
+}
+
+// notify pushes the current presence of room to its subscribers
+func (h *presenceHub) notify(room string) {
+	h.mutex.Lock()
+	subscribers := make(map[*Client]bool, len(h.watchers[room]))
+	for client, members := range h.watchers[room] {
+		subscribers[client] = members
+	}
+	h.mutex.Unlock()
+	if len(subscribers) == 0 {
+		return
+	}
+	var withMembers, withoutMembers []byte
+	for client, members := range subscribers {
+		if members {
+			if withMembers == nil {
+				withMembers = presenceMessage(room, true)
+			}
+			client.trySend(withMembers)
+		} else {
+			if withoutMembers == nil {
+				withoutMembers = presenceMessage(room, false)
+			}
+			client.trySend(withoutMembers)
+		}
+	}
+}
+
+// presenceMessage builds the 'room-presence' update for the named room
+func presenceMessage(name string, members bool) []byte {
+	names := make([]string, 0)
+	occupancy := 0
+	if room, exists := server.Rooms.Get(name); exists {
+		names = room.ClientList()
+		room.Mutex.Lock()
+		occupancy = room.occupancy()
+		room.Mutex.Unlock()
+	}
+	presence := map[string]interface{}{
+		"type":      "room-presence",
+		"room":      name,
+		"occupancy": occupancy,
+	}
+	if members {
+		sort.Strings(names)
+		presence["members"] = names
+	}
+	presenceJSON, _ := json.Marshal(presence)
+	return presenceJSON
+}
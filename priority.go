@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Relayed messages carry the priority of their sender's class, so that when
+// a recipient falls behind, what the host or presenter says reaches it ahead
+// of lower-priority chatter queued alongside. The writer reorders each batch
+// it drains from the send queue: relayed messages move ahead of lower-priority
+// ones, keeping their order within a priority, while server messages stay
+// where they are and nothing moves past them. Membership and other server
+// notices therefore still arrive in order with the signaling around them.
+//
+// Priority only matters under contention: a recipient that keeps up writes
+// every message as it comes. It is independent of -fair-broadcast, which
+// decides which room's broadcast the fan-out workers serve next; priority
+// then decides the order a slow recipient gets what is already queued for
+// it. Neither lets a message skip the send buffer bound, so a full queue
+// drops high-priority messages like any others.
+
+// Sender classes, from which relayed messages take their priority
+const (
+	priorityHost        = "host"
+	priorityPresenter   = "presenter"
+	priorityParticipant = "participant"
+	priorityObserver    = "observer"
+)
+
+// defaultPriorities is the priority of each sender class; higher goes first
+var defaultPriorities = map[string]int{
+	priorityHost:        2,
+	priorityPresenter:   2,
+	priorityParticipant: 1,
+	priorityObserver:    0,
+}
+
+// parsePriorities applies comma-separated class=priority overrides to the default priorities
+func parsePriorities(overrides string) (map[string]int, error) {
+	priorities := make(map[string]int, len(defaultPriorities))
+	for class, priority := range defaultPriorities {
+		priorities[class] = priority
+	}
+	for _, entry := range splitList(overrides) {
+		class, value, _ := strings.Cut(entry, "=")
+		class = strings.TrimSpace(class)
+		if _, known := defaultPriorities[class]; !known {
+			return nil, fmt.Errorf("unknown priority class '%s'", class)
+		}
+		priority, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority for class '%s'", class)
+		}
+		priorities[class] = priority
+	}
+	return priorities, nil
+}
+
+// priorityClass returns the sender class of the client: the room's host, the
+// publisher of a publish-subscribe room, a hidden client or subscriber, or
+// any other participant
+func (c *Client) priorityClass() string {
+	if c.Hidden || c.role == roleSubscriber {
+		return priorityObserver
+	}
+	room := c.room()
+	if room == nil {
+		return priorityParticipant
+	}
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+	switch c.name() {
+	case room.Host:
+		return priorityHost
+	case room.Publisher:
+		return priorityPresenter
+	}
+	return priorityParticipant
+}
+
+// relayed wraps a message from the client for queueing, with its priority
+func (c *Client) relayed(data []byte, expires time.Time) outbound {
+	return outbound{data: data, expires: expires, priority: config.Priorities[c.priorityClass()], relayed: true}
+}
+
+// prioritize reorders queued so that each run of relayed messages between
+// server messages is in descending priority, keeping the order of messages
+// with the same priority
+func prioritize(queued []outbound) {
+	for start := 0; start < len(queued); {
+		if !queued[start].relayed {
+			start++
+			continue
+		}
+		end := start
+		for end < len(queued) && queued[end].relayed {
+			end++
+		}
+		run := queued[start:end]
+		sort.SliceStable(run, func(i, j int) bool { return run[i].priority > run[j].priority })
+		start = end
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Room modes. Mesh rooms route signaling by 'target' between any peers. In
+// publish-subscribe rooms one client, which joined with role 'publisher',
+// sends to everyone else: its signaling without a 'target' fans out to all
+// subscribers, and subscribers' signaling always goes to the publisher.
+const (
+	roomModeMesh             = "mesh"
+	roomModePublishSubscribe = "publish-subscribe"
+)
+
+// Join roles, meaningful in publish-subscribe rooms only
+const (
+	rolePublisher  = "publisher"
+	roleSubscriber = "subscriber"
+)
+
+// mode returns the room's mode. The caller must hold r.Mutex.
+func (r *Room) mode() string {
+	if r.Mode == "" {
+		return roomModeMesh
+	}
+	return r.Mode
+}
+
+// isPublishSubscribe reports whether the room is a publish-subscribe room
+func (r *Room) isPublishSubscribe() bool {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	return r.Mode == roomModePublishSubscribe
+}
+
+// signalTarget resolves where signaling from sender goes in a
+// publish-subscribe room: subscribers always reach the publisher, and the
+// publisher reaches target, or every subscriber when fanOut is set.
+func (r *Room) signalTarget(sender, target string) (resolved string, fanOut bool, err error) {
+	r.Mutex.Lock()
+	publisher := r.Publisher
+	r.Mutex.Unlock()
+	if sender == publisher {
+		return target, target == "", nil
+	}
+	if publisher == "" {
+		return "", false, fmt.Errorf("room '%s' has no publisher", r.Name)
+	}
+	return publisher, false, nil
+}
+
+// claimPublisher makes name the publisher of a publish-subscribe room if the
+// client asked to publish. The caller must hold r.Mutex.
+func (r *Room) claimPublisher(name, role string) error {
+	if r.Mode != roomModePublishSubscribe || role != rolePublisher {
+		return nil
+	}
+	if r.Publisher != "" && r.Publisher != name {
+		return &joinError{Code: "publisher-taken", Message: fmt.Sprintf("room '%s' already has publisher '%s'", r.Name, r.Publisher)}
+	}
+	return nil
+}
+
+// broadcastPublisher announces the current publisher to everyone in the room
+func (r *Room) broadcastPublisher() {
+	r.Mutex.Lock()
+	publisher := r.Publisher
+	r.Mutex.Unlock()
+	publisherMessage := map[string]interface{}{
+		"type":      "publisher-changed",
+		"publisher": publisher,
+	}
+	publisherJSON, _ := json.Marshal(publisherMessage)
+	r.Broadcast(publisherJSON, "", false)
+	log.Printf("Publisher of room '%s' is now '%s'", r.Name, publisher)
+}
+
+// releasePublisher clears the publisher if clientName held the role and has
+// left the room, and reports whether it did
+func (r *Room) releasePublisher(clientName string) bool {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if r.Publisher != clientName || r.Clients[clientName] != nil {
+		return false
+	}
+	r.Publisher = ""
+	return true
+}
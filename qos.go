@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 'qos-report' carries a client's opaque connection quality metrics. With a
+// 'target' it goes to that peer like other signaling, without one it is
+// relayed to the whole room. The server doesn't act on the payload; with
+// -qos-log-interval it only logs per-room averages of the numeric values in
+// 'metrics' for operators.
+
+// relayQoS routes a 'qos-report' and notes it for the operator log
+func (c *Client) relayQoS(data map[string]interface{}, message []byte) {
+	if _, targeted := data["target"]; targeted {
+		stamped, err := withFields(message, map[string]interface{}{"from": c.name()})
+		if err != nil {
+			log.Printf("Could not encode 'qos-report' from '%s': %v", c.name(), err)
+			return
+		}
+		c.forward("qos-report", data, stamped)
+	} else {
+		c.relayToRoom("qos-report", data, message)
+	}
+	if reported, ok := data["metrics"].(map[string]interface{}); ok {
+		qosLog.note(c.room().Name, reported)
+	}
+}
+
+// qosAggregate sums the numeric metrics reported in one room
+type qosAggregate struct {
+	reports int
+	sums    map[string]float64
+	counts  map[string]int
+}
+
+// qosAggregator collects reports between two operator log lines
+type qosAggregator struct {
+	mutex sync.Mutex
+	rooms map[string]*qosAggregate
+}
+
+// qosLog is nil unless -qos-log-interval is set
+var qosLog *qosAggregator
+
+// note adds a report's numeric metrics to its room's aggregate
+func (q *qosAggregator) note(room string, values map[string]interface{}) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	aggregate, exists := q.rooms[room]
+	if !exists {
+		aggregate = &qosAggregate{sums: make(map[string]float64), counts: make(map[string]int)}
+		q.rooms[room] = aggregate
+	}
+	aggregate.reports++
+	for key, value := range values {
+		if number, ok := value.(float64); ok {
+			aggregate.sums[key] += number
+			aggregate.counts[key]++
+		}
+	}
+}
+
+// run logs and resets the aggregates on every tick of interval
+func (q *qosAggregator) run(ctx context.Context, interval time.Duration) {
+	everyTick(ctx, interval, func(time.Time) {
+		q.mutex.Lock()
+		rooms := q.rooms
+		q.rooms = make(map[string]*qosAggregate)
+		q.mutex.Unlock()
+		for _, room := range sortedKeys(rooms) {
+			aggregate := rooms[room]
+			averages := make([]string, 0, len(aggregate.sums))
+			for _, key := range sortedKeys(aggregate.sums) {
+				averages = append(averages, fmt.Sprintf("%s=%.4g", key, aggregate.sums[key]/float64(aggregate.counts[key])))
+			}
+			log.Printf("QoS in room '%s' over %s: %d reports, averages %s", room, interval, aggregate.reports, strings.Join(averages, " "))
+		}
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Rooms with QueueWhenFull set don't reject joins once they are full: the
+// joiner waits in line, is told its place in 'queued' messages and gets the
+// usual 'joined' when a place frees up. Places are handed out under the room
+// lock once the departure that freed them is announced, and fresh joins
+// can't overtake the queue. Disconnecting or sending 'leave' cancels the wait.
+
+// maxJoinQueue bounds the joins waiting for one room
+const maxJoinQueue = 1000
+
+// errLeftJoinQueue is returned when a queued client gives up its place
+var errLeftJoinQueue = &joinError{Code: "left-queue", Message: "left the join queue"}
+
+// joinWaiter is a join queued for a place in a full room
+type joinWaiter struct {
+	client *Client
+	name   string
+	// admitted receives the outcome once the waiter leaves the queue
+	admitted chan error
+	// moved is signalled when the waiter's place in line may have changed
+	moved chan struct{}
+}
+
+// queuesJoins reports whether joins to the full room wait in line
+func (r *Room) queuesJoins() bool {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	return r.QueueWhenFull
+}
+
+// admitWaiting lets queued joins in while the room has room for them. The
+// caller must hold r.Mutex.
+func (r *Room) admitWaiting() {
+	admitted := 0
+	for len(r.waiting) > 0 {
+		if capacity := r.capacity(); r.Locked || (capacity > 0 && r.visibleCount() >= capacity) {
+			break
+		}
+		w := r.waiting[0]
+		r.waiting = r.waiting[1:]
+		err := w.client.admitLocked(r, w.name, true, true)
+		if err != nil {
+			log.Printf("Queued client '%s' could not enter room '%s': %v", w.name, r.Name, err)
+		}
+		w.admitted <- err
+		admitted++
+	}
+	if admitted > 0 {
+		r.notifyWaiting()
+	}
+}
+
+// rejectWaiting fails every queued join with err. The caller must hold r.Mutex.
+func (r *Room) rejectWaiting(err error) {
+	for _, w := range r.waiting {
+		w.admitted <- err
+	}
+	r.waiting = nil
+}
+
+// notifyWaiting tells queued joins that their place may have changed. The
+// caller must hold r.Mutex.
+func (r *Room) notifyWaiting() {
+	for _, w := range r.waiting {
+		select {
+		case w.moved <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// queuePosition returns the 1-based place of w in line, 0 once it left it
+func (r *Room) queuePosition(w *joinWaiter) int {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	for i, queued := range r.waiting {
+		if queued == w {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// removeWaiter takes w out of line and reports whether it was still in it.
+// The caller must hold r.Mutex.
+func (r *Room) removeWaiter(w *joinWaiter) bool {
+	for i, queued := range r.waiting {
+		if queued == w {
+			r.waiting = append(r.waiting[:i], r.waiting[i+1:]...)
+			r.notifyWaiting()
+			return true
+		}
+	}
+	return false
+}
+
+// waitInQueue queues the client for a place in the full room and blocks
+// until it is admitted (nil) or gives up. It runs on the connection's setup
+// goroutine, before the client's writer and reader are running.
+func (c *Client) waitInQueue(room *Room, name string) error {
+	w := &joinWaiter{client: c, name: name, admitted: make(chan error, 1), moved: make(chan struct{}, 1)}
+	room.Mutex.Lock()
+	// A place may have freed up since the first attempt
+	if err := c.admitLocked(room, name, true, false); joinErrorCode(err) != "room-full" {
+		room.Mutex.Unlock()
+		return err
+	}
+	if len(room.waiting) >= maxJoinQueue {
+		room.Mutex.Unlock()
+		return &joinError{Code: "room-full", Message: fmt.Sprintf("room '%s' is full and so is its join queue", room.Name)}
+	}
+	room.waiting = append(room.waiting, w)
+	position := len(room.waiting)
+	room.Mutex.Unlock()
+	log.Printf("Client '%s' queued for room '%s' at position %d", name, room.Name, position)
+
+	// Waiting clients don't hold up connections that are still setting up
+	if c.leaveSetup != nil {
+		c.leaveSetup()
+	}
+	messages := c.startReading()
+	var keepalive <-chan time.Time
+	if config.KeepaliveInterval > 0 {
+		ticker := time.NewTicker(config.KeepaliveInterval)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+	sent := 0
+	for {
+		if position != sent {
+			if err := c.sendQueued(room, position); err != nil {
+				log.Printf("Could not update queued client '%s': %v", name, err)
+				return c.leaveQueue(room, w)
+			}
+			sent = position
+		}
+		select {
+		case err := <-w.admitted:
+			return err
+		case <-w.moved:
+			if position = room.queuePosition(w); position == 0 {
+				// Admitted; the outcome is waiting in w.admitted
+				sent = 0
+			}
+		case <-keepalive:
+			sent = 0
+		case message, ok := <-messages:
+			if !ok {
+				log.Printf("Queued client '%s' disconnected from the queue of room '%s'", name, room.Name)
+				return c.leaveQueue(room, w)
+			}
+			data, err := decodeFrame(message)
+			if messageType, _ := data["type"].(string); err == nil && messageType == "leave" {
+				log.Printf("Queued client '%s' left the queue of room '%s'", name, room.Name)
+				return c.leaveQueue(room, w)
+			}
+			log.Printf("Ignoring message from queued client '%s'", name)
+		}
+	}
+}
+
+// sendQueued tells a waiting client its place in line
+func (c *Client) sendQueued(room *Room, position int) error {
+	if position == 0 {
+		return nil
+	}
+	queuedMessage := map[string]interface{}{
+		"type":     "queued",
+		"room":     room.Name,
+		"position": position,
+	}
+	queuedJSON, _ := json.Marshal(queuedMessage)
+	written, err := writeFrame(c.Socket, signMessage(queuedJSON))
+	c.Traffic.Written.Add(int64(written))
+	return err
+}
+
+// leaveQueue cancels w's wait. If a place was handed to it meanwhile the
+// admission stands, and the client leaves the room the usual way.
+func (c *Client) leaveQueue(room *Room, w *joinWaiter) error {
+	room.Mutex.Lock()
+	removed := room.removeWaiter(w)
+	room.Mutex.Unlock()
+	if removed {
+		return errLeftJoinQueue
+	}
+	return <-w.admitted
+}
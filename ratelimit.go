@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// rateBucket is a token bucket limiting how fast a client may send messages.
+// A client's is only used from its reading goroutine.
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// allowMessage reports whether a message of the given type fits the client's
+// rate limit, taking a token for it. Exempt types are never counted, so a
+// throttled client can still leave and acknowledge cleanly.
+func (c *Client) allowMessage(messageType string) bool {
+	if config.RateLimit <= 0 || config.RateLimitExempt[messageType] {
+		return true
+	}
+	b := &c.rate
+	now := time.Now()
+	if b.updated.IsZero() {
+		b.tokens = float64(config.RateBurst)
+	} else {
+		b.tokens += now.Sub(b.updated).Seconds() * config.RateLimit
+		if b.tokens > float64(config.RateBurst) {
+			b.tokens = float64(config.RateBurst)
+		}
+	}
+	b.updated = now
+	if b.tokens < 1 {
+		log.Printf("Client '%s' exceeded %.1f messages/s. '%s' dropped.", c.name(), config.RateLimit, messageType)
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// broadcastRate is the room's broadcast budget in broadcasts per second, 0
+// meaning unlimited. The caller must hold r.Mutex.
+func (r *Room) broadcastRate() float64 {
+	if r.BroadcastRate > 0 {
+		return r.BroadcastRate
+	}
+	return config.RoomBroadcastRate
+}
+
+// allowBroadcast reports whether a broadcast from the client fits its room's
+// aggregate broadcast budget, taking a token for it. Every broadcast costs
+// each member a message, so the budget is shared by the whole room, on top of
+// the per-client limit; the bucket holds up to one second's worth. A
+// rejected sender gets a 'room-rate-limited' error. Targeted signaling never
+// counts.
+func (c *Client) allowBroadcast(messageType string) bool {
+	room := c.room()
+	room.Mutex.Lock()
+	rate := room.broadcastRate()
+	if rate <= 0 {
+		room.Mutex.Unlock()
+		return true
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	b := &room.broadcasts
+	now := time.Now()
+	if b.updated.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.updated).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.updated = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	room.Mutex.Unlock()
+	if !allowed {
+		log.Printf("Room '%s' exceeded %.1f broadcasts/s. '%s' from '%s' dropped.", room.Name, rate, messageType, c.name())
+		metrics.IncCounter("signaling_messages_dropped_total", "kind", "room-rate-limited")
+		c.trySend(errorMessage("room-rate-limited", fmt.Sprintf("room '%s' allows %g broadcasts per second, slow down", room.Name, rate)))
+	}
+	return allowed
+}
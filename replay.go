@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// maxTrackedNonces bounds the seen-nonce cache; the oldest entries are
+// evicted first once it fills up
+const maxTrackedNonces = 100000
+
+// errReplayDetected rejects a join or resume message that was seen before
+// or whose timestamp is outside the allowed clock skew
+var errReplayDetected = errors.New("message nonce was already used or its timestamp is out of range")
+
+// nonceCache remembers recently seen nonces for config.ReplayWindow
+type nonceCache struct {
+	mutex sync.Mutex
+	seen  map[string]time.Time
+	// order lists nonces by the time they were seen, oldest first
+	order []string
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: make(map[string]time.Time)}
+}
+
+// checkReplay validates the 'nonce' and 'timestamp' (milliseconds since the
+// epoch) fields of a join or resume message. It does nothing unless
+// config.ReplayWindow is set.
+func checkReplay(data map[string]interface{}, now time.Time) error {
+	if config.ReplayWindow <= 0 {
+		return nil
+	}
+	nonce, _ := data["nonce"].(string)
+	timestamp, ok := data["timestamp"].(float64)
+	if nonce == "" || !ok {
+		return errors.New("'nonce' and 'timestamp' are required")
+	}
+	skew := now.Sub(time.UnixMilli(int64(timestamp)))
+	if skew > config.ReplayWindow || skew < -config.ReplayWindow {
+		return errReplayDetected
+	}
+	if !server.Nonces.remember(nonce, now) {
+		return errReplayDetected
+	}
+	return nil
+}
+
+// remember records nonce and reports whether it was new. A nonce only has to
+// be kept for twice the window: older timestamps fail the skew check anyway.
+func (n *nonceCache) remember(nonce string, now time.Time) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for len(n.order) > 0 {
+		oldest := n.order[0]
+		if len(n.order) < maxTrackedNonces && now.Sub(n.seen[oldest]) <= 2*config.ReplayWindow {
+			break
+		}
+		delete(n.seen, oldest)
+		n.order = n.order[1:]
+	}
+	if _, seen := n.seen[nonce]; seen {
+		return false
+	}
+	n.seen[nonce] = now
+	n.order = append(n.order, nonce)
+	return true
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errResumeExpired is returned for unknown, expired or revoked resume tokens
+var errResumeExpired = errors.New("resume token is unknown or has expired")
+
+// resumeSession ties an issued resume token to the client holding the slot
+type resumeSession struct {
+	Client *Client
+	// Expires is zero while the client is connected and set once it drops
+	Expires time.Time
+}
+
+// resumeStore keeps the resume sessions of joined clients keyed by token.
+// With -max-resume-sessions it holds at most that many; when full, the
+// oldest session is evicted or the new one refused (-resume-store-full).
+type resumeStore struct {
+	sessions map[string]*resumeSession
+	// order holds the tokens oldest first; tokens no longer in sessions are
+	// skipped when evicting and compacted away as they pile up
+	order []string
+	mutex sync.Mutex
+}
+
+// newResumeStore creates an empty resume store
+func newResumeStore() *resumeStore {
+	return &resumeStore{sessions: make(map[string]*resumeSession)}
+}
+
+// newToken generates resume tokens. It defaults to randomToken and can be
+// swapped for a deterministic generator in tests.
+var newToken = randomToken
+
+// randomToken returns a crypto-random, URL-safe hex token
+func randomToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// resumeGrace is the room's resume window, falling back to the server-wide setting
+func (r *Room) resumeGrace() time.Duration {
+	if r.ResumeGrace > 0 {
+		return r.ResumeGrace
+	}
+	return config.ResumeGrace
+}
+
+// Issue creates a session for a connected client and returns its token, or
+// "" when the store is full and refuses new sessions
+func (s *resumeStore) Issue(client *Client) string {
+	token := newToken()
+	s.mutex.Lock()
+	var evicted *resumeSession
+	if config.MaxResumeSessions > 0 && len(s.sessions) >= config.MaxResumeSessions {
+		if config.ResumeStoreFull == "refuse" {
+			s.mutex.Unlock()
+			log.Printf("Resume store is full (%d sessions). No resume token for client '%s'.", config.MaxResumeSessions, client.name())
+			metrics.IncCounter("signaling_resume_sessions_refused_total")
+			return ""
+		}
+		evicted = s.evictOldest()
+	}
+	s.sessions[token] = &resumeSession{Client: client}
+	s.order = append(s.order, token)
+	if len(s.order) > 2*len(s.sessions)+64 {
+		s.compact()
+	}
+	size := len(s.sessions)
+	s.mutex.Unlock()
+	metrics.SetGauge("signaling_resume_sessions", float64(size))
+	if evicted != nil {
+		// The evicted client's name and room may be changing on its own
+		// goroutine; the accessors read them atomically
+		roomName := ""
+		if room := evicted.Client.room(); room != nil {
+			roomName = room.Name
+		}
+		log.Printf("Resume store is full (%d sessions). Evicted the session of client '%s' in room '%s'.", config.MaxResumeSessions, evicted.Client.name(), roomName)
+		metrics.IncCounter("signaling_resume_sessions_evicted_total")
+		evicted.release()
+	}
+	return token
+}
+
+// evictOldest removes and returns the oldest session. The caller must hold
+// s.mutex and release the session after unlocking.
+func (s *resumeStore) evictOldest() *resumeSession {
+	for len(s.order) > 0 {
+		token := s.order[0]
+		s.order = s.order[1:]
+		if session, exists := s.sessions[token]; exists {
+			delete(s.sessions, token)
+			return session
+		}
+	}
+	return nil
+}
+
+// compact drops the tokens of removed sessions from s.order. The caller must hold s.mutex.
+func (s *resumeStore) compact() {
+	order := make([]string, 0, len(s.sessions))
+	for _, token := range s.order {
+		if _, exists := s.sessions[token]; exists {
+			order = append(order, token)
+		}
+	}
+	s.order = order
+}
+
+// Size returns the number of sessions in the store
+func (s *resumeStore) Size() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.sessions)
+}
+
+// Drop forgets the client's session, if the client still owns it
+func (s *resumeStore) Drop(client *Client) {
+	if client.SessionID == "" {
+		return
+	}
+	s.mutex.Lock()
+	if session, exists := s.sessions[client.SessionID]; exists && session.Client == client {
+		delete(s.sessions, client.SessionID)
+	}
+	s.mutex.Unlock()
+}
+
+// holdForResume keeps the client's slot after a temporary leave, starting
+// its resume window. It reports false when the client can't resume.
+func (c *Client) holdForResume() bool {
+	grace := c.room().resumeGrace()
+	if c.SessionID == "" || grace <= 0 {
+		return false
+	}
+	s := server.Sessions
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, exists := s.sessions[c.SessionID]
+	if !exists || session.Client != c {
+		return false
+	}
+	session.Expires = time.Now().Add(grace)
+	return true
+}
+
+// resume lets a new connection take over the slot of a session. On success
+// the client is in the session's room under the session's name.
+func (c *Client) resume(token string) error {
+	s := server.Sessions
+	s.mutex.Lock()
+	session, exists := s.sessions[token]
+	if !exists || (!session.Expires.IsZero() && time.Now().After(session.Expires)) {
+		s.mutex.Unlock()
+		return errResumeExpired
+	}
+	previous := session.Client
+	room := previous.room()
+
+	room.Mutex.Lock()
+	if room.Clients[previous.name()] != previous {
+		// The slot was taken by a fresh join under the same name
+		room.Mutex.Unlock()
+		delete(s.sessions, token)
+		s.mutex.Unlock()
+		return errResumeExpired
+	}
+	c.setName(previous.name())
+	c.setRoom(room)
+	c.SessionID = token
+	c.Hidden = previous.Hidden
+	c.role = previous.role
+	c.stickyRoom = previous.stickyRoom
+	c.AppVersion = previous.AppVersion
+	c.roomUsageBase = c.usage()
+	room.retireUsage(previous)
+	room.Clients[c.name()] = c
+	room.Mutex.Unlock()
+
+	session.Client = c
+	session.Expires = time.Time{}
+	s.mutex.Unlock()
+
+	// If the previous connection is still open, retire it without giving up the slot
+	previous.replaced.Store(true)
+	previous.disconnect(websocket.CloseNormalClosure, "resumed")
+
+	log.Printf("Client '%s' resumed its session in room '%s'", c.name(), room.Name)
+	server.Audit.record("join", c, room.Name, "resume")
+	server.Events.record(room.Name, "resume", c.name(), "")
+	c.readLimit.Store(room.maxMessageSize())
+	c.welcome(true)
+	if !c.Hidden {
+		// The new connection counts as connected now, which can move the relay
+		room.updateAdvisory(c)
+	}
+	queued := previous.takeQueued()
+	for _, message := range queued {
+		c.enqueueOutbound(message)
+	}
+	if len(queued) > 0 {
+		log.Printf("Delivered %d messages queued for client '%s' while it was away", len(queued), c.name())
+	}
+	return nil
+}
+
+// maxQueuedWhileAway bounds the targeted messages kept for a client whose slot is held
+const maxQueuedWhileAway = 64
+
+// deliver sends a targeted message to the client, holding it while the
+// client is on hold and queueing it for resume when the client is away with
+// its slot held. The message is dropped if still queued when it expires.
+func (c *Client) deliver(message outbound) bool {
+	if c.holdIfPaused(message) {
+		return true
+	}
+	if c.enqueueOutbound(message) {
+		return true
+	}
+	select {
+	case <-c.Done:
+	default:
+		// Still connected; the send queue is just full
+		return false
+	}
+	if !server.Sessions.held(c) {
+		return false
+	}
+	c.awayMutex.Lock()
+	defer c.awayMutex.Unlock()
+	if len(c.awayQueue) >= maxQueuedWhileAway {
+		log.Printf("Queue for away client '%s' is full (%d messages). Message dropped.", c.name(), maxQueuedWhileAway)
+		return false
+	}
+	c.awayQueue = append(c.awayQueue, message)
+	return true
+}
+
+// takeQueued returns and clears the messages queued while the client was away
+func (c *Client) takeQueued() []outbound {
+	c.awayMutex.Lock()
+	defer c.awayMutex.Unlock()
+	queued := c.awayQueue
+	c.awayQueue = nil
+	return queued
+}
+
+// held reports whether client is disconnected with its slot held for resume
+func (s *resumeStore) held(client *Client) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, exists := s.sessions[client.SessionID]
+	return exists && session.Client == client && !session.Expires.IsZero()
+}
+
+// sweep periodically releases the slots of sessions whose resume window ran out
+func (s *resumeStore) sweep(ctx context.Context, interval time.Duration) {
+	everyTick(ctx, interval, s.expire)
+}
+
+// expire removes sessions that expired before now and fully releases their
+// clients, broadcasting the usual 'leave'
+func (s *resumeStore) expire(now time.Time) {
+	s.mutex.Lock()
+	expired := make([]*Client, 0)
+	for token, session := range s.sessions {
+		if !session.Expires.IsZero() && now.After(session.Expires) {
+			expired = append(expired, session.Client)
+			delete(s.sessions, token)
+		}
+	}
+	size := len(s.sessions)
+	s.mutex.Unlock()
+	metrics.SetGauge("signaling_resume_sessions", float64(size))
+
+	for _, client := range expired {
+		log.Printf("Resume window for client '%s' in room '%s' expired", client.name(), client.room().Name)
+		if dropped := len(client.takeQueued()); dropped > 0 {
+			log.Printf("Dropped %d messages queued for client '%s' while it was away", dropped, client.name())
+		}
+		client.room().RemoveClientIfCurrent(client)
+	}
+}
+
+// revoke forgets a session token and, if its client is away with the slot
+// held, releases the slot as if the resume window had run out. It reports
+// whether the token was known.
+func (s *resumeStore) revoke(token string) bool {
+	s.mutex.Lock()
+	session, exists := s.sessions[token]
+	if exists {
+		delete(s.sessions, token)
+	}
+	s.mutex.Unlock()
+	if !exists {
+		return false
+	}
+	client := session.Client
+	if session.Expires.IsZero() {
+		log.Printf("Session of client '%s' in room '%s' revoked while connected", client.name(), client.room().Name)
+	} else {
+		log.Printf("Session of away client '%s' in room '%s' revoked", client.name(), client.room().Name)
+	}
+	session.release()
+	return true
+}
+
+// release frees the slot of a session removed from the store whose client
+// is away; a connected client just loses the ability to resume
+func (session *resumeSession) release() {
+	if session.Expires.IsZero() {
+		return
+	}
+	client := session.Client
+	if dropped := len(client.takeQueued()); dropped > 0 {
+		log.Printf("Dropped %d messages queued for client '%s' while it was away", dropped, client.name())
+	}
+	client.room().RemoveClientIfCurrent(client)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// limitResumeStore sets -max-resume-sessions and -resume-store-full for a test
+func limitResumeStore(t *testing.T, capacity int, full string) {
+	maxSessions, storeFull := config.MaxResumeSessions, config.ResumeStoreFull
+	t.Cleanup(func() { config.MaxResumeSessions, config.ResumeStoreFull = maxSessions, storeFull })
+	config.MaxResumeSessions, config.ResumeStoreFull = capacity, full
+}
+
+// resumeClient returns a client that isn't connected, named name in room
+func resumeClient(room *Room, name string) *Client {
+	client := &Client{Send: make(chan outbound, 1), Done: make(chan struct{})}
+	client.setName(name)
+	if room != nil {
+		client.setRoom(room)
+	}
+	return client
+}
+
+func TestResumeStoreEvictsOldest(t *testing.T) {
+	limitResumeStore(t, 3, "evict")
+	s := newResumeStore()
+	room := &Room{Name: t.Name(), Clients: make(map[string]*Client)}
+
+	// The oldest client is away, holding its slot for resume
+	away := resumeClient(room, "away")
+	room.Clients["away"] = away
+	tokens := []string{s.Issue(away)}
+	s.sessions[tokens[0]].Expires = time.Now().Add(time.Minute)
+	for _, name := range []string{"b", "c"} {
+		tokens = append(tokens, s.Issue(resumeClient(room, name)))
+	}
+
+	evicted := counterValue("signaling_resume_sessions_evicted_total")
+	// A client with no room yet doesn't trip up the eviction log
+	tokens = append(tokens, s.Issue(resumeClient(nil, "d")))
+	if tokens[3] == "" {
+		t.Fatal("no token issued with -resume-store-full=evict")
+	}
+	if s.Size() != 3 {
+		t.Fatalf("store holds %d sessions, want 3", s.Size())
+	}
+	if _, exists := s.sessions[tokens[0]]; exists {
+		t.Fatal("the oldest session survived eviction")
+	}
+	for _, token := range tokens[1:] {
+		if _, exists := s.sessions[token]; !exists {
+			t.Fatalf("session %s was evicted, want only the oldest", token)
+		}
+	}
+	if counterValue("signaling_resume_sessions_evicted_total") != evicted+1 {
+		t.Fatal("the eviction was not counted")
+	}
+	if _, exists := room.Clients["away"]; exists {
+		t.Fatal("the evicted away client still holds its place in the room")
+	}
+}
+
+func TestResumeStoreRefusesWhenFull(t *testing.T) {
+	limitResumeStore(t, 2, "refuse")
+	s := newResumeStore()
+	room := &Room{Name: t.Name(), Clients: make(map[string]*Client)}
+	first, second := s.Issue(resumeClient(room, "a")), s.Issue(resumeClient(room, "b"))
+
+	refused := counterValue("signaling_resume_sessions_refused_total")
+	if token := s.Issue(resumeClient(room, "c")); token != "" {
+		t.Fatalf("token %s issued by a full store with -resume-store-full=refuse", token)
+	}
+	if counterValue("signaling_resume_sessions_refused_total") != refused+1 {
+		t.Fatal("the refusal was not counted")
+	}
+	for _, token := range []string{first, second} {
+		if _, exists := s.sessions[token]; !exists {
+			t.Fatalf("session %s was dropped by a refusing store", token)
+		}
+	}
+}
+
+// TestResumeStoreUnderPressure issues many more sessions than the store
+// holds, from many goroutines at once, and checks the bound and the counts
+// in both modes
+func TestResumeStoreUnderPressure(t *testing.T) {
+	const capacity, goroutines, each = 50, 8, 500
+	for _, full := range []string{"evict", "refuse"} {
+		t.Run(full, func(t *testing.T) {
+			limitResumeStore(t, capacity, full)
+			s := newResumeStore()
+			room := &Room{Name: t.Name(), Clients: make(map[string]*Client)}
+			counter := "signaling_resume_sessions_" + map[string]string{"evict": "evicted", "refuse": "refused"}[full] + "_total"
+			before := counterValue(counter)
+
+			var wg sync.WaitGroup
+			issued := make([][]string, goroutines)
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < each; i++ {
+						client := resumeClient(room, fmt.Sprintf("client-%d-%d", g, i))
+						if token := s.Issue(client); token != "" {
+							issued[g] = append(issued[g], token)
+						}
+						if size := s.Size(); size > capacity {
+							t.Errorf("store holds %d sessions, want at most %d", size, capacity)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if s.Size() != capacity {
+				t.Fatalf("store holds %d sessions, want %d", s.Size(), capacity)
+			}
+			total := 0
+			for _, tokens := range issued {
+				total += len(tokens)
+			}
+			wantIssued := map[string]int{"evict": goroutines * each, "refuse": capacity}[full]
+			if total != wantIssued {
+				t.Fatalf("%d tokens issued, want %d", total, wantIssued)
+			}
+			if got := counterValue(counter) - before; got != goroutines*each-capacity {
+				t.Fatalf("%s rose by %v, want %d", counter, got, goroutines*each-capacity)
+			}
+			if len(s.order) > 2*capacity+64 {
+				t.Fatalf("eviction order holds %d tokens for %d sessions", len(s.order), capacity)
+			}
+		})
+	}
+}
+
+// TestResumeKeepsJoinState resumes a session and checks the state the join
+// set, beyond the name and room, carries over to the new connection
+func TestResumeKeepsJoinState(t *testing.T) {
+	room := t.Name()
+	alice := joinFake(t, room, "alice")
+	r, _ := server.Rooms.Get(room)
+	r.Mutex.Lock()
+	r.ResumeGrace = time.Minute
+	r.Mutex.Unlock()
+	// alice joined before resume was on; rejoin for a token
+	alice.feed(map[string]interface{}{"type": "leave"})
+	waitFor(t, 5*time.Second, "alice to leave", alice.isClosed)
+	alice = serveFake(t, "/ws")
+	alice.feed(map[string]interface{}{"type": "join", "room": room, "name": "alice", "role": roleSubscriber, "appVersion": "2.3.1"})
+	token, _ := alice.expect("joined")["resumeToken"].(string)
+	if token == "" {
+		t.Fatal("alice got no resume token")
+	}
+
+	alice.feed(map[string]interface{}{"type": "leave", "temporary": true})
+	waitFor(t, 5*time.Second, "alice to leave", alice.isClosed)
+	resumed := serveFake(t, "/ws")
+	closeAll(t, resumed)
+	resumed.feed(map[string]interface{}{"type": "resume", "token": token})
+	resumed.expect("joined")
+	resumed.feed(map[string]interface{}{"type": "whereami"})
+	if reply := resumed.expect("whereami"); reply["role"] != roleSubscriber {
+		t.Fatalf("alice's role after resuming is %v, want %s", reply["role"], roleSubscriber)
+	}
+	r.Mutex.Lock()
+	client := r.Clients["alice"]
+	r.Mutex.Unlock()
+	if client.AppVersion != "2.3.1" {
+		t.Fatalf("alice's app version after resuming is %q, want 2.3.1", client.AppVersion)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// route is how the server handles a client message type
+type route int
+
+const (
+	// routeUnknown types are logged (and optionally echoed) and dropped
+	routeUnknown route = iota
+	// routeTargeted types need a 'target' and are forwarded to that peer
+	routeTargeted
+	// routeBroadcast types are relayed to everyone else in the room
+	routeBroadcast
+	// routeServer types are handled by the server itself
+	routeServer
+)
+
+// routeNames are the route names accepted by -routes
+var routeNames = map[string]route{
+	"targeted":  routeTargeted,
+	"broadcast": routeBroadcast,
+	"server":    routeServer,
+}
+
+// defaultRoutes is the routing table before -routes overrides. 'dtmf'
+// carries softphone tones and is relayed as opaquely as WebRTC signaling.
+var defaultRoutes = map[string]route{
+	"offer":                routeTargeted,
+	"answer":               routeTargeted,
+	"candidate":            routeTargeted,
+	"dtmf":                 routeTargeted,
+	"qos-report":           routeServer,
+	"chat":                 routeServer,
+	"read-receipt":         routeServer,
+	"rename":               routeServer,
+	"lock-room":            routeServer,
+	"unlock-room":          routeServer,
+	"hold":                 routeServer,
+	"kick":                 routeServer,
+	"ban":                  routeServer,
+	"unhold":               routeServer,
+	"move-to-breakout":     routeServer,
+	"return-from-breakout": routeServer,
+	"switch-room":          routeServer,
+	"subscribe-presence":   routeServer,
+	"whereami":             routeServer,
+	"chunk":                routeServer,
+	"leave":                routeServer,
+}
+
+// parseRoutes builds the routing table from the defaults and a
+// comma-separated list of type=route overrides, e.g. "mute=broadcast".
+// Only the default server-handled types can be routed to the server.
+func parseRoutes(overrides string) (map[string]route, error) {
+	routes := make(map[string]route, len(defaultRoutes))
+	for messageType, r := range defaultRoutes {
+		routes[messageType] = r
+	}
+	for _, entry := range splitList(overrides) {
+		messageType, name, ok := strings.Cut(entry, "=")
+		messageType = strings.TrimSpace(messageType)
+		r, known := routeNames[strings.TrimSpace(name)]
+		if !ok || messageType == "" || !known {
+			return nil, fmt.Errorf("invalid route %q, want type=targeted|broadcast|server", entry)
+		}
+		if r == routeServer && defaultRoutes[messageType] != routeServer {
+			return nil, fmt.Errorf("type '%s' has no server handler", messageType)
+		}
+		routes[messageType] = r
+	}
+	return routes, nil
+}
+
+// maxCorrelationIDLength bounds the client-supplied correlation ids copied into logs
+const maxCorrelationIDLength = 128
+
+// correlationTag renders a message's optional 'correlationId' for log lines,
+// or "" when there is none. The id is opaque to the server and is forwarded
+// untouched with the message; it only ties log lines to the client's traces.
+func correlationTag(data map[string]interface{}) string {
+	id := correlationID(data)
+	if id == "" {
+		return ""
+	}
+	return fmt.Sprintf(" correlationId=%q", id)
+}
+
+// correlationID returns a message's optional 'correlationId', truncated to
+// maxCorrelationIDLength, or "" when there is none
+func correlationID(data map[string]interface{}) string {
+	id, _ := data["correlationId"].(string)
+	if len(id) > maxCorrelationIDLength {
+		id = id[:maxCorrelationIDLength]
+	}
+	return id
+}
+
+// relayToRoom broadcasts a message, as received, to the rest of the sender's
+// room, stamped with the sender's name
+func (c *Client) relayToRoom(messageType string, data map[string]interface{}, message []byte) {
+	if !c.allowBroadcast(messageType) {
+		return
+	}
+	relayJSON, err := withFields(message, map[string]interface{}{"from": c.name()})
+	if err != nil {
+		log.Printf("Could not encode '%s' from '%s': %v", messageType, c.name(), err)
+		return
+	}
+	c.room().RelayFrom(c, relayJSON, c.name(), true, messageExpiry(data))
+	debugf("Message of type '%s' from '%s' broadcast to room '%s'%s", messageType, c.name(), c.room().Name, correlationTag(data))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxSDPSize bounds the session descriptions accepted when validation is on
+const maxSDPSize = 64 * 1024
+
+// validateSignal checks the payload of an offer, answer or candidate for basic
+// well-formedness. It returns the error code to report along with the error.
+func validateSignal(messageType string, data map[string]interface{}) (string, error) {
+	if messageType == "candidate" {
+		candidate, ok := extractField(data, "candidate", "candidate")
+		if !ok {
+			return "bad-candidate", errors.New("missing candidate")
+		}
+		if err := validateCandidate(candidate); err != nil {
+			return "bad-candidate", err
+		}
+		return "", nil
+	}
+	sdp, ok := extractField(data, messageType, "sdp")
+	if !ok {
+		sdp, ok = extractField(data, "sdp", "sdp")
+	}
+	if !ok {
+		return "bad-sdp", errors.New("missing sdp")
+	}
+	if err := validateSDP(sdp); err != nil {
+		return "bad-sdp", err
+	}
+	return "", nil
+}
+
+// extractField reads data[key] either as a string or as an object holding a
+// string under inner, matching both {"sdp": "..."} and {"offer": {"sdp": "..."}}
+func extractField(data map[string]interface{}, key, inner string) (string, bool) {
+	switch value := data[key].(type) {
+	case string:
+		return value, true
+	case map[string]interface{}:
+		nested, ok := value[inner].(string)
+		return nested, ok
+	}
+	return "", false
+}
+
+// validateSDP performs a lenient structural check of a session description:
+// it must start with v=0, carry o= and s= lines, consist only of <letter>=<value>
+// lines, and have well-formed m= lines. Attribute contents are not inspected.
+func validateSDP(sdp string) error {
+	if len(sdp) > maxSDPSize {
+		return fmt.Errorf("sdp exceeds %d bytes", maxSDPSize)
+	}
+	lines := strings.Split(strings.TrimRight(sdp, "\r\n"), "\n")
+	if strings.TrimSuffix(lines[0], "\r") != "v=0" {
+		return errors.New("sdp must start with 'v=0'")
+	}
+	seen := make(map[byte]bool)
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) < 2 || line[1] != '=' || line[0] < 'a' || line[0] > 'z' {
+			return fmt.Errorf("sdp line %d is not of the form <type>=<value>", i+1)
+		}
+		seen[line[0]] = true
+		if line[0] == 'm' {
+			fields := strings.Fields(line[2:])
+			if len(fields) < 4 || !startsWithDigit(fields[1]) {
+				return fmt.Errorf("sdp line %d is not a valid media description", i+1)
+			}
+		}
+	}
+	if !seen['o'] || !seen['s'] {
+		return errors.New("sdp is missing its o= or s= line")
+	}
+	return nil
+}
+
+// validateCandidate checks an ICE candidate attribute. An empty candidate
+// signals end-of-candidates and is accepted.
+func validateCandidate(candidate string) error {
+	if candidate == "" {
+		return nil
+	}
+	candidate = strings.TrimPrefix(candidate, "a=")
+	if !strings.HasPrefix(candidate, "candidate:") {
+		return errors.New("candidate must start with 'candidate:'")
+	}
+	fields := strings.Fields(strings.TrimPrefix(candidate, "candidate:"))
+	if len(fields) < 8 || fields[6] != "typ" {
+		return errors.New("candidate is missing required fields")
+	}
+	return nil
+}
+
+// startsWithDigit reports whether s begins with an ASCII digit
+func startsWithDigit(s string) bool {
+	return s != "" && s[0] >= '0' && s[0] <= '9'
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// assignSlot gives name the lowest free slot index, keeping the slot it
+// already holds. The caller must hold r.Mutex.
+func (r *Room) assignSlot(name string) int {
+	if slot := r.slotOf(name); slot >= 0 {
+		return slot
+	}
+	for slot, holder := range r.Slots {
+		if holder == "" {
+			r.Slots[slot] = name
+			return slot
+		}
+	}
+	r.Slots = append(r.Slots, name)
+	return len(r.Slots) - 1
+}
+
+// releaseSlot frees the slot held by name. The caller must hold r.Mutex.
+func (r *Room) releaseSlot(name string) {
+	if slot := r.slotOf(name); slot >= 0 {
+		r.Slots[slot] = ""
+	}
+	for len(r.Slots) > 0 && r.Slots[len(r.Slots)-1] == "" {
+		r.Slots = r.Slots[:len(r.Slots)-1]
+	}
+}
+
+// slotOf returns the slot held by name, or -1. The caller must hold r.Mutex.
+func (r *Room) slotOf(name string) int {
+	for slot, holder := range r.Slots {
+		if holder == name {
+			return slot
+		}
+	}
+	return -1
+}
+
+// slotHolder returns the name of the client in the given slot, or ""
+func (r *Room) slotHolder(slot int) string {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if slot < 0 || slot >= len(r.Slots) {
+		return ""
+	}
+	return r.Slots[slot]
+}
+
+// broadcastSlots sends the current name -> slot assignments to the whole room
+func (r *Room) broadcastSlots() {
+	r.Mutex.Lock()
+	slots := make(map[string]int, len(r.Slots))
+	for slot, holder := range r.Slots {
+		if holder != "" {
+			slots[holder] = slot
+		}
+	}
+	r.Mutex.Unlock()
+
+	slotsMessage := map[string]interface{}{
+		"type":  "slots",
+		"slots": slots,
+	}
+	slotsJSON, _ := json.Marshal(slotsMessage)
+	r.Broadcast(slotsJSON, "", false)
+	log.Printf("Slot assignments broadcasted in room '%s': %v", r.Name, slots)
+}
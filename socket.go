@@ -0,0 +1,25 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// socketConn is the part of a WebSocket connection the server uses.
+// *websocket.Conn implements it in production; anything else that does, such
+// as an in-memory connection, can stand in for it.
+type socketConn interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetReadLimit(limit int64)
+	SetPingHandler(h func(appData string) error)
+	SetCloseHandler(h func(code int, text string) error)
+	Subprotocol() string
+	Close() error
+}
+
+var _ socketConn = (*websocket.Conn)(nil)
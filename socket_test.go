@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeFrame is a frame queued for a fakeSocket to read
+type fakeFrame struct {
+	messageType int
+	data        []byte
+}
+
+// fakeControl is a control frame the server wrote to a fakeSocket
+type fakeControl struct {
+	messageType int
+	data        []byte
+}
+
+// fakeSocket is an in-memory socketConn. Tests queue the frames the server
+// reads and take the frames it writes, with no network in between, so the
+// only synchronization between clients is the server's own.
+type fakeSocket struct {
+	frames    chan fakeFrame
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mutex         sync.Mutex
+	pingHandler   func(appData string) error
+	closeHandler  func(code int, text string) error
+	writeDeadline time.Time
+	// deadlineLimit, when set, caps how far ahead a write deadline can be
+	deadlineLimit time.Duration
+	// unstalled is open while writes block, as to a peer that stopped reading
+	unstalled chan struct{}
+	// blocked counts the writes that blocked on a stall
+	blocked   int
+	closeSent bool
+	written   [][]byte
+	controls  []fakeControl
+	// wrote is signaled after every write
+	wrote chan struct{}
+
+	// cursor is the next written frame expect looks at, used by the test only
+	cursor int
+	t      testing.TB
+}
+
+// newFakeSocket returns a fakeSocket that can queue frames frames before
+// the server reads them
+func newFakeSocket(t testing.TB, frames int) *fakeSocket {
+	return &fakeSocket{
+		t:      t,
+		frames: make(chan fakeFrame, frames),
+		closed: make(chan struct{}),
+		wrote:  make(chan struct{}, 1),
+	}
+}
+
+// serveFake runs a connection for target, such as "/ws?room=a&name=b", over
+// a fakeSocket, as if it had just been upgraded
+func serveFake(t testing.TB, target string) *fakeSocket {
+	f := newFakeSocket(t, 1024)
+	go serveSocket(f, httptest.NewRequest("GET", target, nil), nil)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// joinFake connects a fake client and joins name to room, waiting for 'joined'
+func joinFake(t testing.TB, room, name string) *fakeSocket {
+	t.Helper()
+	f := serveFake(t, "/ws")
+	f.feed(map[string]interface{}{"type": "join", "room": room, "name": name})
+	f.expect("joined")
+	return f
+}
+
+// feed queues a message for the server to read
+func (f *fakeSocket) feed(message map[string]interface{}) {
+	data, _ := json.Marshal(message)
+	f.feedRaw(data)
+}
+
+// feedRaw queues a text frame as it is
+func (f *fakeSocket) feedRaw(data []byte) {
+	f.frames <- fakeFrame{websocket.TextMessage, data}
+}
+
+// ping queues a ping carrying appData
+func (f *fakeSocket) ping(appData string) {
+	f.frames <- fakeFrame{websocket.PingMessage, []byte(appData)}
+}
+
+// hangUp queues a close frame with code
+func (f *fakeSocket) hangUp(code int) {
+	f.frames <- fakeFrame{websocket.CloseMessage, websocket.FormatCloseMessage(code, "")}
+}
+
+// stall makes writes block until their deadline, or until unstall
+func (f *fakeSocket) stall() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.unstalled = make(chan struct{})
+}
+
+// unstall lets blocked and later writes through
+func (f *fakeSocket) unstall() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.unstalled != nil {
+		close(f.unstalled)
+		f.unstalled = nil
+	}
+}
+
+// limitDeadlines caps the write deadlines the server sets to limit from now,
+// as if it ran with a shorter -write-timeout
+func (f *fakeSocket) limitDeadlines(limit time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.deadlineLimit = limit
+}
+
+// blockedWrites returns how many writes blocked on a stall so far
+func (f *fakeSocket) blockedWrites() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.blocked
+}
+
+// ReadMessage returns the next queued frame. Like gorilla, it runs the ping
+// and close handlers for control frames, answering pings as it reads on.
+func (f *fakeSocket) ReadMessage() (int, []byte, error) {
+	for {
+		select {
+		case frame := <-f.frames:
+			f.mutex.Lock()
+			pingHandler, closeHandler := f.pingHandler, f.closeHandler
+			f.mutex.Unlock()
+			switch frame.messageType {
+			case websocket.PingMessage:
+				if pingHandler != nil {
+					if err := pingHandler(string(frame.data)); err != nil {
+						return 0, nil, err
+					}
+				}
+				continue
+			case websocket.CloseMessage:
+				code := int(frame.data[0])<<8 | int(frame.data[1])
+				if closeHandler != nil {
+					closeHandler(code, "")
+				}
+				return 0, nil, &websocket.CloseError{Code: code}
+			}
+			return frame.messageType, frame.data, nil
+		case <-f.closed:
+			return 0, nil, net.ErrClosed
+		}
+	}
+}
+
+// WriteMessage records a data frame, blocking while the socket is stalled
+func (f *fakeSocket) WriteMessage(messageType int, data []byte) error {
+	f.mutex.Lock()
+	unstalled, deadline := f.unstalled, f.writeDeadline
+	if unstalled != nil {
+		f.blocked++
+	}
+	f.mutex.Unlock()
+	if unstalled != nil {
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case <-unstalled:
+		case <-expired:
+			return os.ErrDeadlineExceeded
+		case <-f.closed:
+			return net.ErrClosed
+		}
+	}
+	return f.record(func() { f.written = append(f.written, append([]byte(nil), data...)) })
+}
+
+// WriteControl records a control frame; nothing is written after a close
+// frame, and, as on a real connection, nothing past its deadline
+func (f *fakeSocket) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return os.ErrDeadlineExceeded
+	}
+	return f.record(func() {
+		f.controls = append(f.controls, fakeControl{messageType, append([]byte(nil), data...)})
+		if messageType == websocket.CloseMessage {
+			f.closeSent = true
+		}
+	})
+}
+
+// record runs add under the mutex unless the socket is closed, and signals wrote
+func (f *fakeSocket) record(add func()) error {
+	select {
+	case <-f.closed:
+		return net.ErrClosed
+	default:
+	}
+	f.mutex.Lock()
+	if f.closeSent {
+		f.mutex.Unlock()
+		return websocket.ErrCloseSent
+	}
+	add()
+	f.mutex.Unlock()
+	select {
+	case f.wrote <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetReadDeadline is not used by the server, which reads without a deadline
+func (f *fakeSocket) SetReadDeadline(t time.Time) error { return nil }
+
+func (f *fakeSocket) SetWriteDeadline(t time.Time) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if limit := time.Now().Add(f.deadlineLimit); f.deadlineLimit > 0 && !t.IsZero() && t.After(limit) {
+		t = limit
+	}
+	f.writeDeadline = t
+	return nil
+}
+
+func (f *fakeSocket) SetReadLimit(limit int64) {}
+
+func (f *fakeSocket) SetPingHandler(h func(appData string) error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.pingHandler = h
+}
+
+func (f *fakeSocket) SetCloseHandler(h func(code int, text string) error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closeHandler = h
+}
+
+func (f *fakeSocket) Subprotocol() string { return "" }
+
+func (f *fakeSocket) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+// isClosed reports whether the server closed the socket
+func (f *fakeSocket) isClosed() bool {
+	select {
+	case <-f.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// next returns the next data frame the server wrote, waiting until deadline
+func (f *fakeSocket) next(deadline time.Time) ([]byte, bool) {
+	for {
+		f.mutex.Lock()
+		if f.cursor < len(f.written) {
+			frame := f.written[f.cursor]
+			f.cursor++
+			f.mutex.Unlock()
+			return frame, true
+		}
+		f.mutex.Unlock()
+		select {
+		case <-f.wrote:
+		case <-time.After(time.Until(deadline)):
+			return nil, false
+		}
+	}
+}
+
+// await takes written frames until a message of messageType, giving up after timeout
+func (f *fakeSocket) await(messageType string, timeout time.Duration) ([]byte, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		data, ok := f.next(deadline)
+		if !ok {
+			return nil, false
+		}
+		var message map[string]interface{}
+		if json.Unmarshal(data, &message) == nil && message["type"] == messageType {
+			return data, true
+		}
+	}
+}
+
+// expectRaw is await failing the test after five seconds
+func (f *fakeSocket) expectRaw(messageType string) []byte {
+	f.t.Helper()
+	data, ok := f.await(messageType, 5*time.Second)
+	if !ok {
+		f.t.Fatalf("timed out waiting for '%s'", messageType)
+	}
+	return data
+}
+
+// expect is expectRaw for a decoded message
+func (f *fakeSocket) expect(messageType string) map[string]interface{} {
+	f.t.Helper()
+	var message map[string]interface{}
+	json.Unmarshal(f.expectRaw(messageType), &message)
+	return message
+}
+
+// control returns the control frames of messageType written so far
+func (f *fakeSocket) control(messageType int) [][]byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var frames [][]byte
+	for _, frame := range f.controls {
+		if frame.messageType == messageType {
+			frames = append(frames, frame.data)
+		}
+	}
+	return frames
+}
+
+func TestFakeSocketRelay(t *testing.T) {
+	room := t.Name()
+	alice := joinFake(t, room, "alice")
+	bob := joinFake(t, room, "bob")
+	alice.expect("new-user")
+
+	alice.feed(map[string]interface{}{"type": "offer", "target": "bob", "sdp": "v=0"})
+	offer := bob.expect("offer")
+	if offer["sdp"] != "v=0" {
+		t.Fatalf("bob got offer %v, want sdp 'v=0'", offer)
+	}
+}
+
+func TestFakeSocketPing(t *testing.T) {
+	alice := joinFake(t, t.Name(), "alice")
+	alice.ping("are you there")
+	waitFor(t, 5*time.Second, "the pong", func() bool { return len(alice.control(websocket.PongMessage)) > 0 })
+	if pong := string(alice.control(websocket.PongMessage)[0]); pong != "are you there" {
+		t.Fatalf("pong carries %q, want the ping's data", pong)
+	}
+}
+
+func TestFakeSocketHangUp(t *testing.T) {
+	room := t.Name()
+	alice := joinFake(t, room, "alice")
+	bob := joinFake(t, room, "bob")
+
+	bob.hangUp(websocket.CloseNormalClosure)
+	if leave := alice.expect("leave"); leave["name"] != "bob" {
+		t.Fatalf("alice got %v, want bob's leave", leave)
+	}
+	waitFor(t, 5*time.Second, "bob's socket to close", bob.isClosed)
+	if echoed := bob.control(websocket.CloseMessage); len(echoed) != 1 {
+		t.Fatalf("server wrote %d close frames, want its echo of bob's", len(echoed))
+	}
+	if _, exists := roomClients(room)["bob"]; exists {
+		t.Fatal("bob is still in the room after hanging up")
+	}
+}
+
+// awaitPong waits up to timeout for a pong carrying appData
+func (f *fakeSocket) awaitPong(appData string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, pong := range f.control(websocket.PongMessage) {
+			if string(pong) == appData {
+				return true
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+// TestPongWhileHandlingMessages checks that pings are answered while the
+// client's messages wait to be handled, so a busy client doesn't trip its
+// peer's keepalive
+func TestPongWhileHandlingMessages(t *testing.T) {
+	room := t.Name()
+	alice := joinFake(t, room, "alice")
+	bob := joinFake(t, room, "bob")
+	alice.expect("new-user")
+	offer := map[string]interface{}{"type": "offer", "target": "bob", "sdp": "v=0"}
+
+	// With handling held up, the reader still gets through readAhead
+	// messages to the ping behind them
+	started, release := make(chan struct{}), make(chan struct{})
+	go roomClients(room)["alice"].do(func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	for i := 0; i < readAhead; i++ {
+		alice.feed(offer)
+	}
+	alice.ping("busy")
+	if !alice.awaitPong("busy", 2*time.Second) {
+		t.Fatal("no pong while alice's messages were waiting to be handled")
+	}
+	if _, handled := bob.await("offer", 10*time.Millisecond); handled {
+		t.Fatal("an offer was handled while handling was held up")
+	}
+	close(release)
+
+	// A flood well past readAhead delays the pong only as long as it takes
+	// to handle the messages ahead of the ping
+	for i := 0; i < 5000; i++ {
+		alice.feed(offer)
+	}
+	alice.ping("flood")
+	if !alice.awaitPong("flood", 5*time.Second) {
+		t.Fatal("no pong within 5s of a ping behind a flood of messages")
+	}
+}
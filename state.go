@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// StateProvider supplies the app-level state of a room, such as a whiteboard,
+// a shared document or a playback position, that an app keeps
+// authoritatively elsewhere. Joining clients get the snapshot in a
+// 'room-state' message; the server doesn't interpret it. A nil snapshot
+// sends nothing. Implementations must be safe for concurrent use.
+type StateProvider interface {
+	Snapshot(room string) []byte
+}
+
+// stateProvider is the provider chosen with -room-state-url; nil sends no snapshots
+var stateProvider StateProvider
+
+// Limits for fetching snapshots over HTTP
+const (
+	stateTimeout     = 2 * time.Second
+	maxRoomStateSize = 1 << 20
+)
+
+// httpStateProvider fetches snapshots with a GET to a URL template in which
+// {room} is replaced by the escaped room name. A 404 or 204 means the room
+// has no state.
+type httpStateProvider struct {
+	template string
+	client   *http.Client
+}
+
+// newStateProvider returns the provider for -room-state-url, nil when it is empty
+func newStateProvider(template string) (StateProvider, error) {
+	if template == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(template, "http://") && !strings.HasPrefix(template, "https://") {
+		return nil, fmt.Errorf("room state URL must be http(s), got '%s'", template)
+	}
+	if !strings.Contains(template, "{room}") {
+		return nil, fmt.Errorf("room state URL '%s' has no {room} placeholder", template)
+	}
+	return &httpStateProvider{template: template, client: &http.Client{Timeout: stateTimeout}}, nil
+}
+
+func (p *httpStateProvider) Snapshot(room string) []byte {
+	resp, err := p.client.Get(strings.ReplaceAll(p.template, "{room}", url.QueryEscape(room)))
+	if err != nil {
+		log.Printf("Could not fetch the state of room '%s': %v", room, err)
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("Could not fetch the state of room '%s': provider returned %s", room, resp.Status)
+		return nil
+	}
+	snapshot, err := io.ReadAll(io.LimitReader(resp.Body, maxRoomStateSize+1))
+	if err != nil {
+		log.Printf("Could not read the state of room '%s': %v", room, err)
+		return nil
+	}
+	if len(snapshot) > maxRoomStateSize {
+		log.Printf("State of room '%s' is larger than %d bytes. Not sent.", room, maxRoomStateSize)
+		return nil
+	}
+	return snapshot
+}
+
+// sendRoomState sends the client the provider's snapshot of its room, if
+// any. The snapshot is fetched in the background, once for all the clients
+// that arrive while a fetch is running, so joins and room moves don't wait on
+// the provider.
+func (c *Client) sendRoomState() {
+	if stateProvider == nil {
+		return
+	}
+	room := c.room()
+	room.Mutex.Lock()
+	fetching := room.stateWaiters != nil
+	room.stateWaiters = append(room.stateWaiters, c)
+	room.Mutex.Unlock()
+	if !fetching {
+		go room.fetchState(stateProvider)
+	}
+}
+
+// fetchState fetches the room's snapshot from provider and sends it to the clients waiting
+// for it that are still in the room. A JSON snapshot is embedded as is,
+// anything else as a string.
+func (r *Room) fetchState(provider StateProvider) {
+	snapshot := provider.Snapshot(r.Name)
+	r.Mutex.Lock()
+	waiters := r.stateWaiters
+	r.stateWaiters = nil
+	r.Mutex.Unlock()
+	if len(snapshot) == 0 {
+		return
+	}
+	var state interface{} = string(snapshot)
+	if json.Valid(snapshot) {
+		state = json.RawMessage(snapshot)
+	}
+	roomStateJSON, _ := json.Marshal(map[string]interface{}{
+		"type":  "room-state",
+		"room":  r.Name,
+		"state": state,
+	})
+	for _, client := range waiters {
+		if client.room() != r {
+			continue
+		}
+		client.trySend(roomStateJSON)
+		log.Printf("Room state (%d bytes) sent to client '%s' in room '%s'", len(snapshot), client.name(), r.Name)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// blockingStateProvider returns its snapshot once release is closed
+type blockingStateProvider struct {
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (p *blockingStateProvider) Snapshot(room string) []byte {
+	p.calls.Add(1)
+	<-p.release
+	return []byte(`{"page":3}`)
+}
+
+// TestRoomStateFetchedInBackground holds the state provider while two
+// clients join, checks the first is still served, then that one fetch
+// delivers the snapshot to both
+func TestRoomStateFetchedInBackground(t *testing.T) {
+	provider := &blockingStateProvider{release: make(chan struct{})}
+	previous := stateProvider
+	stateProvider = provider
+	t.Cleanup(func() { stateProvider = previous })
+
+	room := t.Name()
+	alice := joinFake(t, room, "alice")
+	bob := joinFake(t, room, "bob")
+	alice.feed(map[string]interface{}{"type": "whereami"})
+	alice.expect("whereami")
+
+	close(provider.release)
+	for _, client := range []*fakeSocket{alice, bob} {
+		if state := client.expect("room-state"); state["room"] != room {
+			t.Fatalf("got room state %v, want room %s", state, room)
+		}
+	}
+	if calls := provider.calls.Load(); calls != 1 {
+		t.Fatalf("state fetched %d times, want once", calls)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"time"
+)
+
+// roomStats is what a 'room-stats' message reports
+type roomStats struct {
+	Clients           int
+	MessagesPerMinute float64
+}
+
+// broadcastRoomStats pushes 'room-stats' to every room on each tick of
+// interval. Rooms whose numbers haven't changed since their last broadcast
+// are skipped, so idle rooms cost one lock per tick.
+func broadcastRoomStats(ctx context.Context, interval time.Duration) {
+	// counts and last are only touched by this goroutine
+	counts := make(map[*Room]int64)
+	last := make(map[*Room]roomStats)
+	everyTick(ctx, interval, func(time.Time) {
+		rooms := server.Rooms.List()
+		live := make(map[*Room]bool, len(rooms))
+		for _, room := range rooms {
+			live[room] = true
+			count := room.messageCount.Load()
+			room.Mutex.Lock()
+			stats := roomStats{Clients: room.occupancy()}
+			room.Mutex.Unlock()
+			perMinute := float64(count-counts[room]) * float64(time.Minute) / float64(interval)
+			stats.MessagesPerMinute = math.Round(perMinute*10) / 10
+			counts[room] = count
+			if previous, sent := last[room]; (sent && previous == stats) || stats.Clients == 0 {
+				continue
+			}
+			last[room] = stats
+			statsMessage := map[string]interface{}{
+				"type":              "room-stats",
+				"clients":           stats.Clients,
+				"messagesPerMinute": stats.MessagesPerMinute,
+			}
+			statsJSON, _ := json.Marshal(statsMessage)
+			room.Broadcast(statsJSON, "", false)
+		}
+		for room := range counts {
+			if !live[room] {
+				delete(counts, room)
+				delete(last, room)
+			}
+		}
+	})
+}
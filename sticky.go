@@ -0,0 +1,43 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// roomPlaceholder matches the {attribute} placeholders of a room mapping
+var roomPlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// mappedRoom derives a room from client attributes using the -room-mappings
+// templates, e.g. "ticket-{ticketId}". The first template whose attributes
+// are all present wins; ok is false when none applies.
+func mappedRoom(attributes map[string]string) (room string, ok bool) {
+	if len(attributes) == 0 {
+		return "", false
+	}
+	for _, template := range config.RoomMappings {
+		complete := true
+		room := roomPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+			value := strings.TrimSpace(attributes[placeholder[1:len(placeholder)-1]])
+			if value == "" {
+				complete = false
+			}
+			return value
+		})
+		if complete {
+			return room, true
+		}
+	}
+	return "", false
+}
+
+// queryAttributes collects the "attr.<name>" query parameters of a query join
+func queryAttributes(query map[string][]string) map[string]string {
+	attributes := make(map[string]string)
+	for key, values := range query {
+		if name, ok := strings.CutPrefix(key, "attr."); ok && len(values) > 0 {
+			attributes[name] = values[0]
+		}
+	}
+	return attributes
+}
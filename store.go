@@ -0,0 +1,64 @@
+package main
+
+import "sync"
+
+// RoomStore maps room names to rooms. The in-memory store is the default;
+// other implementations (sharded, remote) can be plugged into Server.
+type RoomStore interface {
+	// Get returns the named room if it exists
+	Get(name string) (*Room, bool)
+	// GetOrCreate returns the named room, creating it if needed, and reports whether it was created
+	GetOrCreate(name string) (*Room, bool)
+	// Delete removes the named room
+	Delete(name string)
+	// List returns a snapshot of all rooms
+	List() []*Room
+}
+
+// memoryRoomStore keeps rooms in a map guarded by a mutex
+type memoryRoomStore struct {
+	rooms map[string]*Room
+	mutex sync.Mutex
+}
+
+// newMemoryRoomStore creates an empty in-memory room store
+func newMemoryRoomStore() *memoryRoomStore {
+	return &memoryRoomStore{rooms: make(map[string]*Room)}
+}
+
+func (s *memoryRoomStore) Get(name string) (*Room, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	room, exists := s.rooms[name]
+	return room, exists
+}
+
+func (s *memoryRoomStore) GetOrCreate(name string) (*Room, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if room, exists := s.rooms[name]; exists {
+		return room, false
+	}
+	room := &Room{
+		Name:    name,
+		Clients: make(map[string]*Client),
+	}
+	s.rooms[name] = room
+	return room, true
+}
+
+func (s *memoryRoomStore) Delete(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.rooms, name)
+}
+
+func (s *memoryRoomStore) List() []*Room {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
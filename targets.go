@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// targetTracker remembers when a connection last addressed each target
+type targetTracker struct {
+	mutex    sync.Mutex
+	lastSeen map[string]time.Time
+	// exceeded is set once the connection is being disconnected
+	exceeded bool
+}
+
+// noteTarget records a targeted message. Addressing more than
+// -max-distinct-targets different names within -distinct-target-window, as
+// a scanner cycling through made-up names does, disconnects the client with
+// 'too-many-targets'. The map never grows past the threshold plus one.
+func (c *Client) noteTarget(target string) {
+	if config.MaxDistinctTargets <= 0 {
+		return
+	}
+	t := &c.targets
+	t.mutex.Lock()
+	now := time.Now()
+	if t.lastSeen == nil {
+		t.lastSeen = make(map[string]time.Time)
+	}
+	t.lastSeen[target] = now
+	if len(t.lastSeen) > config.MaxDistinctTargets {
+		for name, seen := range t.lastSeen {
+			if now.Sub(seen) > config.DistinctTargetWindow {
+				delete(t.lastSeen, name)
+			}
+		}
+	}
+	distinct := len(t.lastSeen)
+	exceeded := distinct > config.MaxDistinctTargets && !t.exceeded
+	t.exceeded = t.exceeded || exceeded
+	t.mutex.Unlock()
+	if exceeded {
+		log.Printf("Client '%s' from %s addressed %d distinct targets within %s. Disconnecting.", c.name(), c.RemoteIP, distinct, config.DistinctTargetWindow)
+		metrics.IncCounter("signaling_too_many_targets_total")
+		c.disconnect(websocket.ClosePolicyViolation, "too-many-targets")
+	}
+}
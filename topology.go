@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Room topologies restrict how clients may address each other. Targeted-only
+// rooms, e.g. private 1:1 calls, refuse room-wide messages; broadcast-only
+// rooms refuse messages addressed to a single peer.
+const (
+	topologyAny           = "any"
+	topologyTargetedOnly  = "targeted-only"
+	topologyBroadcastOnly = "broadcast-only"
+)
+
+// topology returns the room's topology. The caller must hold r.Mutex.
+func (r *Room) topology() string {
+	if r.Topology == "" {
+		return topologyAny
+	}
+	return r.Topology
+}
+
+// isBroadcastMessage reports whether a message goes to the whole room rather
+// than one peer: broadcast-routed types, chat, and untargeted QoS reports
+func isBroadcastMessage(messageType string, data map[string]interface{}) bool {
+	switch config.Routes[messageType] {
+	case routeBroadcast:
+		return true
+	case routeServer:
+		_, targeted := data["target"]
+		return messageType == "chat" || messageType == "qos-report" && !targeted
+	}
+	return false
+}
+
+// isTargetedMessage reports whether a message is addressed to one peer
+func isTargetedMessage(messageType string, data map[string]interface{}) bool {
+	if config.Routes[messageType] == routeTargeted {
+		return true
+	}
+	_, targeted := data["target"]
+	return messageType == "qos-report" && targeted
+}
+
+// checkTopology returns the error code and reason when the room's topology
+// doesn't allow the message, or "" when it does
+func (r *Room) checkTopology(messageType string, data map[string]interface{}) (string, error) {
+	r.Mutex.Lock()
+	topology := r.topology()
+	r.Mutex.Unlock()
+	switch {
+	case topology == topologyTargetedOnly && isBroadcastMessage(messageType, data):
+		return "broadcast-disabled", fmt.Errorf("room '%s' allows targeted messages only, not '%s'", r.Name, messageType)
+	case topology == topologyBroadcastOnly && isTargetedMessage(messageType, data):
+		return "targeting-disabled", fmt.Errorf("room '%s' allows room-wide messages only, not '%s'", r.Name, messageType)
+	}
+	return "", nil
+}
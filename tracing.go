@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tracer starts spans for the connection and signaling paths. Spans started
+// with the same trace key, such as a client's correlation id, belong to one
+// trace; an empty key starts a new trace. Implementations must be safe for
+// concurrent use.
+type Tracer interface {
+	// Start begins a span; attributes are alternating key/value pairs
+	Start(name, traceKey string, attributes ...string) Span
+}
+
+// Span is one timed operation
+type Span interface {
+	SetAttribute(key, value string)
+	End()
+}
+
+// tracer is the implementation chosen at startup with -tracing
+var tracer Tracer = noopTracer{}
+
+// newTracer returns the Tracer named by -tracing. 'log' writes finished
+// spans to the log; 'otlp' sends them in batches to an OpenTelemetry
+// collector as OTLP/HTTP JSON.
+func newTracer(kind, endpoint string) (Tracer, error) {
+	switch kind {
+	case "", "none":
+		return noopTracer{}, nil
+	case "log":
+		return &recordingTracer{export: logSpan}, nil
+	case "otlp":
+		if endpoint == "" {
+			return nil, fmt.Errorf("-tracing otlp needs -otlp-endpoint")
+		}
+		return newOTLPExporter(endpoint), nil
+	}
+	return nil, fmt.Errorf("unknown tracing implementation '%s'", kind)
+}
+
+// noopTracer discards everything
+type noopTracer struct{}
+
+type noopSpan struct{}
+
+func (noopTracer) Start(string, string, ...string) Span { return noopSpan{} }
+func (noopSpan) SetAttribute(string, string)            {}
+func (noopSpan) End()                                   {}
+
+// finishedSpan is a span handed to an exporter once it ends
+type finishedSpan struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Name       string
+	Start, End time.Time
+	Attributes []string
+}
+
+// recordingTracer times spans and passes them to export when they end
+type recordingTracer struct {
+	export func(span finishedSpan)
+}
+
+// recordingSpan is a span of a recordingTracer; it is used by one goroutine
+type recordingSpan struct {
+	finishedSpan
+	export func(span finishedSpan)
+}
+
+func (t *recordingTracer) Start(name, traceKey string, attributes ...string) Span {
+	span := &recordingSpan{export: t.export}
+	span.Name = name
+	span.Start = time.Now()
+	span.Attributes = append([]string(nil), attributes...)
+	span.TraceID = traceIDFor(traceKey)
+	rand.Read(span.SpanID[:])
+	return span
+}
+
+func (s *recordingSpan) SetAttribute(key, value string) {
+	s.Attributes = append(s.Attributes, key, value)
+}
+
+func (s *recordingSpan) End() {
+	s.finishedSpan.End = time.Now()
+	s.export(s.finishedSpan)
+}
+
+// traceIDFor derives the trace id for a trace key. A key that already is a
+// W3C trace id (32 hex digits) is used as is, other keys are hashed, and an
+// empty key gets a random id.
+func traceIDFor(traceKey string) [16]byte {
+	var id [16]byte
+	if traceKey == "" {
+		rand.Read(id[:])
+		return id
+	}
+	if decoded, err := hex.DecodeString(traceKey); err == nil && len(decoded) == len(id) {
+		copy(id[:], decoded)
+		return id
+	}
+	sum := sha256.Sum256([]byte(traceKey))
+	copy(id[:], sum[:])
+	return id
+}
+
+// logSpan writes a finished span as one log line
+func logSpan(span finishedSpan) {
+	attributes := make([]string, 0, len(span.Attributes)/2)
+	for i := 0; i+1 < len(span.Attributes); i += 2 {
+		attributes = append(attributes, fmt.Sprintf("%s=%q", span.Attributes[i], span.Attributes[i+1]))
+	}
+	log.Printf("span name=%q traceId=%x spanId=%x duration=%s %s", span.Name, span.TraceID, span.SpanID, span.End.Sub(span.Start), strings.Join(attributes, " "))
+}
+
+// OTLP export limits: spans wait in a bounded queue and are sent in batches
+const (
+	otlpQueueSize     = 4096
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+)
+
+// otlpExporter sends finished spans to an OTLP/HTTP endpoint, e.g.
+// http://collector:4318/v1/traces
+type otlpExporter struct {
+	recordingTracer
+	endpoint string
+	queue    chan finishedSpan
+	client   *http.Client
+}
+
+func newOTLPExporter(endpoint string) *otlpExporter {
+	e := &otlpExporter{endpoint: endpoint, queue: make(chan finishedSpan, otlpQueueSize), client: &http.Client{Timeout: webhookTimeout}}
+	e.export = func(span finishedSpan) {
+		select {
+		case e.queue <- span:
+		default:
+			log.Printf("Trace queue full. Span '%s' dropped.", span.Name)
+		}
+	}
+	return e
+}
+
+// run sends queued spans in batches until ctx is cancelled, then flushes
+func (e *otlpExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	batch := make([]finishedSpan, 0, otlpBatchSize)
+	for {
+		select {
+		case span := <-e.queue:
+			if batch = append(batch, span); len(batch) >= otlpBatchSize {
+				e.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = batch[:0]
+		case <-ctx.Done():
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			e.send(batch)
+			return
+		}
+	}
+}
+
+// send posts one batch of spans as an OTLP JSON trace export request
+func (e *otlpExporter) send(batch []finishedSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, span := range batch {
+		spans = append(spans, map[string]interface{}{
+			"traceId":           hex.EncodeToString(span.TraceID[:]),
+			"spanId":            hex.EncodeToString(span.SpanID[:]),
+			"name":              span.Name,
+			"kind":              2, // SPAN_KIND_SERVER
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(span.Attributes...),
+		})
+	}
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes("service.name", "webrtc-teste", "service.version", serverVersion())},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "signaling"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		log.Println("Trace encode error:", err)
+		return
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Trace export of %d spans failed: %v", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("Trace export of %d spans failed: collector returned %s", len(batch), resp.Status)
+	}
+}
+
+// otlpAttributes renders key/value pairs as OTLP string attributes
+func otlpAttributes(pairs ...string) []map[string]interface{} {
+	attributes := make([]map[string]interface{}, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		attributes = append(attributes, map[string]interface{}{
+			"key":   pairs[i],
+			"value": map[string]interface{}{"stringValue": pairs[i+1]},
+		})
+	}
+	return attributes
+}
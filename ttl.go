@@ -0,0 +1,42 @@
+package main
+
+import "time"
+
+// A relayed message may carry ttlMs, the number of milliseconds it stays
+// worth delivering. If it is still queued for a recipient when that runs out,
+// the writer drops it instead of sending it late. Messages without ttlMs
+// never expire.
+
+// outbound is a message queued for a client; expires is zero when it never
+// expires. Relayed client messages carry their sender's priority.
+type outbound struct {
+	data     []byte
+	expires  time.Time
+	priority int
+	relayed  bool
+}
+
+// messageExpiry returns when a message stamped with ttlMs, received now,
+// stops being worth delivering, or the zero time when it has no TTL
+func messageExpiry(data map[string]interface{}) time.Time {
+	ttl, ok := data["ttlMs"].(float64)
+	if !ok || ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(ttl * float64(time.Millisecond)))
+}
+
+// liveBatch appends the queued messages to batch in priority order, leaving
+// out those whose TTL ran out while they were queued
+func (c *Client) liveBatch(batch [][]byte, queued []outbound, now time.Time) [][]byte {
+	prioritize(queued)
+	for _, message := range queued {
+		if !message.expires.IsZero() && now.After(message.expires) {
+			debugf("Message for client '%s' expired %s before it could be written. Message dropped.", c.name(), now.Sub(message.expires))
+			metrics.IncCounter("signaling_messages_dropped_total", "kind", "expired")
+			continue
+		}
+		batch = append(batch, message.data)
+	}
+	return batch
+}
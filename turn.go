@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// turnCredentials is a short-lived credential in the coturn REST API format
+type turnCredentials struct {
+	Username   string   `json:"username"`
+	Credential string   `json:"credential"`
+	TTL        int64    `json:"ttl"`
+	URIs       []string `json:"uris"`
+}
+
+// turnEnabled reports whether a shared secret is configured
+func turnEnabled() bool {
+	return config.TURNSecret != ""
+}
+
+// newTURNCredentials mints credentials for user: the username is
+// "<expiry-unix>:<user>" and the credential is base64(HMAC-SHA1(secret, username))
+func newTURNCredentials(user string, now time.Time) turnCredentials {
+	username := strconv.FormatInt(now.Add(config.TURNTTL).Unix(), 10)
+	if user != "" {
+		username += ":" + user
+	}
+	mac := hmac.New(sha1.New, []byte(config.TURNSecret))
+	mac.Write([]byte(username))
+	return turnCredentials{
+		Username:   username,
+		Credential: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		TTL:        int64(config.TURNTTL / time.Second),
+		URIs:       config.TURNURIs,
+	}
+}
+
+// handleTURNCredentials issues TURN credentials to the subject of a valid
+// connection token, or anonymous ones to a request with the admin token.
+// Without -jwt-secret or -admin-token nobody can be authenticated, so none
+// are issued.
+func handleTURNCredentials(w http.ResponseWriter, r *http.Request) {
+	if !turnEnabled() {
+		http.Error(w, "TURN credentials are not configured", http.StatusNotFound)
+		return
+	}
+	user := ""
+	if !hasAdminToken(r) {
+		if config.JWTSecret == "" {
+			log.Printf("Rejected TURN credentials request from %s: authentication is off", clientIP(r))
+			http.Error(w, "TURN credentials require -jwt-secret or -admin-token", http.StatusForbidden)
+			return
+		}
+		subject, err := authenticate(r)
+		if err != nil {
+			log.Printf("Rejected TURN credentials request from %s: %v", clientIP(r), err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		user = subject
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, newTURNCredentials(user, time.Now()))
+}
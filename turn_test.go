@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// signTestJWT returns an HS256 token for subject
+func signTestJWT(secret, subject string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{"sub": subject})
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestTURNCredentials(t *testing.T) {
+	turnSecret, jwtSecret, adminToken := config.TURNSecret, config.JWTSecret, config.AdminToken
+	t.Cleanup(func() { config.TURNSecret, config.JWTSecret, config.AdminToken = turnSecret, jwtSecret, adminToken })
+	config.TURNSecret = "turn-secret"
+
+	tests := []struct {
+		name          string
+		jwtSecret     string
+		adminToken    string
+		authorization string
+		wantStatus    int
+		// wantUser is the user after the expiry in the issued username
+		wantUser string
+	}{
+		{name: "authentication off", wantStatus: http.StatusForbidden},
+		{name: "missing token", jwtSecret: "jwt", wantStatus: http.StatusUnauthorized},
+		{name: "bad signature", jwtSecret: "jwt", authorization: "Bearer " + signTestJWT("other", "alice"), wantStatus: http.StatusUnauthorized},
+		{name: "token subject", jwtSecret: "jwt", authorization: "Bearer " + signTestJWT("jwt", "alice"), wantStatus: http.StatusOK, wantUser: "alice"},
+		{name: "admin token", adminToken: "admin", authorization: "Bearer admin", wantStatus: http.StatusOK},
+		{name: "wrong admin token", adminToken: "admin", authorization: "Bearer nope", wantStatus: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.JWTSecret, config.AdminToken = test.jwtSecret, test.adminToken
+			// The query name is ignored: credentials are only for the authenticated user
+			r := httptest.NewRequest("GET", "/turn-credentials?username=mallory", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			handleTURNCredentials(w, r)
+			if w.Code != test.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var credentials turnCredentials
+			if err := json.Unmarshal(w.Body.Bytes(), &credentials); err != nil {
+				t.Fatalf("invalid body %s: %v", w.Body, err)
+			}
+			_, user, _ := strings.Cut(credentials.Username, ":")
+			if user != test.wantUser {
+				t.Fatalf("credentials issued for user %q, want %q", user, test.wantUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// An upgrade that fails before the connection is hijacked gets a JSON body
+// {type: "error", code, message}, in the same shape as a rejection sent over
+// the socket, and is counted in signaling_upgrade_failures_total by code.
+// The HTTP status stays the one the WebSocket handshake calls for.
+
+// upgradeFailureCode classifies why the handshake for r failed with status
+func upgradeFailureCode(r *http.Request, status int) string {
+	switch status {
+	case http.StatusForbidden:
+		return "bad-origin"
+	case http.StatusMethodNotAllowed:
+		return "method-not-allowed"
+	case http.StatusBadRequest:
+		switch {
+		case !websocket.IsWebSocketUpgrade(r):
+			return "not-websocket"
+		case r.Header.Get("Sec-Websocket-Version") != "13":
+			return "unsupported-version"
+		case r.Header.Get("Sec-Websocket-Key") == "":
+			return "missing-key"
+		}
+		return "bad-handshake"
+	}
+	return "internal"
+}
+
+// upgradeError answers a failed WebSocket handshake; it is the upgrader's Error hook
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	code := upgradeFailureCode(r, status)
+	log.Printf("WebSocket upgrade from %s failed (%s): %v", clientIP(r), code, reason)
+	metrics.IncCounter("signaling_upgrade_failures_total", "reason", code)
+	if status == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", http.MethodGet)
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"type":    "error",
+		"code":    code,
+		"message": strings.TrimPrefix(reason.Error(), "websocket: "),
+	})
+}
+
+// noteUpgradeError logs and counts a failed upgrade that upgradeError did
+// not see: the handshake broke after the connection was hijacked, so no
+// response is possible
+func noteUpgradeError(err error) {
+	var handshakeErr websocket.HandshakeError
+	if errors.As(err, &handshakeErr) {
+		return
+	}
+	log.Println("Upgrade error:", err)
+	metrics.IncCounter("signaling_upgrade_failures_total", "reason", "handshake-io")
+}
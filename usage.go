@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// usage is a snapshot of signaling traffic in bytes
+type usage struct {
+	BytesRead    int64 `json:"bytesRead"`
+	BytesWritten int64 `json:"bytesWritten"`
+}
+
+func (u usage) add(other usage) usage {
+	return usage{BytesRead: u.BytesRead + other.BytesRead, BytesWritten: u.BytesWritten + other.BytesWritten}
+}
+
+func (u usage) sub(other usage) usage {
+	return usage{BytesRead: u.BytesRead - other.BytesRead, BytesWritten: u.BytesWritten - other.BytesWritten}
+}
+
+// byteCounters accumulate a connection's traffic without taking any lock
+type byteCounters struct {
+	Read    atomic.Int64
+	Written atomic.Int64
+}
+
+// usage returns the client's traffic since it connected
+func (c *Client) usage() usage {
+	return usage{BytesRead: c.Traffic.Read.Load(), BytesWritten: c.Traffic.Written.Load()}
+}
+
+// usage returns the traffic of the room: what current clients exchanged since
+// they entered it plus what departed clients exchanged while they were in it
+func (r *Room) usage() usage {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	total := r.retiredUsage
+	for _, client := range r.Clients {
+		total = total.add(client.usage().sub(client.roomUsageBase))
+	}
+	return total
+}
+
+// retireUsage folds a departing client's traffic into the room's total. The
+// caller must hold r.Mutex.
+func (r *Room) retireUsage(client *Client) {
+	r.retiredUsage = r.retiredUsage.add(client.usage().sub(client.roomUsageBase))
+}
+
+// handleUsage reports signaling traffic per room and for the whole server
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	rooms := server.Rooms.List()
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	perRoom := make(map[string]usage, len(rooms))
+	total := usage{}
+	for _, room := range rooms {
+		roomUsage := room.usage()
+		perRoom[room.Name] = roomUsage
+		total = total.add(roomUsage)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"rooms": perRoom,
+		"total": total,
+	})
+}
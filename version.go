@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Clients may report an app version at join next to their protocol
+// version. Joins below -min-protocol or -min-app-version are rejected with
+// 'upgrade-required', and peers learn each other's versions from membership
+// events so they can adapt.
+
+// peerVersion is what peers are told about a client's versions
+type peerVersion struct {
+	Protocol   int    `json:"protocol"`
+	AppVersion string `json:"appVersion,omitempty"`
+}
+
+// checkVersion rejects joins from clients older than the configured minimums
+func checkVersion(protocol int, appVersion string) error {
+	if config.MinProtocol > 0 && protocol < config.MinProtocol {
+		return &joinError{Code: "upgrade-required", Message: fmt.Sprintf("protocol %d is no longer supported, %d or later is required", protocol, config.MinProtocol)}
+	}
+	if config.MinAppVersion == "" {
+		return nil
+	}
+	if appVersion == "" {
+		return &joinError{Code: "upgrade-required", Message: fmt.Sprintf("an app version of %s or later is required", config.MinAppVersion)}
+	}
+	if older, err := versionBefore(appVersion, config.MinAppVersion); err != nil || older {
+		return &joinError{Code: "upgrade-required", Message: fmt.Sprintf("app version %q is too old, %s or later is required", appVersion, config.MinAppVersion)}
+	}
+	return nil
+}
+
+// versionBefore reports whether dotted numeric version a is older than b,
+// e.g. "1.9" before "1.10". A leading "v" is ignored and missing components
+// count as zero.
+func versionBefore(a, b string) (bool, error) {
+	partsA, err := parseVersion(a)
+	if err != nil {
+		return false, err
+	}
+	partsB, err := parseVersion(b)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i < max(len(partsA), len(partsB)); i++ {
+		var x, y int
+		if i < len(partsA) {
+			x = partsA[i]
+		}
+		if i < len(partsB) {
+			y = partsB[i]
+		}
+		if x != y {
+			return x < y, nil
+		}
+	}
+	return false, nil
+}
+
+// parseVersion splits a dotted numeric version into its components
+func parseVersion(version string) ([]int, error) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if version == "" {
+		return nil, fmt.Errorf("no version")
+	}
+	fields := strings.Split(version, ".")
+	parts := make([]int, len(fields))
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		parts[i] = n
+	}
+	return parts, nil
+}
+
+// versionsOf returns the versions of the named clients in the room
+func (r *Room) versionsOf(names []string) map[string]peerVersion {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	versions := make(map[string]peerVersion, len(names))
+	for _, name := range names {
+		if client, exists := r.Clients[name]; exists {
+			versions[name] = peerVersion{Protocol: client.Protocol, AppVersion: client.AppVersion}
+		}
+	}
+	return versions
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Webhook delivery limits: events wait in a bounded queue so signaling never
+// blocks on a slow endpoint, and each one is retried with doubling backoff
+const (
+	webhookQueueSize = 1024
+	webhookAttempts  = 4
+	webhookBackoff   = 500 * time.Millisecond
+	webhookTimeout   = 5 * time.Second
+)
+
+// webhookEvent is the JSON body POSTed for one event
+type webhookEvent struct {
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// webhookPoster mirrors selected server events to -webhook-url
+type webhookPoster struct {
+	url    string
+	events map[string]bool
+	queue  chan webhookEvent
+	client *http.Client
+}
+
+// newWebhookPoster returns nil when no URL is configured, which makes emit a no-op
+func newWebhookPoster(url string, events []string) *webhookPoster {
+	if url == "" {
+		return nil
+	}
+	selected := make(map[string]bool, len(events))
+	for _, event := range events {
+		selected[event] = true
+	}
+	return &webhookPoster{
+		url:    url,
+		events: selected,
+		queue:  make(chan webhookEvent, webhookQueueSize),
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// emit queues an event for delivery if it is selected, dropping it when the queue is full
+func (p *webhookPoster) emit(event string, data interface{}) {
+	if p == nil || !p.events[event] {
+		return
+	}
+	select {
+	case p.queue <- webhookEvent{Event: event, Time: time.Now().UTC(), Data: data}:
+	default:
+		log.Printf("Webhook queue full. '%s' event dropped.", event)
+	}
+}
+
+// run delivers queued events in order until ctx is cancelled
+func (p *webhookPoster) run(ctx context.Context) {
+	for {
+		select {
+		case event := <-p.queue:
+			p.deliver(ctx, event)
+		case <-ctx.Done():
+			if pending := len(p.queue); pending > 0 {
+				log.Printf("Webhook stopped with %d events undelivered", pending)
+			}
+			return
+		}
+	}
+}
+
+// deliver posts one event, retrying with doubling backoff
+func (p *webhookPoster) deliver(ctx context.Context, event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Webhook encode error:", err)
+		return
+	}
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err = p.post(body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Printf("Webhook delivery of '%s' failed after %d attempts: %v", event.Event, attempt, err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			log.Printf("Webhook delivery of '%s' abandoned at shutdown: %v", event.Event, err)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// post sends one event body, treating any non-2xx status as a failure
+func (p *webhookPoster) post(body []byte) error {
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// sendWhereAmI answers a 'whereami' request with the client's room, role,
+// host and member count, read together under the room lock so they are
+// consistent. Clients use it to recover their state after a resume.
+func (c *Client) sendWhereAmI() {
+	room := c.room()
+	room.Mutex.Lock()
+	reply := map[string]interface{}{
+		"type":    "whereami",
+		"room":    room.Name,
+		"name":    c.name(),
+		"host":    room.Host,
+		"isHost":  room.Host == c.name(),
+		"members": room.occupancy(),
+		"mode":    room.mode(),
+	}
+	if c.role != "" {
+		reply["role"] = c.role
+	}
+	room.Mutex.Unlock()
+	replyJSON, _ := json.Marshal(reply)
+	c.trySend(replyJSON)
+}